@@ -1238,6 +1238,18 @@ function main.f_commandLine()
 			if main.flags['-p' .. num .. '.ai'] ~= nil then
 				ai = tonumber(main.flags['-p' .. num .. '.ai'])
 			end
+			if main.flags['-p' .. num .. '.bot'] ~= nil then
+				setAIController(num, main.flags['-p' .. num .. '.bot'])
+				if ai == 0 then
+					ai = 8
+				end
+			end
+			if main.flags['-p' .. num .. '.agent'] ~= nil then
+				setAIAgent(num, main.flags['-p' .. num .. '.agent'])
+				if ai == 0 then
+					ai = 8
+				end
+			end
 			if main.flags['-p' .. num .. '.input'] ~= nil then
 				remapInput(num, tonumber(main.flags['-p' .. num .. '.input']))
 			end
@@ -3222,17 +3234,81 @@ function main.f_replay()
 			main.close = true
 		elseif main.f_input(main.t_players, {'pal', 's'}) then
 			sndPlay(motif.files.snd_data, motif[main.group].cursor_done_snd[1], motif[main.group].cursor_done_snd[2])
-			enterReplay(t[item].itemname)
-			start.f_hardReset()
+			if enterReplay(t[item].itemname) then
+				if replayMatch() ~= nil then
+					main.f_playReplay()
+				else
+					start.f_hardReset()
+					synchronize()
+					math.randomseed(sszRandom())
+					main.f_cmdBufReset()
+					main.menu.submenu.server.loop()
+					replayStop()
+					exitNetPlay()
+				end
+			end
+			exitReplay()
+		end
+	end
+end
+
+--returns select.def reference of character def, adding it if needed
+local function f_replayCharRef(def)
+	for i, v in ipairs(main.t_selChars) do
+		if v.def ~= nil and v.def:lower() == def:lower() then
+			return i - 1
+		end
+	end
+	if main.t_charDef[def:lower()] == nil then
+		main.f_addChar(def .. ', exclude = 1', false, true)
+	end
+	return main.t_charDef[def:lower()]
+end
+
+--plays back the replay entered with enterReplay, setting up each recorded
+--match from the characters, stage and team settings stored in the file
+function main.f_playReplay()
+	local t = replayMatch()
+	while t ~= nil do
+		if #t.chars == 0 then
+			--netplay sessions synchronize once before their menus
 			synchronize()
 			math.randomseed(sszRandom())
-			main.f_cmdBufReset()
-			main.menu.submenu.server.loop()
-			replayStop()
-			exitNetPlay()
-			exitReplay()
+		else
+			main.f_default()
+			setGameMode('replay')
+			for i = 1, 2 do
+				local num = t.numsimul[i]
+				if t.teammode[i] == 2 then --Turns
+					num = t.numturns[i]
+				end
+				setTeamMode(i, t.teammode[i], math.max(1, num))
+				setMatchWins(i, t.matchwins[i])
+			end
+			setRoundTime(t.roundtime)
+			for _, v in ipairs(t.chars) do
+				local ref = f_replayCharRef(v.def)
+				if ref == nil then
+					panicError("\nUnable to add character. No such file or directory: " .. v.def .. "\n")
+				end
+				selectChar(2 - v.player % 2, ref, v.pal)
+				setCom(v.player, v.com)
+			end
+			if main.t_stageDef[t.stage:lower()] == nil then
+				main.f_addStage(t.stage)
+			end
+			start.f_setMusic(start.f_setStage(main.t_stageDef[t.stage:lower()], true))
+			clearColor(0, 0, 0)
+			loadStart()
+			game()
+			if gameend() then
+				os.exit()
+			end
 		end
+		t = replayMatch()
 	end
+	main.f_bgReset(motif[main.background].bg)
+	main.f_playBGM(true, motif.music.title_bgm, motif.music.title_bgm_loop, motif.music.title_bgm_volume, motif.music.title_bgm_loopstart, motif.music.title_bgm_loopend)
 end
 
 local txt_connecting = main.f_createTextImg(motif.title_info, 'connecting')
@@ -4011,6 +4087,29 @@ if main.flags['-stresstest'] ~= nil then
 	os.exit()
 end
 
+if main.flags['-replay'] ~= nil then
+	main.f_default()
+	if enterReplay(main.flags['-replay']) then
+		main.f_playReplay()
+	end
+	exitReplay()
+	os.exit()
+end
+
+if main.flags['-spectate'] ~= nil then
+	main.f_default()
+	if enterSpectate(main.flags['-spectate']) then
+		start.f_hardReset()
+		synchronize()
+		math.randomseed(sszRandom())
+		main.f_cmdBufReset()
+		main.menu.submenu.server.loop()
+		replayStop()
+		exitNetPlay()
+	end
+	exitReplay()
+end
+
 main.f_loadingRefresh(main.txt_loading)
 main.txt_loading = nil
 --sleep(1)
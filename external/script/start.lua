@@ -1394,7 +1394,14 @@ function start.f_game(lua)
 	local p2In = main.t_pIn[2]
 	main.t_pIn[2] = 2
 	if lua ~= '' then commonLuaInsert(lua) end
+	local record = config.RecordReplays and not network()
+	if record then
+		replayRecord('save/replays/' .. os.date("%Y-%m-%d %I-%M%p-%Ss") .. '.replay')
+	end
 	local winner, tbl = game()
+	if record then
+		replayStop()
+	end
 	if lua ~= '' then commonLuaDelete(lua) end
 	if gameend() then
 		clearColor(0, 0, 0)
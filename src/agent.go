@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// agentController lets a program outside of the engine play as a computer
+// controlled player, in lock step with the match. Every frame the agent is
+// sent the AiView of its player as one line of JSON, and the match waits
+// until it answers with a line holding the InputBits as a number, or the
+// keys as read by aiKeyBits. When a match is over it is sent a line with
+// "done" set and the winning team, which needs no answer.
+type agentController struct {
+	addr string
+	conn io.ReadWriteCloser
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+type agentMatchOver struct {
+	Done    bool  `json:"done"`
+	WinTeam int32 `json:"winteam"`
+}
+
+// Standard input and output, for an agent that starts the engine itself.
+// The output is kept for the agent alone, anything else the engine prints
+// going to standard error.
+type agentStdio struct{ out *os.File }
+
+var agentStdout *os.File
+
+// Takes standard output for an agent, before anything else gets printed to it
+func reserveStdout() *os.File {
+	if agentStdout == nil {
+		agentStdout, os.Stdout = os.Stdout, os.Stderr
+	}
+	return agentStdout
+}
+
+func (agentStdio) Read(p []byte) (int, error)     { return os.Stdin.Read(p) }
+func (as agentStdio) Write(p []byte) (int, error) { return as.out.Write(p) }
+func (agentStdio) Close() error                   { return nil }
+
+// Waits for a program to connect to addr, which is "stdio", "unix:<path>" or
+// a TCP address the engine listens on, eg. 127.0.0.1:7500
+func acceptLocal(addr string) (io.ReadWriteCloser, error) {
+	if addr == "stdio" {
+		return agentStdio{reserveStdout()}, nil
+	}
+	network, address := "tcp", addr
+	if strings.HasPrefix(addr, "unix:") {
+		network, address = "unix", addr[len("unix:"):]
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	fmt.Fprintf(os.Stderr, "Waiting for a connection on %v\n", addr)
+	return ln.Accept()
+}
+func newAgentController(addr string) (*agentController, error) {
+	conn, err := acceptLocal(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &agentController{addr: addr, conn: conn, r: bufio.NewReader(conn),
+		w: bufio.NewWriter(conn)}, nil
+}
+
+// The player gets no more input once the agent has gone
+func (ac *agentController) fail(err error) {
+	sys.errLog.Printf("Agent %v: %v\n", ac.addr, err)
+	ac.conn.Close()
+	ac.conn = nil
+}
+func (ac *agentController) send(v interface{}) bool {
+	if ac.conn == nil {
+		return false
+	}
+	b, err := json.Marshal(v)
+	if err == nil {
+		if _, err = ac.w.Write(append(b, '\n')); err == nil {
+			err = ac.w.Flush()
+		}
+	}
+	if err != nil {
+		ac.fail(err)
+		return false
+	}
+	return true
+}
+func (ac *agentController) Input(v *AiView) InputBits {
+	if !ac.send(v) {
+		return 0
+	}
+	line, err := ac.r.ReadString('\n')
+	if err != nil {
+		ac.fail(err)
+		return 0
+	}
+	line = strings.TrimSpace(line)
+	if ib, err := strconv.ParseInt(line, 10, 32); err == nil {
+		return InputBits(ib)
+	}
+	return aiKeyBits(line, v.Self.Facing)
+}
+
+// Binds player pn to the agent at addr, keeping the connection if it is
+// already bound to it
+func (s *System) setAiAgent(pn int, addr string) error {
+	for _, ctl := range s.aiController {
+		if ac, ok := ctl.(*agentController); ok && ac.addr == addr && ac.conn != nil {
+			s.aiController[pn] = ac
+			return nil
+		}
+	}
+	ac, err := newAgentController(addr)
+	if err != nil {
+		return err
+	}
+	s.aiController[pn] = ac
+	return nil
+}
+
+// Tells every agent that the match is over, where winp is the winning team
+// or 0 on a draw
+func (s *System) agentMatchOver(winp int32) {
+	for i, ctl := range s.aiController {
+		if ac, ok := ctl.(*agentController); ok {
+			shared := false
+			for _, prev := range s.aiController[:i] {
+				shared = shared || prev == ctl
+			}
+			if !shared {
+				ac.send(agentMatchOver{Done: true, WinTeam: winp})
+			}
+		}
+	}
+}
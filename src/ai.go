@@ -0,0 +1,256 @@
+package main
+
+import (
+	"math/rand"
+
+	"github.com/Windblade-GR01/Ikemen_GO/src/src/env"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// AiController replaces the random input of AiInput for a computer
+// controlled player. Input is called once per frame with what the player can
+// see of the match, and returns the keys to hold, with left and right as seen
+// on the screen. Recorded matches play back the keys that were returned
+// instead of asking the controller again, so controllers must not draw from
+// the random numbers of the match.
+type AiController interface {
+	Input(v *AiView) InputBits
+}
+
+// What controllers see of the match, which is also what training agents of
+// the env package see
+type AiView = env.AiView
+type AiCharView = env.AiCharView
+
+func (st StateType) viewString() string {
+	switch st {
+	case ST_S:
+		return "S"
+	case ST_C:
+		return "C"
+	case ST_A:
+		return "A"
+	case ST_L:
+		return "L"
+	}
+	return "U"
+}
+func (mt MoveType) viewString() string {
+	switch mt {
+	case MT_I:
+		return "I"
+	case MT_A:
+		return "A"
+	case MT_H:
+		return "H"
+	}
+	return "U"
+}
+
+// Describes c as seen from self
+func newAiCharView(self, c *Char) AiCharView {
+	return AiCharView{Player: c.playerNo + 1, Name: c.name,
+		Pos:       [...]float32{c.pos[0] * c.localscl / self.localscl, c.pos[1] * c.localscl / self.localscl},
+		Vel:       [...]float32{c.vel[0] * c.localscl / self.localscl, c.vel[1] * c.localscl / self.localscl},
+		Facing:    c.facing,
+		DistX:     self.facing * self.distX(c, self),
+		DistY:     (c.pos[1]*c.localscl - self.pos[1]*self.localscl) / self.localscl,
+		StateNo:   c.ss.no,
+		StateType: c.ss.stateType.viewString(),
+		MoveType:  c.ss.moveType.viewString(),
+		Anim:      c.animNo,
+		AnimTime:  c.animTime(),
+		Ctrl:      c.ctrl(),
+		Alive:     c.alive(),
+		HitPause:  c.hitPause(),
+		Life:      c.life,
+		LifeMax:   c.lifeMax,
+		Power:     c.getPower(),
+		PowerMax:  c.powerMax}
+}
+
+// Returns what player pn can see of the match, or nil if it is not playing
+func newAiView(pn int) *AiView {
+	if pn < 0 || pn >= len(sys.chars) || len(sys.chars[pn]) == 0 {
+		return nil
+	}
+	self := sys.chars[pn][0]
+	v := &AiView{Player: pn + 1, Level: sys.com[pn], GameTime: sys.gameTime,
+		Round: sys.round, RoundState: self.roundState(),
+		Self: newAiCharView(self, self)}
+	if p2 := self.p2(); p2 != nil {
+		cv := newAiCharView(self, p2)
+		v.P2 = &cv
+	}
+	for i, p := range sys.chars {
+		if i == pn || len(p) == 0 || p[0].teamside == -1 ||
+			p[0].scf(SCF_standby) || p[0].scf(SCF_disabled) {
+			continue
+		}
+		if i&1 != pn&1 {
+			v.Enemies = append(v.Enemies, newAiCharView(self, p[0]))
+		} else {
+			v.Partners = append(v.Partners, newAiCharView(self, p[0]))
+		}
+	}
+	return v
+}
+
+// Returns the keys named in s as read by env.ParseKeys
+func aiKeyBits(s string, facing float32) InputBits {
+	return InputBits(env.ParseKeys(s, facing))
+}
+
+// AI controllers written in Go, by name, each making a new controller for
+// the player number it is given
+var aiControllers = map[string]func(pn int) AiController{
+	"basic": func(int) AiController { return &basicBot{} },
+}
+
+func RegisterAiController(name string, f func(pn int) AiController) {
+	aiControllers[name] = f
+}
+
+// A Lua function, given the view as a table, returning either the InputBits
+// as a number or a string of keys as read by aiKeyBits
+type luaAiController struct {
+	fn *lua.LFunction
+}
+
+func (lc *luaAiController) Input(v *AiView) InputBits {
+	l := sys.luaLState
+	top := l.GetTop()
+	defer l.SetTop(top)
+	if err := l.CallByParam(lua.P{Fn: lc.fn, NRet: 1, Protect: true},
+		aiViewTable(l, v)); err != nil {
+		sys.errLog.Println(err.Error())
+		return 0
+	}
+	switch ret := l.Get(-1).(type) {
+	case lua.LNumber:
+		return InputBits(ret)
+	case lua.LString:
+		return aiKeyBits(string(ret), v.Self.Facing)
+	}
+	return 0
+}
+
+func aiCharViewTable(l *lua.LState, cv *AiCharView) *lua.LTable {
+	t := l.NewTable()
+	t.RawSetString("player", lua.LNumber(cv.Player))
+	t.RawSetString("name", lua.LString(cv.Name))
+	t.RawSetString("x", lua.LNumber(cv.Pos[0]))
+	t.RawSetString("y", lua.LNumber(cv.Pos[1]))
+	t.RawSetString("velx", lua.LNumber(cv.Vel[0]))
+	t.RawSetString("vely", lua.LNumber(cv.Vel[1]))
+	t.RawSetString("facing", lua.LNumber(cv.Facing))
+	t.RawSetString("distx", lua.LNumber(cv.DistX))
+	t.RawSetString("disty", lua.LNumber(cv.DistY))
+	t.RawSetString("stateno", lua.LNumber(cv.StateNo))
+	t.RawSetString("statetype", lua.LString(cv.StateType))
+	t.RawSetString("movetype", lua.LString(cv.MoveType))
+	t.RawSetString("anim", lua.LNumber(cv.Anim))
+	t.RawSetString("animtime", lua.LNumber(cv.AnimTime))
+	t.RawSetString("ctrl", lua.LBool(cv.Ctrl))
+	t.RawSetString("alive", lua.LBool(cv.Alive))
+	t.RawSetString("hitpause", lua.LBool(cv.HitPause))
+	t.RawSetString("life", lua.LNumber(cv.Life))
+	t.RawSetString("lifemax", lua.LNumber(cv.LifeMax))
+	t.RawSetString("power", lua.LNumber(cv.Power))
+	t.RawSetString("powermax", lua.LNumber(cv.PowerMax))
+	return t
+}
+func aiViewTable(l *lua.LState, v *AiView) *lua.LTable {
+	t := l.NewTable()
+	t.RawSetString("player", lua.LNumber(v.Player))
+	t.RawSetString("level", lua.LNumber(v.Level))
+	t.RawSetString("gametime", lua.LNumber(v.GameTime))
+	t.RawSetString("round", lua.LNumber(v.Round))
+	t.RawSetString("roundstate", lua.LNumber(v.RoundState))
+	t.RawSetString("self", aiCharViewTable(l, &v.Self))
+	if v.P2 != nil {
+		t.RawSetString("p2", aiCharViewTable(l, v.P2))
+	}
+	for _, s := range [...]struct {
+		name  string
+		chars []AiCharView
+	}{{"enemies", v.Enemies}, {"partners", v.Partners}} {
+		ct := l.NewTable()
+		for i := range s.chars {
+			ct.Append(aiCharViewTable(l, &s.chars[i]))
+		}
+		t.RawSetString(s.name, ct)
+	}
+	return t
+}
+
+// Sets the controller of player pn from a Lua value, which is either the
+// name of a Go controller, the name of a global Lua function or a function.
+// Anything else gives the player back the default AI.
+func setAiController(l *lua.LState, pn int, lv lua.LValue) {
+	sys.aiController[pn] = nil
+	switch v := lv.(type) {
+	case *lua.LFunction:
+		sys.aiController[pn] = &luaAiController{fn: v}
+	case lua.LString:
+		if f, ok := aiControllers[string(v)]; ok {
+			sys.aiController[pn] = f(pn)
+		} else if fn, ok := l.GetGlobal(string(v)).(*lua.LFunction); ok {
+			sys.aiController[pn] = &luaAiController{fn: fn}
+		} else if v != "" {
+			l.RaiseError("\nUnknown AI controller: %v\n", v)
+		}
+	}
+}
+
+// A simple opponent: it walks up to P2, guards while P2 attacks and throws
+// random attacks when in reach
+type basicBot struct {
+	hold InputBits
+	time int32
+	rnd  *rand.Rand
+}
+
+// Random numbers of the bot, seeded from those of the match without drawing
+// from them
+func (bb *basicBot) rand(min, max int32) int32 {
+	if bb.rnd == nil {
+		bb.rnd = rand.New(rand.NewSource(int64(sys.randseed)))
+	}
+	return min + bb.rnd.Int31n(max-min+1)
+}
+
+func (bb *basicBot) Input(v *AiView) InputBits {
+	p2 := v.P2
+	if v.RoundState != 2 || p2 == nil {
+		return 0
+	}
+	if bb.time > 0 {
+		bb.time--
+		return bb.hold
+	}
+	bb.hold = 0
+	dist := p2.DistX
+	switch {
+	case p2.MoveType == "A" && dist < 120:
+		bb.hold = aiKeyBits("B", v.Self.Facing)
+		if p2.StateType == "C" {
+			bb.hold |= IB_PD
+		}
+	case !v.Self.Ctrl:
+	case dist > 60:
+		bb.hold = aiKeyBits("F", v.Self.Facing)
+		if dist > 150 && bb.rand(0, 29) == 0 {
+			bb.hold |= IB_PU
+		}
+	default:
+		bb.hold = [...]InputBits{IB_A, IB_B, IB_C, IB_X, IB_Y, IB_Z}[bb.rand(0, 5)]
+		if bb.rand(0, 2) == 0 {
+			bb.hold |= IB_PD
+		}
+		bb.time = 2
+		return bb.hold
+	}
+	bb.time = bb.rand(0, 4)
+	return bb.hold
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/gob"
+	"fmt"
 	"math"
 	"os"
 	"path/filepath"
@@ -65,6 +66,8 @@ const (
 	VT_Int
 	VT_Bool
 	VT_SFalse
+	VT_String
+	VT_Array
 )
 
 type OpCode byte
@@ -328,6 +331,8 @@ const (
 	OC_const_stagevar_info_name
 	OC_const_constants
 	OC_const_stage_constants
+	OC_const_constants_cached
+	OC_const_stage_constants_cached
 )
 const (
 	OC_st_var OpCode = iota + OC_var*2
@@ -472,6 +477,11 @@ const (
 	OC_ex_timetotal
 	OC_ex_pos_z
 	OC_ex_vel_z
+	OC_ex_string
+	OC_ex_array
+	OC_ex_index
+	OC_ex_st_index
+	OC_ex_len
 )
 const (
 	NumVar     = OC_sysvar0 - OC_var0
@@ -504,6 +514,9 @@ func (sp *StringPool) Add(s string) int {
 type BytecodeValue struct {
 	t ValueType
 	v float64
+	// string of a VT_String, []BytecodeValue of a VT_Array, which is never
+	// modified once created so that values can be copied freely
+	x interface{}
 }
 
 func (bv BytecodeValue) IsNone() bool { return bv.t == VT_None }
@@ -521,44 +534,96 @@ func (bv BytecodeValue) ToI() int32 {
 	return int32(bv.v)
 }
 func (bv BytecodeValue) ToB() bool {
-	if bv.IsSF() || bv.v == 0 {
+	switch bv.t {
+	case VT_SFalse:
 		return false
+	case VT_String:
+		return bv.ToS() != ""
+	case VT_Array:
+		return len(bv.ToA()) > 0
 	}
-	return true
+	return bv.v != 0
+}
+func (bv BytecodeValue) ToS() string {
+	switch bv.t {
+	case VT_String:
+		s, _ := bv.x.(string)
+		return s
+	case VT_Array:
+		a := bv.ToA()
+		ss := make([]string, len(a))
+		for i, v := range a {
+			ss[i] = v.ToS()
+		}
+		return "[" + strings.Join(ss, ", ") + "]"
+	case VT_Float:
+		return fmt.Sprint(float32(bv.v))
+	case VT_Int, VT_Bool:
+		return fmt.Sprint(int32(bv.v))
+	}
+	return ""
+}
+func (bv BytecodeValue) ToA() []BytecodeValue {
+	a, _ := bv.x.([]BytecodeValue)
+	return a
 }
 func (bv *BytecodeValue) SetF(f float32) {
 	if math.IsNaN(float64(f)) {
 		*bv = BytecodeSF()
 	} else {
-		*bv = BytecodeValue{VT_Float, float64(f)}
+		*bv = BytecodeValue{t: VT_Float, v: float64(f)}
 	}
 }
 func (bv *BytecodeValue) SetI(i int32) {
-	*bv = BytecodeValue{VT_Int, float64(i)}
+	*bv = BytecodeValue{t: VT_Int, v: float64(i)}
 }
 func (bv *BytecodeValue) SetB(b bool) {
-	bv.t = VT_Bool
-	if b {
-		bv.v = 1
-	} else {
-		bv.v = 0
-	}
+	*bv = BytecodeBool(b)
 }
 
 func bvNone() BytecodeValue {
-	return BytecodeValue{VT_None, 0}
+	return BytecodeValue{t: VT_None}
 }
 func BytecodeSF() BytecodeValue {
-	return BytecodeValue{VT_SFalse, math.NaN()}
+	return BytecodeValue{t: VT_SFalse, v: math.NaN()}
 }
 func BytecodeFloat(f float32) BytecodeValue {
-	return BytecodeValue{VT_Float, float64(f)}
+	return BytecodeValue{t: VT_Float, v: float64(f)}
 }
 func BytecodeInt(i int32) BytecodeValue {
-	return BytecodeValue{VT_Int, float64(i)}
+	return BytecodeValue{t: VT_Int, v: float64(i)}
 }
 func BytecodeBool(b bool) BytecodeValue {
-	return BytecodeValue{VT_Bool, float64(Btoi(b))}
+	return BytecodeValue{t: VT_Bool, v: float64(Btoi(b))}
+}
+func BytecodeString(s string) BytecodeValue {
+	return BytecodeValue{t: VT_String, x: s}
+}
+func BytecodeArray(a []BytecodeValue) BytecodeValue {
+	return BytecodeValue{t: VT_Array, x: a}
+}
+
+// Whether two values are equal, where strings and arrays only equal values
+// of the same type
+func (bv BytecodeValue) equals(v BytecodeValue) bool {
+	switch {
+	case bv.t == VT_String || v.t == VT_String:
+		return bv.t == v.t && bv.ToS() == v.ToS()
+	case bv.t == VT_Array || v.t == VT_Array:
+		if bv.t != v.t || len(bv.ToA()) != len(v.ToA()) {
+			return false
+		}
+		a := v.ToA()
+		for i, e := range bv.ToA() {
+			if !e.equals(a[i]) {
+				return false
+			}
+		}
+		return true
+	case ValueType(Min(int32(bv.t), int32(v.t))) == VT_Float:
+		return bv.ToF() == v.ToF()
+	}
+	return bv.ToI() == v.ToI()
 }
 
 type BytecodeStack []BytecodeValue
@@ -694,7 +759,9 @@ func (BytecodeExp) mod(v1 *BytecodeValue, v2 BytecodeValue) {
 	}
 }
 func (BytecodeExp) add(v1 *BytecodeValue, v2 BytecodeValue) {
-	if ValueType(Min(int32(v1.t), int32(v2.t))) == VT_Float {
+	if v1.t == VT_String || v2.t == VT_String {
+		*v1 = BytecodeString(v1.ToS() + v2.ToS())
+	} else if ValueType(Min(int32(v1.t), int32(v2.t))) == VT_Float {
 		v1.SetF(v1.ToF() + v2.ToF())
 	} else {
 		v1.SetI(v1.ToI() + v2.ToI())
@@ -736,17 +803,30 @@ func (BytecodeExp) le(v1 *BytecodeValue, v2 BytecodeValue) {
 	}
 }
 func (BytecodeExp) eq(v1 *BytecodeValue, v2 BytecodeValue) {
-	if ValueType(Min(int32(v1.t), int32(v2.t))) == VT_Float {
-		v1.SetB(v1.ToF() == v2.ToF())
-	} else {
-		v1.SetB(v1.ToI() == v2.ToI())
-	}
+	v1.SetB(v1.equals(v2))
 }
 func (BytecodeExp) ne(v1 *BytecodeValue, v2 BytecodeValue) {
-	if ValueType(Min(int32(v1.t), int32(v2.t))) == VT_Float {
-		v1.SetB(v1.ToF() != v2.ToF())
-	} else {
-		v1.SetB(v1.ToI() != v2.ToI())
+	v1.SetB(!v1.equals(v2))
+}
+func (BytecodeExp) index(v1 *BytecodeValue, v2 BytecodeValue) {
+	i := int(v2.ToI())
+	switch {
+	case v1.t == VT_Array && i >= 0 && i < len(v1.ToA()):
+		*v1 = v1.ToA()[i]
+	case v1.t == VT_String && i >= 0 && i < len(v1.ToS()):
+		*v1 = BytecodeString(v1.ToS()[i : i+1])
+	default:
+		*v1 = BytecodeSF()
+	}
+}
+func (BytecodeExp) length(v1 *BytecodeValue) {
+	switch v1.t {
+	case VT_Array:
+		v1.SetI(int32(len(v1.ToA())))
+	case VT_String:
+		v1.SetI(int32(len(v1.ToS())))
+	default:
+		*v1 = BytecodeSF()
 	}
 }
 func (BytecodeExp) and(v1 *BytecodeValue, v2 BytecodeValue) {
@@ -1584,6 +1664,12 @@ func (be BytecodeExp) run_const(c *Char, i *int, oc *Char) {
 		sys.bcStack.PushF(sys.stage.constants[sys.stringPool[sys.workingState.playerNo].List[*(*int32)(
 			unsafe.Pointer(&be[*i]))]])
 		*i += 4
+	case OC_const_constants_cached:
+		sys.bcStack.PushF(c.cachedConst(*(*int32)(unsafe.Pointer(&be[*i])), false))
+		*i += 4
+	case OC_const_stage_constants_cached:
+		sys.bcStack.PushF(c.cachedConst(*(*int32)(unsafe.Pointer(&be[*i])), true))
+		*i += 4
 	default:
 		sys.errLog.Printf("%v\n", be[*i-1])
 		c.panic()
@@ -1791,7 +1877,7 @@ func (be BytecodeExp) run_ex(c *Char, i *int, oc *Char) {
 	case OC_ex_majorversion:
 		sys.bcStack.PushI(int32(c.gi().ver[0]))
 	case OC_ex_maparray:
-		sys.bcStack.PushF(c.mapArray[sys.stringPool[sys.workingState.playerNo].List[*(*int32)(unsafe.Pointer(&be[*i]))]])
+		sys.bcStack.Push(c.mapValue(sys.stringPool[sys.workingState.playerNo].List[*(*int32)(unsafe.Pointer(&be[*i]))]))
 		*i += 4
 	case OC_ex_max:
 		v2 := sys.bcStack.Pop()
@@ -1858,6 +1944,31 @@ func (be BytecodeExp) run_ex(c *Char, i *int, oc *Char) {
 		sys.bcStack.PushF(c.pos[2] * c.localscl / oc.localscl)
 	case OC_ex_vel_z:
 		sys.bcStack.PushF(c.vel[2] * c.localscl / oc.localscl)
+	case OC_ex_string:
+		sys.bcStack.Push(BytecodeString(sys.stringPool[sys.workingState.playerNo].List[*(*int32)(unsafe.Pointer(&be[*i]))]))
+		*i += 4
+	case OC_ex_array:
+		n := int(*(*int32)(unsafe.Pointer(&be[*i])))
+		a := make([]BytecodeValue, n)
+		copy(a, sys.bcStack[len(sys.bcStack)-n:])
+		sys.bcStack = sys.bcStack[:len(sys.bcStack)-n]
+		sys.bcStack.Push(BytecodeArray(a))
+		*i += 4
+	case OC_ex_index:
+		v2 := sys.bcStack.Pop()
+		be.index(sys.bcStack.Top(), v2)
+	case OC_ex_st_index:
+		v := sys.bcStack.Pop()
+		a, idx := sys.bcVar[uint8(be[*i])].ToA(), sys.bcStack.Top().ToI()
+		if idx >= 0 && int(idx) < len(a) {
+			a = append([]BytecodeValue{}, a...)
+			a[idx] = v
+			sys.bcVar[uint8(be[*i])] = BytecodeArray(a)
+		}
+		*sys.bcStack.Top() = v
+		*i++
+	case OC_ex_len:
+		be.length(sys.bcStack.Top())
 	default:
 		sys.errLog.Printf("%v\n", be[*i-1])
 		c.panic()
@@ -1897,7 +2008,7 @@ func (bf bytecodeFunction) run(c *Char, ret []uint8) (changeState bool) {
 	}
 	copy(sys.bcVar, sys.bcStack)
 	sys.bcStack.Clear()
-	for _, sc := range bf.ctrls {
+	for i, sc := range bf.ctrls {
 		switch sc.(type) {
 		case StateBlock:
 		default:
@@ -1905,7 +2016,7 @@ func (bf bytecodeFunction) run(c *Char, ret []uint8) (changeState bool) {
 				continue
 			}
 		}
-		if sc.Run(c, nil) {
+		if sys.profiler.runCtrl(c, &bf.ctrls[i], i, nil) {
 			changeState = true
 			break
 		}
@@ -1937,6 +2048,21 @@ func (cf callFunction) Run(c *Char, _ []int32) (changeState bool) {
 	return cf.run(c, cf.ret)
 }
 
+// Set by break and continue, and cleared by the loop they belong to once the
+// blocks between them have returned
+type LoopJump int32
+
+const (
+	LJ_None LoopJump = iota
+	LJ_Break
+	LJ_Continue
+)
+
+// Loops stop once all of them together have gone round this many times in
+// one run of a state, so that nested loops or loops that never end cannot
+// hang the game
+const MaxLoopIterations = 2500
+
 type StateBlock struct {
 	persistent          int32
 	persistentIndex     int32
@@ -1945,6 +2071,12 @@ type StateBlock struct {
 	trigger             BytecodeExp
 	elseBlock           *StateBlock
 	ctrls               []StateController
+	// A while loop runs ctrls for as long as trigger holds, and a for loop
+	// counts forVar from forExp[0] to forExp[1] inclusive, by forExp[2] or 1
+	loop    bool
+	forLoop bool
+	forVar  uint8
+	forExp  [3]BytecodeExp
 }
 
 func newStateBlock() *StateBlock {
@@ -1970,13 +2102,30 @@ func (b StateBlock) Run(c *Char, ps []int32) (changeState bool) {
 		}
 	}
 	sys.workingChar = c
-	if len(b.trigger) > 0 && !b.trigger.evalB(c) {
-		if b.elseBlock != nil {
-			return b.elseBlock.Run(c, ps)
+	if b.loop {
+		if b.runLoop(c, ps) {
+			return true
 		}
-		return false
+	} else {
+		if len(b.trigger) > 0 && !b.trigger.evalB(c) {
+			if b.elseBlock != nil {
+				return b.elseBlock.Run(c, ps)
+			}
+			return false
+		}
+		if b.runCtrls(c, ps) {
+			return true
+		}
+	}
+	if b.persistentIndex >= 0 {
+		ps[b.persistentIndex] = b.persistent
 	}
-	for _, sc := range b.ctrls {
+	return false
+}
+
+// Stops early on a break or continue, leaving it to the loop to clear
+func (b StateBlock) runCtrls(c *Char, ps []int32) bool {
+	for i, sc := range b.ctrls {
 		switch sc.(type) {
 		case StateBlock:
 		default:
@@ -1984,13 +2133,60 @@ func (b StateBlock) Run(c *Char, ps []int32) (changeState bool) {
 				continue
 			}
 		}
-		if sc.Run(c, ps) {
+		if sys.profiler.runCtrl(c, &b.ctrls[i], i, ps) {
 			return true
 		}
+		if sys.loopJump != LJ_None {
+			break
+		}
 	}
-	if b.persistentIndex >= 0 {
-		ps[b.persistentIndex] = b.persistent
+	return false
+}
+func (b StateBlock) runLoop(c *Char, ps []int32) bool {
+	var i, end, step int32
+	if b.forLoop {
+		i, end, step = b.forExp[0].evalI(c), b.forExp[1].evalI(c), 1
+		if len(b.forExp[2]) > 0 {
+			step = b.forExp[2].evalI(c)
+		}
 	}
+	for {
+		if b.forLoop {
+			if step >= 0 && i > end || step < 0 && i < end {
+				break
+			}
+			sys.bcVar[b.forVar] = BytecodeInt(i)
+		} else if !b.trigger.evalB(c) {
+			break
+		}
+		if sys.loopIterations >= MaxLoopIterations {
+			// Warn once per run of the state
+			if sys.loopIterations == MaxLoopIterations {
+				sys.appendToConsole(c.warn() + fmt.Sprintf("loops stopped after %v iterations",
+					MaxLoopIterations))
+				sys.loopIterations++
+			}
+			break
+		}
+		sys.loopIterations++
+		if b.runCtrls(c, ps) {
+			sys.loopJump = LJ_None
+			return true
+		}
+		jump := sys.loopJump
+		sys.loopJump = LJ_None
+		if jump == LJ_Break {
+			break
+		}
+		i += step
+	}
+	return false
+}
+
+type loopJump LoopJump
+
+func (lj loopJump) Run(_ *Char, _ []int32) (changeState bool) {
+	sys.loopJump = LoopJump(lj)
 	return false
 }
 
@@ -5488,6 +5684,7 @@ type displayToClipboard StateControllerBase
 const (
 	displayToClipboard_params byte = iota
 	displayToClipboard_text
+	displayToClipboard_textexp
 	displayToClipboard_redirectid
 )
 
@@ -5498,9 +5695,12 @@ func (sc displayToClipboard) Run(c *Char, _ []int32) bool {
 		switch id {
 		case displayToClipboard_params:
 			for _, e := range exp {
-				if bv := e.run(c); bv.t == VT_Float {
+				switch bv := e.run(c); bv.t {
+				case VT_Float:
 					params = append(params, bv.ToF())
-				} else {
+				case VT_String, VT_Array:
+					params = append(params, bv.ToS())
+				default:
 					params = append(params, bv.ToI())
 				}
 			}
@@ -5508,6 +5708,9 @@ func (sc displayToClipboard) Run(c *Char, _ []int32) bool {
 			crun.clipboardText = nil
 			crun.appendToClipboard(sys.workingState.playerNo,
 				int(exp[0].evalI(c)), params...)
+		case displayToClipboard_textexp:
+			crun.clipboardText = nil
+			crun.appendClipboardText(exp[0].run(c).ToS(), params...)
 		case displayToClipboard_redirectid:
 			if rid := sys.playerID(exp[0].evalI(c)); rid != nil {
 				crun = rid
@@ -5529,15 +5732,20 @@ func (sc appendToClipboard) Run(c *Char, _ []int32) bool {
 		switch id {
 		case displayToClipboard_params:
 			for _, e := range exp {
-				if bv := e.run(c); bv.t == VT_Float {
+				switch bv := e.run(c); bv.t {
+				case VT_Float:
 					params = append(params, bv.ToF())
-				} else {
+				case VT_String, VT_Array:
+					params = append(params, bv.ToS())
+				default:
 					params = append(params, bv.ToI())
 				}
 			}
 		case displayToClipboard_text:
 			crun.appendToClipboard(sys.workingState.playerNo,
 				int(exp[0].evalI(c)), params...)
+		case displayToClipboard_textexp:
+			crun.appendClipboardText(exp[0].run(c).ToS(), params...)
 		case displayToClipboard_redirectid:
 			if rid := sys.playerID(exp[0].evalI(c)); rid != nil {
 				crun = rid
@@ -6741,14 +6949,14 @@ const (
 func (sc mapSet) Run(c *Char, _ []int32) bool {
 	crun := c
 	var s string
-	var value float32
+	value := BytecodeFloat(0)
 	var scType int32
 	StateControllerBase(sc).run(c, func(id byte, exp []BytecodeExp) bool {
 		switch id {
 		case mapSet_mapArray:
 			s = string(*(*[]byte)(unsafe.Pointer(&exp[0])))
 		case mapSet_value:
-			value = exp[0].evalF(c)
+			value = exp[0].run(c)
 		case mapSet_type:
 			scType = exp[0].evalI(c)
 		case mapSet_redirectid:
@@ -6760,7 +6968,7 @@ func (sc mapSet) Run(c *Char, _ []int32) bool {
 		}
 		return true
 	})
-	crun.mapSet(s, value, scType)
+	crun.mapSetValue(s, value, scType)
 	return false
 }
 
@@ -6882,9 +7090,12 @@ func (sc printToConsole) Run(c *Char, _ []int32) bool {
 		switch id {
 		case printToConsole_params:
 			for _, e := range exp {
-				if bv := e.run(c); bv.t == VT_Float {
+				switch bv := e.run(c); bv.t {
+				case VT_Float:
 					params = append(params, bv.ToF())
-				} else {
+				case VT_String, VT_Array:
+					params = append(params, bv.ToS())
+				default:
 					params = append(params, bv.ToI())
 				}
 			}
@@ -7336,8 +7547,12 @@ func (sb *StateBytecode) init(c *Char) {
 	sb.stateDef.Run(c)
 }
 func (sb *StateBytecode) run(c *Char) (changeState bool) {
+	if sys.profiler.enabled {
+		defer sys.profiler.endState(sys.profiler.beginState(c, sb.playerNo))
+	}
 	sys.bcVar = sys.bcVarStack.Alloc(int(sb.numVars))
 	sys.workingState = sb
+	sys.loopIterations = 0
 	changeState = sb.block.Run(c, sb.ctrlsps)
 	if len(sys.bcStack) != 0 {
 		sys.errLog.Println(sys.cgi[sb.playerNo].def)
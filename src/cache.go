@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// Compiled states, commands and animation tables are cached in this
+// directory, so that characters only get compiled again when one of their
+// files, the common files or the engine itself changes
+const compileCacheDir = "save/cache"
+
+// Bumped whenever the layout of what is cached changes
+const compileCacheVersion = 1
+
+// Types that can be held by an interface in cached data, by name
+var cacheTypes = make(map[string]reflect.Type)
+
+func init() {
+	for _, v := range []interface{}{
+		NullStateController{}, StateBlock{}, StateExpr(nil), varAssign{},
+		callFunction{}, loopJump(0),
+		afterImage(nil), afterImageTime(nil), allPalFX(nil), angleAdd(nil),
+		angleDraw(nil), angleMul(nil), angleSet(nil), appendToClipboard(nil),
+		assertSpecial(nil), attackDist(nil), attackMulSet(nil), bgPalFX(nil),
+		bindToParent(nil), bindToRoot(nil), bindToTarget(nil), changeAnim(nil),
+		changeAnim2(nil), changeState(nil), clearClipboard(nil), ctrlSet(nil),
+		defenceMulSet(nil), destroySelf(nil), dialogue(nil),
+		displayToClipboard(nil), dizzyPointsAdd(nil), dizzyPointsSet(nil),
+		dizzySet(nil), envColor(nil), envShake(nil), explod(nil),
+		explodBindTime(nil), fallEnvShake(nil), gameMakeAnim(nil),
+		gravity(nil), guardBreakSet(nil), guardPointsAdd(nil),
+		guardPointsSet(nil), helper(nil), hitAdd(nil), hitBy(nil), hitDef(nil),
+		hitFallDamage(nil), hitFallSet(nil), hitFallVel(nil), hitOverride(nil),
+		hitScaleSet(nil), hitVelSet(nil), lifeAdd(nil), lifeSet(nil),
+		lifebarAction(nil), loadFile(nil), makeDust(nil), mapSet(nil),
+		matchRestart(nil), modifyExplod(nil), moveHitReset(nil), notHitBy(nil),
+		offset(nil), palFX(nil), pause(nil), playSnd(nil), playerPush(nil),
+		posAdd(nil), posFreeze(nil), posSet(nil), powerAdd(nil), powerSet(nil),
+		printToConsole(nil), projectile(nil), rankAdd(nil), redLifeAdd(nil),
+		redLifeSet(nil), remapPal(nil), remapSprite(nil), removeExplod(nil),
+		reversalDef(nil), roundTimeAdd(nil), roundTimeSet(nil), saveFile(nil),
+		scoreAdd(nil), screenBound(nil), selfState(nil), sndPan(nil),
+		sprPriority(nil), stateDef(nil), stateTypeSet(nil), stopSnd(nil),
+		superPause(nil), tagIn(nil), tagOut(nil), targetBind(nil),
+		targetDizzyPointsAdd(nil), targetDrop(nil), targetFacing(nil),
+		targetGuardPointsAdd(nil), targetLifeAdd(nil), targetPowerAdd(nil),
+		targetRedLifeAdd(nil), targetScoreAdd(nil), targetState(nil),
+		targetVelAdd(nil), targetVelSet(nil), trans(nil), turn(nil),
+		varRandom(nil), varRangeSet(nil), varSet(nil), velAdd(nil),
+		velMul(nil), velSet(nil), victoryQuote(nil), width(nil), zoom(nil),
+		"", []BytecodeValue(nil),
+	} {
+		t := reflect.TypeOf(v)
+		cacheTypes[cacheTypeName(t)] = t
+	}
+}
+
+// Unnamed types, such as slices, go by how they are written in Go
+func cacheTypeName(t reflect.Type) string {
+	if t.Name() == "" {
+		return t.String()
+	}
+	return t.Name()
+}
+
+// Pointers of these types are not cached and are nil once read back
+var cacheSkipTypes = map[reflect.Type]bool{
+	reflect.TypeOf((*Sff)(nil)):           true,
+	reflect.TypeOf((*Sprite)(nil)):        true,
+	reflect.TypeOf((*CommandBuffer)(nil)): true,
+}
+
+// Lets values of some types be written as references instead, such as to
+// assets that are loaded again before the values are read back
+type cacheRefs interface {
+	// Writes v as a reference and returns true, or returns false to have v
+	// written as usual
+	write(e *cacheEncoder, v reflect.Value) (bool, error)
+	// Reads v back if write wrote it as a reference
+	read(d *cacheDecoder, v reflect.Value) bool
+}
+
+// A binary encoding of any value made of numbers, strings, slices, maps,
+// structs, pointers and the interfaces in cacheTypes. Unexported fields are
+// included.
+type cacheEncoder struct {
+	buf  bytes.Buffer
+	tmp  [binary.MaxVarintLen64]byte
+	refs cacheRefs
+}
+
+func (e *cacheEncoder) uvarint(u uint64) {
+	e.buf.Write(e.tmp[:binary.PutUvarint(e.tmp[:], u)])
+}
+func (e *cacheEncoder) varint(i int64) {
+	e.buf.Write(e.tmp[:binary.PutVarint(e.tmp[:], i)])
+}
+func (e *cacheEncoder) str(s string) {
+	e.uvarint(uint64(len(s)))
+	e.buf.WriteString(s)
+}
+
+// Fields and map entries are made addressable, which lets unexported fields
+// be read
+func cacheAddressable(v reflect.Value) reflect.Value {
+	if v.CanAddr() {
+		return v
+	}
+	n := reflect.New(v.Type()).Elem()
+	n.Set(v)
+	return n
+}
+func cacheField(v reflect.Value, i int) reflect.Value {
+	f := v.Field(i)
+	return reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem()
+}
+
+func (e *cacheEncoder) value(v reflect.Value) error {
+	if e.refs != nil {
+		if ok, err := e.refs.write(e, v); ok || err != nil {
+			return err
+		}
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		e.uvarint(uint64(Btoi(v.Bool())))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.varint(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		e.uvarint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		e.uvarint(math.Float64bits(v.Float()))
+	case reflect.String:
+		e.str(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.uvarint(0)
+			return nil
+		}
+		e.uvarint(uint64(v.Len()) + 1)
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.buf.Write(v.Bytes())
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := e.value(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			e.uvarint(0)
+			return nil
+		}
+		e.uvarint(uint64(v.Len()) + 1)
+		for it := v.MapRange(); it.Next(); {
+			if err := e.value(cacheAddressable(it.Key())); err != nil {
+				return err
+			}
+			if err := e.value(cacheAddressable(it.Value())); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		v = cacheAddressable(v)
+		for i := 0; i < v.NumField(); i++ {
+			if err := e.value(cacheField(v, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		if v.IsNil() || cacheSkipTypes[v.Type()] {
+			e.uvarint(0)
+			return nil
+		}
+		e.uvarint(1)
+		return e.value(v.Elem())
+	case reflect.Interface:
+		if v.IsNil() {
+			e.str("")
+			return nil
+		}
+		t := v.Elem().Type()
+		if cacheTypes[cacheTypeName(t)] != t {
+			return Error("Type not cacheable: " + t.String())
+		}
+		e.str(cacheTypeName(t))
+		return e.value(cacheAddressable(v.Elem()))
+	default:
+		return Error("Type not cacheable: " + v.Type().String())
+	}
+	return nil
+}
+
+// Reads what cacheEncoder wrote, into a value of the same type, panicking if
+// the data is cut short or corrupt
+type cacheDecoder struct {
+	r    *bytes.Reader
+	refs cacheRefs
+}
+
+func (d *cacheDecoder) uvarint() uint64 {
+	u, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+func (d *cacheDecoder) varint() int64 {
+	i, err := binary.ReadVarint(d.r)
+	if err != nil {
+		panic(err)
+	}
+	return i
+}
+func (d *cacheDecoder) bytes(n uint64) []byte {
+	if n > uint64(d.r.Len()) {
+		panic(Error("Cache data cut short"))
+	}
+	b := make([]byte, n)
+	d.r.Read(b)
+	return b
+}
+func (d *cacheDecoder) str() string {
+	return string(d.bytes(d.uvarint()))
+}
+
+func (d *cacheDecoder) value(v reflect.Value) {
+	if d.refs != nil && d.refs.read(d, v) {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(d.uvarint() != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(d.varint())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		v.SetUint(d.uvarint())
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(math.Float64frombits(d.uvarint()))
+	case reflect.String:
+		v.SetString(d.str())
+	case reflect.Slice:
+		n := d.uvarint()
+		if n == 0 {
+			return
+		}
+		n--
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			// Copied, as slices of named byte types such as BytecodeExp can
+			// not be converted from []byte
+			b := d.bytes(n)
+			s := reflect.MakeSlice(v.Type(), len(b), len(b))
+			copy(s.Bytes(), b)
+			v.Set(s)
+			return
+		}
+		if n > uint64(d.r.Len()) {
+			panic(Error("Cache data cut short"))
+		}
+		v.Set(reflect.MakeSlice(v.Type(), int(n), int(n)))
+		fallthrough
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			d.value(v.Index(i))
+		}
+	case reflect.Map:
+		n := d.uvarint()
+		if n == 0 {
+			return
+		}
+		if n > uint64(d.r.Len())+1 {
+			panic(Error("Cache data cut short"))
+		}
+		v.Set(reflect.MakeMapWithSize(v.Type(), int(n-1)))
+		for i := uint64(1); i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			d.value(key)
+			val := reflect.New(v.Type().Elem()).Elem()
+			d.value(val)
+			v.SetMapIndex(key, val)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			d.value(cacheField(v, i))
+		}
+	case reflect.Ptr:
+		if d.uvarint() != 0 {
+			v.Set(reflect.New(v.Type().Elem()))
+			d.value(v.Elem())
+		}
+	case reflect.Interface:
+		name := d.str()
+		if name == "" {
+			return
+		}
+		t, ok := cacheTypes[name]
+		if !ok {
+			panic(Error("Unknown type in cache: " + name))
+		}
+		n := reflect.New(t).Elem()
+		d.value(n)
+		v.Set(n)
+	default:
+		panic(Error("Type not cacheable: " + v.Type().String()))
+	}
+}
+
+// Identifies the running executable, since the bytecode it compiles to
+// changes with it
+var engineHash struct {
+	once sync.Once
+	sum  string
+}
+
+func cacheEngineHash() string {
+	engineHash.once.Do(func() {
+		exe, err := os.Executable()
+		if err != nil {
+			return
+		}
+		if b, err := ioutil.ReadFile(exe); err == nil {
+			sum := sha256.Sum256(b)
+			engineHash.sum = hex.EncodeToString(sum[:])
+		}
+	})
+	return engineHash.sum
+}
+
+func fileHash(filename string) ([32]byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return sha256.Sum256(b), nil
+}
+
+// A cache file, which holds the hash of every file its data was made from
+type cacheEntry struct {
+	Version int
+	Sources map[string][32]byte
+	Data    []byte
+}
+
+func cachePath(kind string, key ...string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%v\x00%v", compileCacheVersion, cacheEngineHash())
+	for _, k := range key {
+		fmt.Fprintf(h, "\x00%v", k)
+	}
+	return filepath.Join(compileCacheDir,
+		fmt.Sprintf("%v-%x", kind, h.Sum(nil)[:16]))
+}
+
+// Reads the cache file into v, if every source file is still the same
+func readCache(path string, v interface{}) (ok bool) {
+	if sys.noCache || cacheEngineHash() == "" {
+		return false
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			ok = false
+		}
+	}()
+	var ce cacheEntry
+	(&cacheDecoder{r: bytes.NewReader(b)}).value(reflect.ValueOf(&ce).Elem())
+	if ce.Version != compileCacheVersion {
+		return false
+	}
+	for name, sum := range ce.Sources {
+		if s, err := fileHash(name); err != nil || s != sum {
+			return false
+		}
+	}
+	(&cacheDecoder{r: bytes.NewReader(ce.Data)}).value(reflect.ValueOf(v).Elem())
+	return true
+}
+
+// Writes v to the cache file. Failing to is not an error, as the data is
+// only made again next time.
+func writeCache(path string, sources []string, v interface{}) {
+	if sys.noCache || cacheEngineHash() == "" {
+		return
+	}
+	ce := cacheEntry{Version: compileCacheVersion,
+		Sources: make(map[string][32]byte)}
+	for _, name := range sources {
+		sum, err := fileHash(name)
+		if err != nil {
+			return
+		}
+		ce.Sources[name] = sum
+	}
+	var data, file cacheEncoder
+	if data.value(reflect.ValueOf(v).Elem()) != nil {
+		return
+	}
+	ce.Data = data.buf.Bytes()
+	if file.value(reflect.ValueOf(&ce).Elem()) != nil {
+		return
+	}
+	if os.MkdirAll(compileCacheDir, 0755) != nil {
+		return
+	}
+	// Written to another file first, so that a cache file is never read
+	// while half written
+	tmp := fmt.Sprintf("%v.%v.tmp", path, os.Getpid())
+	if ioutil.WriteFile(tmp, file.buf.Bytes(), 0644) != nil ||
+		os.Rename(tmp, path) != nil {
+		os.Remove(tmp)
+	}
+}
+
+// What Compiler.Compile makes for a character, besides the states
+type compiledChar struct {
+	States            map[int32]StateBytecode
+	Strings           []string
+	WakewakaLength    int32
+	Ver               [2]uint16
+	Commands          [][]Command
+	Names             map[string]int
+	DefaultTime       int32
+	DefaultBufferTime int32
+}
+
+// Compiles the states of a character, or reads them from the cache if none
+// of the files they are compiled from has changed since
+func compileChar(pn int, def string) (map[int32]StateBytecode, error) {
+	path := cachePath("char", def, sys.commonCmd,
+		strings.Join(sys.commonStates, "\n"), fmt.Sprint(sys.noOptimize))
+	var cc compiledChar
+	if readCache(path, &cc) {
+		sys.stringPool[pn].Clear()
+		for _, s := range cc.Strings {
+			sys.stringPool[pn].Add(s)
+		}
+		sys.cgi[pn].wakewakaLength, sys.cgi[pn].ver = cc.WakewakaLength, cc.Ver
+		cl := charCommandList(pn)
+		cl.Commands, cl.Names = cc.Commands, cc.Names
+		cl.DefaultTime, cl.DefaultBufferTime = cc.DefaultTime, cc.DefaultBufferTime
+		for no, sb := range cc.States {
+			sb.playerNo = pn
+			cc.States[no] = sb
+		}
+		return cc.States, nil
+	}
+	c := newCompiler()
+	states, err := c.Compile(pn, def)
+	if err != nil {
+		return nil, err
+	}
+	cl := c.cmdl
+	cc = compiledChar{States: states,
+		Strings:        sys.stringPool[pn].List,
+		WakewakaLength: sys.cgi[pn].wakewakaLength, Ver: sys.cgi[pn].ver,
+		Commands: cl.Commands, Names: cl.Names,
+		DefaultTime: cl.DefaultTime, DefaultBufferTime: cl.DefaultBufferTime}
+	writeCache(path, c.sources, &cc)
+	return states, nil
+}
+
+// Reads an animation table, from the cache if the same text has been read
+// before
+func cachedAnimationTable(sff *Sff, str string) AnimationTable {
+	path := cachePath("air", str)
+	var at AnimationTable
+	if !readCache(path, &at) {
+		lines, i := SplitAndTrim(str, "\n"), 0
+		at = ReadAnimationTable(sff, lines, &i)
+		writeCache(path, nil, &at)
+	}
+	for _, a := range at {
+		if a != nil {
+			a.sff = sff
+		}
+	}
+	return at
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// A character covering blocks, functions, loops and the common controllers
+var cacheTestChar = map[string]string{
+	"test.def": `[Info]
+name = "Test"
+mugenversion = 1.0
+
+[Files]
+cmd = test.cmd
+cns = test.cns
+st = test.cns
+st0 = test.zss
+`,
+	"test.cmd": `[Command]
+name = "a"
+command = a
+time = 1
+
+[Statedef -1]
+
+[State -1, a]
+type = ChangeState
+value = 200
+triggerall = command = "a"
+trigger1 = ctrl
+`,
+	"test.cns": `[Data]
+life = 1000
+
+[Statedef 200]
+type = S
+movetype = A
+physics = S
+anim = 200
+ctrl = 0
+
+[State 200, hit]
+type = HitDef
+trigger1 = animelem = 2
+attr = S, NA
+damage = 20, 5
+ground.hittime = 15
+guard.hittime = 10
+pausetime = 8, 8
+sparkxy = -10, -60
+
+[State 200, var]
+type = VarSet
+trigger1 = time = 0
+var(1) = var(1) + 1
+
+[State 200, fx]
+type = Explod
+trigger1 = time = 1
+anim = F100
+pos = 10, -20
+postype = p1
+removetime = -2
+
+[State 200, end]
+type = ChangeState
+trigger1 = animtime = 0
+value = 0
+ctrl = 1
+`,
+	"test.zss": `[Function dbl(x) r]
+let r = $x * 2;
+
+[Statedef 300; type: S; movetype: A; anim: 200;]
+let total = 0;
+for i = 1; 5 {
+	if $i = 3 { continue; }
+	let total = $total + $i;
+}
+while $total > 0 {
+	let total = $total - 1;
+	if $total = 4 { break; }
+}
+ignoreHitPause persistent(2) if var(1) := 2 {
+	call dbl($total);
+} else {
+	velSet{x: 1.5; y: -2}
+}
+mapSet{map: "test"; value: ifElse(time > 10, 1, 2)}
+changeState{value: 0; ctrl: 1}
+`,
+}
+
+// A compiled character must read back from the cache as it was written
+func TestCacheRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	for name, text := range cacheTestChar {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text),
+			0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sys.chars[0] = []*Char{newChar(0, 0)}
+	c := newCompiler()
+	states, err := c.Compile(0, filepath.Join(dir, "test.def"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := compiledChar{States: states, Strings: sys.stringPool[0].List,
+		WakewakaLength: sys.cgi[0].wakewakaLength, Ver: sys.cgi[0].ver,
+		Commands: c.cmdl.Commands, Names: c.cmdl.Names,
+		DefaultTime: c.cmdl.DefaultTime, DefaultBufferTime: c.cmdl.DefaultBufferTime}
+	var e cacheEncoder
+	if err := e.value(reflect.ValueOf(&cc).Elem()); err != nil {
+		t.Fatal(err)
+	}
+	var got compiledChar
+	(&cacheDecoder{r: bytes.NewReader(e.buf.Bytes())}).value(reflect.ValueOf(&got).Elem())
+	if !reflect.DeepEqual(got, cc) {
+		t.Errorf("read back as %+v\nwritten as %+v", got, cc)
+	}
+	for _, no := range []int32{-1, 200, 300} {
+		if _, ok := got.States[no]; !ok {
+			t.Errorf("state %v not read back", no)
+		}
+	}
+}
+
+// Values of types that are not in cacheTypes can not be written
+func TestCacheUnknownType(t *testing.T) {
+	type unknown struct{ v int }
+	var e cacheEncoder
+	v := []interface{}{unknown{1}}
+	if err := e.value(reflect.ValueOf(&v).Elem()); err == nil {
+		t.Error("no error writing a type missing from cacheTypes")
+	}
+}
@@ -1626,6 +1626,7 @@ type Char struct {
 	comboExtraFrameWindow int32
 	inheritJuggle         int32
 	mapArray              map[string]float32
+	mapValues             map[string]BytecodeValue
 	mapDefault            map[string]float32
 	remapSpr              RemapPreset
 	clipboardText         []string
@@ -1665,6 +1666,7 @@ func (c *Char) init(n int, idx int32) {
 		c.keyctrl = [...]bool{true, true, true, true}
 	} else {
 		c.mapArray = make(map[string]float32)
+		c.mapValues = nil
 		c.remapSpr = make(RemapPreset)
 
 		c.defaultHitScale = newHitScaleArray()
@@ -1868,6 +1870,7 @@ func (c *Char) load(def string) error {
 	}
 
 	gi.constants = make(map[string]float32)
+	sys.constGen++
 	gi.constants["default.attack.lifetopowermul"] = 0.7
 	gi.constants["default.gethit.lifetopowermul"] = 0.6
 	gi.constants["super.targetdefencemul"] = 1.5
@@ -2158,9 +2161,7 @@ func (c *Char) load(def string) error {
 		if err != nil {
 			return err
 		}
-		str = str + sys.commonAir
-		lines, i := SplitAndTrim(str, "\n"), 0
-		gi.anim = ReadAnimationTable(gi.sff, lines, &i)
+		gi.anim = cachedAnimationTable(gi.sff, str+sys.commonAir)
 		return nil
 	}); err != nil {
 		return err
@@ -2205,15 +2206,17 @@ func (c *Char) loadPallet() {
 					c.gi().palExist[i] = true
 
 					//パレットテクスチャ生成
-					gl.Enable(gl.TEXTURE_1D)
-					c.gi().sff.palList.PalTex[i] = newTexture()
-					gl.BindTexture(gl.TEXTURE_1D, uint32(*c.gi().sff.palList.PalTex[i]))
-					gl.PixelStorei(gl.UNPACK_ALIGNMENT, 1)
-					gl.TexImage1D(gl.TEXTURE_1D, 0, gl.RGBA, 256, 0, gl.RGBA, gl.UNSIGNED_BYTE,
-						unsafe.Pointer(&pl[0]))
-					gl.TexParameteri(gl.TEXTURE_1D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
-					gl.TexParameteri(gl.TEXTURE_1D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
-					gl.Disable(gl.TEXTURE_1D)
+					if !sys.headless {
+						gl.Enable(gl.TEXTURE_1D)
+						c.gi().sff.palList.PalTex[i] = newTexture()
+						gl.BindTexture(gl.TEXTURE_1D, uint32(*c.gi().sff.palList.PalTex[i]))
+						gl.PixelStorei(gl.UNPACK_ALIGNMENT, 1)
+						gl.TexImage1D(gl.TEXTURE_1D, 0, gl.RGBA, 256, 0, gl.RGBA, gl.UNSIGNED_BYTE,
+							unsafe.Pointer(&pl[0]))
+						gl.TexParameteri(gl.TEXTURE_1D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+						gl.TexParameteri(gl.TEXTURE_1D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+						gl.Disable(gl.TEXTURE_1D)
+					}
 
 					tmp = i + 1
 				}
@@ -2985,7 +2988,7 @@ func (c *Char) newChannel(ch int32, lowpriority bool) *Sound {
 }
 func (c *Char) playSound(f, lowpriority, loop bool, g, n, chNo, vol int32,
 	p, freqmul float32, x *float32, log bool) {
-	if g < 0 {
+	if g < 0 || sys.resimulating() {
 		return
 	}
 	var w *Wave
@@ -3280,6 +3283,9 @@ func (c *Char) helperInit(h *Char, st int32, pt PosType, x, y float32,
 		for key, value := range c.mapArray {
 			h.mapArray[key] = value
 		}
+		for key, value := range c.mapValues {
+			h.mapPut(key, value)
+		}
 	}
 	h.changeStateEx(st, c.playerNo, 0, 1, false)
 }
@@ -4636,67 +4642,73 @@ func (c *Char) scaleHit(baseDamage, id int32, index int) int32 {
 
 // MapSet() sets a map to a specific value.
 func (c *Char) mapSet(s string, Value float32, scType int32) {
+	c.mapSetValue(s, BytecodeFloat(Value), scType)
+}
+
+// Like mapSet, but for values of any type, where strings and arrays are kept
+// in mapValues and added to by concatenation.
+func (c *Char) mapSetValue(s string, v BytecodeValue, scType int32) {
 	if s == "" {
 		return
 	}
 	key := strings.ToLower(s)
+	var chars []*Char
 	switch scType {
-	case 0:
-		c.mapArray[key] = Value
-	case 1:
-		c.mapArray[key] += Value
-	case 2:
+	case 0, 1:
+		chars = []*Char{c}
+	case 2, 3:
 		if c.parent() != nil {
-			c.parent().mapArray[key] = Value
+			chars = []*Char{c.parent()}
 		} else {
-			c.mapArray[key] = Value
+			chars = []*Char{c}
 		}
-	case 3:
-		if c.parent() != nil {
-			c.parent().mapArray[key] += Value
-		} else {
-			c.mapArray[key] += Value
-		}
-	case 4:
+	case 4, 5:
 		if c.root() != nil {
-			c.root().mapArray[key] = Value
+			chars = []*Char{c.root()}
 		} else {
-			c.mapArray[key] = Value
+			chars = []*Char{c}
 		}
-	case 5:
-		if c.root() != nil {
-			c.root().mapArray[key] += Value
-		} else {
-			c.mapArray[key] += Value
-		}
-	case 6:
+	case 6, 7:
 		if c.teamside == -1 {
 			for i := MaxSimul * 2; i < MaxSimul*2+MaxAttachedChar; i += 1 {
 				if len(sys.chars[i]) > 0 {
-					sys.chars[i][0].mapArray[key] = Value
+					chars = append(chars, sys.chars[i][0])
 				}
 			}
 		} else {
 			for i := c.teamside; i < MaxSimul*2; i += 2 {
 				if len(sys.chars[i]) > 0 {
-					sys.chars[i][0].mapArray[key] = Value
+					chars = append(chars, sys.chars[i][0])
 				}
 			}
 		}
-	case 7:
-		if c.teamside == -1 {
-			for i := MaxSimul * 2; i < MaxSimul*2+MaxAttachedChar; i += 1 {
-				if len(sys.chars[i]) > 0 {
-					sys.chars[i][0].mapArray[key] += Value
-				}
-			}
+	}
+	for _, ch := range chars {
+		if scType%2 == 1 {
+			sum := ch.mapValue(key)
+			BytecodeExp(nil).add(&sum, v)
+			ch.mapPut(key, sum)
 		} else {
-			for i := c.teamside; i < MaxSimul*2; i += 2 {
-				if len(sys.chars[i]) > 0 {
-					sys.chars[i][0].mapArray[key] += Value
-				}
-			}
+			ch.mapPut(key, v)
+		}
+	}
+}
+func (c *Char) mapValue(key string) BytecodeValue {
+	if v, ok := c.mapValues[key]; ok {
+		return v
+	}
+	return BytecodeFloat(c.mapArray[key])
+}
+func (c *Char) mapPut(key string, v BytecodeValue) {
+	if v.t == VT_String || v.t == VT_Array {
+		if c.mapValues == nil {
+			c.mapValues = make(map[string]BytecodeValue)
 		}
+		c.mapValues[key] = v
+		delete(c.mapArray, key)
+	} else {
+		delete(c.mapValues, key)
+		c.mapArray[key] = v.ToF()
 	}
 }
 
@@ -4748,17 +4760,20 @@ func (c *Char) appendDialogue(s string, reset bool) {
 func (c *Char) appendToClipboard(pn, sn int, a ...interface{}) {
 	spl := sys.stringPool[pn].List
 	if sn >= 0 && sn < len(spl) {
-		for i, str := range strings.Split(OldSprintf(spl[sn], a...), "\n") {
-			if i == 0 && len(c.clipboardText) > 0 {
-				c.clipboardText[len(c.clipboardText)-1] += str
-			} else {
-				c.clipboardText = append(c.clipboardText, str)
-			}
-		}
-		if len(c.clipboardText) > sys.clipboardRows {
-			c.clipboardText = c.clipboardText[len(c.clipboardText)-sys.clipboardRows:]
+		c.appendClipboardText(spl[sn], a...)
+	}
+}
+func (c *Char) appendClipboardText(f string, a ...interface{}) {
+	for i, str := range strings.Split(OldSprintf(f, a...), "\n") {
+		if i == 0 && len(c.clipboardText) > 0 {
+			c.clipboardText[len(c.clipboardText)-1] += str
+		} else {
+			c.clipboardText = append(c.clipboardText, str)
 		}
 	}
+	if len(c.clipboardText) > sys.clipboardRows {
+		c.clipboardText = c.clipboardText[len(c.clipboardText)-sys.clipboardRows:]
+	}
 }
 
 func (c *Char) inGuardState() bool {
@@ -8,6 +8,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"unicode"
 )
 
 const kuuhaktokigou = " !=<>()|&+-*/%,[]^:;{}#\"\t\r\n"
@@ -31,10 +32,78 @@ type Compiler struct {
 	funcs    map[string]bytecodeFunction
 	funcUsed map[string]bool
 	stateNo  int32
+	loops    int
+	lint     *Linter
+	// Trigger functions, read by a prepass over the ZSS files before any
+	// state is compiled, and those being expanded
+	trigFuncs map[string]triggerFunction
+	expanding map[string]bool
+	prepass   bool
+	// Modules declared by the files being compiled, the ones imported by the
+	// character, the module of the current file and which states belong to
+	// a module
+	modules      map[string]*compilerModule
+	imports      map[string]bool
+	module       string
+	moduleStates map[int32]string
+	// Where errors are reported, lineNo being the line of a ZSS file that
+	// has been read last
+	file     string
+	lineNo   int
+	ctrlName string
+	params   map[string]srcPos
+	// The last sentence read from a ZSS file, untrimmed, with where it
+	// starts, and where the innermost expression value that failed to
+	// compile was, as what was left of its input after the token
+	sentence    string
+	sentencePos srcPos
+	expErrRest  *string
+	expErrToken string
+	// Every file read, for the compile cache to tell when it is out of date
+	sources []string
+}
+
+// CompileError is returned for anything wrong in the states of a character,
+// with the file, line and column it was found at, and the controller and
+// parameter it belongs to if any. Line and Col start at 1, and are 0 when
+// unknown.
+type CompileError struct {
+	File  string
+	Line  int
+	Col   int
+	Ctrl  string
+	Param string
+	Err   error
+}
+type srcPos struct {
+	line, col int
+}
+
+func (e *CompileError) Error() string {
+	s := e.File
+	if e.Line > 0 {
+		s += fmt.Sprintf(":%v", e.Line)
+		if e.Col > 0 {
+			s += fmt.Sprintf(":%v", e.Col)
+		}
+	}
+	s += ": "
+	if e.Ctrl != "" {
+		s += e.Ctrl + ": "
+	}
+	if e.Param != "" {
+		s += e.Param + ": "
+	}
+	return s + e.Err.Error()
 }
 
 func newCompiler() *Compiler {
-	c := &Compiler{funcs: make(map[string]bytecodeFunction)}
+	c := &Compiler{funcs: make(map[string]bytecodeFunction),
+		trigFuncs:    make(map[string]triggerFunction),
+		expanding:    make(map[string]bool),
+		modules:      make(map[string]*compilerModule),
+		imports:      make(map[string]bool),
+		moduleStates: make(map[int32]string)}
 	c.scmap = map[string]scFunc{
 		"hitby":                c.hitBy,
 		"nothitby":             c.notHitBy,
@@ -310,6 +379,7 @@ var triggerMap = map[string]int{
 	//new triggers
 	"animelemlength":   1,
 	"animlength":       1,
+	"array":            1,
 	"combocount":       1,
 	"consecutivewins":  1,
 	"dizzy":            1,
@@ -325,6 +395,7 @@ var triggerMap = map[string]int{
 	"incustomstate":    1,
 	"indialogue":       1,
 	"isasserted":       1,
+	"len":              1,
 	"localscale":       1,
 	"majorversion":     1,
 	"map":              1,
@@ -572,19 +643,19 @@ func (c *Compiler) number(token string) BytecodeValue {
 	}
 	if strings.Contains(token, ".") {
 		c.usiroOp = false
-		return BytecodeValue{VT_Float, f}
+		return BytecodeValue{t: VT_Float, v: f}
 	}
 	if strings.ContainsAny(token, "Ee") {
 		return bvNone()
 	}
 	c.usiroOp = false
 	if f > math.MaxInt32 {
-		return BytecodeValue{VT_Int, float64(math.MaxInt32)}
+		return BytecodeValue{t: VT_Int, v: float64(math.MaxInt32)}
 	}
 	if f < math.MinInt32 {
-		return BytecodeValue{VT_Int, float64(math.MinInt32)}
+		return BytecodeValue{t: VT_Int, v: float64(math.MinInt32)}
 	}
-	return BytecodeValue{VT_Int, f}
+	return BytecodeValue{t: VT_Int, v: f}
 }
 func (c *Compiler) attr(text string, hitdef bool) (int32, error) {
 	flg := int32(0)
@@ -1011,7 +1082,13 @@ func (c *Compiler) mathFunc(out *BytecodeExp, in *string, rd bool,
 	return
 }
 func (c *Compiler) expValue(out *BytecodeExp, in *string,
-	rd bool) (BytecodeValue, error) {
+	rd bool) (_ BytecodeValue, err error) {
+	tok, rest := c.token, *in
+	defer func() {
+		if err != nil && c.expErrRest == nil {
+			c.expErrRest, c.expErrToken = &rest, tok
+		}
+	}()
 	c.usiroOp, c.norange = true, false
 	bv := c.number(c.token)
 	if !bv.IsNone() {
@@ -1057,6 +1134,9 @@ func (c *Compiler) expValue(out *BytecodeExp, in *string,
 			_else = true
 		}
 		if _else {
+			if !bv1.IsNone() {
+				c.lintVarIndex(sys, f, bv1.ToI())
+			}
 			out.appendValue(bv1)
 		}
 		if set {
@@ -1150,10 +1230,15 @@ func (c *Compiler) expValue(out *BytecodeExp, in *string,
 	var n int32
 	var be BytecodeExp
 	var opc OpCode
-	var err error
 	switch c.token {
 	case "":
 		return bvNone(), Error("Nothing assigned")
+	case "\"":
+		if err := text(); err != nil {
+			return bvNone(), err
+		}
+		out.append(OC_ex_)
+		out.appendI32Op(OC_ex_string, int32(sys.stringPool[c.playerNo].Add(c.token)))
 	case "root", "parent", "helper", "target", "partner",
 		"enemy", "enemynear", "playerid":
 		switch c.token {
@@ -1189,6 +1274,9 @@ func (c *Compiler) expValue(out *BytecodeExp, in *string,
 				}
 				c.token = c.tokenizer(in)
 				be1.appendValue(bv1)
+				if opc == OC_helper && !bv1.IsNone() {
+					c.lintHelperRef(bv1.ToI())
+				}
 			} else {
 				switch opc {
 				case OC_helper, OC_target:
@@ -2294,6 +2382,35 @@ func (c *Compiler) expValue(out *BytecodeExp, in *string,
 			return bvNone(), err
 		}
 		out.append(OC_ex_, OC_ex_float)
+	case "array":
+		if err := c.kakkohiraku(in); err != nil {
+			return bvNone(), err
+		}
+		if rd {
+			out.append(OC_rdreset)
+		}
+		for c.token != ")" {
+			if n > 0 {
+				if c.token != "," {
+					return bvNone(), Error("Missing ','")
+				}
+				c.token = c.tokenizer(in)
+			}
+			be1 = be1[:0]
+			if bv1, err = c.expBoolOr(&be1, in); err != nil {
+				return bvNone(), err
+			}
+			out.append(be1...)
+			out.appendValue(bv1)
+			n++
+		}
+		out.append(OC_ex_)
+		out.appendI32Op(OC_ex_array, n)
+	case "len":
+		if _, err := c.oneArg(out, in, rd, true); err != nil {
+			return bvNone(), err
+		}
+		out.append(OC_ex_, OC_ex_len)
 	case "max":
 		if err := c.kakkohiraku(in); err != nil {
 			return bvNone(), err
@@ -2553,6 +2670,9 @@ func (c *Compiler) expValue(out *BytecodeExp, in *string,
 		if err := c.kakkohiraku(in); err != nil {
 			return bvNone(), err
 		}
+		if err := c.mapNameCheck(c.token); err != nil {
+			return bvNone(), err
+		}
 		out.append(OC_ex_)
 		out.appendI32Op(OC_ex_maparray, int32(sys.stringPool[c.playerNo].Add(strings.ToLower(c.token))))
 		c.token = c.tokenizer(in)
@@ -2705,12 +2825,46 @@ func (c *Compiler) expValue(out *BytecodeExp, in *string,
 				out.append(OC_blnot)
 			}
 			return bv, nil
+		} else if name, ok, ferr := c.trigFuncName(c.token); ok || ferr != nil {
+			if ferr != nil {
+				return bvNone(), ferr
+			}
+			if bv, err = c.triggerFunc(out, in, name, c.trigFuncs[name]); err != nil {
+				return bvNone(), err
+			}
 		} else if len(c.token) >= 2 && c.token[0] == '$' && c.token != "$_" {
 			vi, ok := c.vars[c.token[1:]]
 			if !ok {
 				return bvNone(), Error(c.token + " is not defined")
 			}
-			out.append(OC_localvar, OpCode(vi))
+			c.lintVarUsed(c.token[1:])
+			if c.token = c.tokenizer(in); c.token != "[" {
+				out.append(OC_localvar, OpCode(vi))
+				return bv, nil
+			}
+			c.token = c.tokenizer(in)
+			if bv1, err = c.expBoolOr(&be1, in); err != nil {
+				return bvNone(), err
+			}
+			if c.token != "]" {
+				return bvNone(), Error("Missing ']' before " + c.token)
+			}
+			be1.appendValue(bv1)
+			if c.token = c.tokenizer(in); c.token != ":=" {
+				out.append(OC_localvar, OpCode(vi))
+				out.append(be1...)
+				out.append(OC_ex_, OC_ex_index)
+				return bv, nil
+			}
+			c.token = c.tokenizer(in)
+			if bv2, err = c.expEqne(&be2, in); err != nil {
+				return bvNone(), err
+			}
+			be2.appendValue(bv2)
+			out.append(be1...)
+			out.append(be2...)
+			out.append(OC_ex_, OC_ex_st_index, OpCode(vi))
+			return bv, nil
 		} else {
 			return bvNone(), Error("Invalid data: " + c.token)
 		}
@@ -3220,6 +3374,7 @@ func (c *Compiler) fullExpression(in *string, vt ValueType) (BytecodeExp,
 func (c *Compiler) parseSection(
 	sctrl func(name, data string) error) (IniSection, bool, error) {
 	is := NewIniSection()
+	c.params = make(map[string]srcPos)
 	_type, persistent, ignorehitpause := true, true, true
 	for ; c.i < len(c.lines); c.i++ {
 		line := strings.TrimSpace(strings.SplitN(c.lines[c.i], ";", 2)[0])
@@ -3227,6 +3382,7 @@ func (c *Compiler) parseSection(
 			c.i--
 			break
 		}
+		col := strings.Index(c.lines[c.i], line) + 1
 		var name, data string
 		if len(line) >= 3 && strings.ToLower(line[:3]) == "var" {
 			name, data = "var", line
@@ -3252,8 +3408,10 @@ func (c *Compiler) parseSection(
 				if sys.ignoreMostErrors {
 					continue
 				}
-				return nil, false, Error(name + " is duplicated")
+				c.params[name] = srcPos{c.i + 1, col}
+				return nil, false, c.paramError(name, Error(name+" is duplicated"))
 			}
+			c.params[name] = srcPos{c.i + 1, col}
 			if sctrl != nil {
 				switch name {
 				case "type":
@@ -3278,7 +3436,7 @@ func (c *Compiler) parseSection(
 					}
 				}
 				if err := sctrl(name, data); err != nil {
-					return nil, false, err
+					return nil, false, c.paramError(name, err)
 				}
 			} else {
 				is[name] = data
@@ -3291,17 +3449,16 @@ func (c *Compiler) stateSec(is IniSection, f func() error) error {
 	if err := f(); err != nil {
 		return err
 	}
-	if !sys.ignoreMostErrors {
-		var str string
+	if !sys.ignoreMostErrors && len(is) > 0 {
+		keys := make([]string, 0, len(is))
 		for k := range is {
-			if len(str) > 0 {
-				str += ", "
-			}
-			str += k
-		}
-		if len(str) > 0 {
-			return Error("Invalid key name: " + str)
+			keys = append(keys, k)
 		}
+		sort.Slice(keys, func(i, j int) bool {
+			pi, pj := c.params[keys[i]], c.params[keys[j]]
+			return pi.line < pj.line || pi.line == pj.line && keys[i] < keys[j]
+		})
+		return c.paramError(keys[0], Error("Invalid key name: "+strings.Join(keys, ", ")))
 	}
 	return nil
 }
@@ -3310,7 +3467,7 @@ func (c *Compiler) stateParam(is IniSection, name string,
 	data, ok := is[name]
 	if ok {
 		if err := f(data); err != nil {
-			return Error(data + "\n" + name + ": " + err.Error())
+			return c.paramError(name, err)
 		}
 		delete(is, name)
 	}
@@ -3932,6 +4089,7 @@ func (c *Compiler) playSnd(is IniSection, sc *StateControllerBase,
 }
 func (c *Compiler) changeStateSub(is IniSection,
 	sc *StateControllerBase) error {
+	c.lintStateRef(is)
 	if err := c.paramValue(is, sc, "redirectid",
 		changeState_redirectid, VT_Int, 1, false); err != nil {
 		return err
@@ -4206,6 +4364,7 @@ func (c *Compiler) helper(is IniSection, sc *StateControllerBase,
 		}); err != nil {
 			return err
 		}
+		c.lintHelperID(is)
 		if err := c.paramValue(is, sc, "id",
 			helper_id, VT_Int, 1, false); err != nil {
 			return err
@@ -5710,6 +5869,7 @@ func (c *Compiler) varSetSub(is IniSection,
 					}
 				}
 			} else {
+				c.lintVarIndex(sys, fv, i)
 				be.appendValue(bv)
 				_else = true
 			}
@@ -6664,7 +6824,11 @@ func (c *Compiler) displayToClipboardSub(is IniSection,
 		_else := false
 		if len(data) >= 2 && data[0] == '"' {
 			if i := strings.Index(data[1:], "\""); i >= 0 {
-				data, _ = strconv.Unquote(data)
+				if str, err := strconv.Unquote(data); err == nil {
+					data = str
+				} else {
+					_else = true
+				}
 			} else {
 				_else = true
 			}
@@ -6672,7 +6836,14 @@ func (c *Compiler) displayToClipboardSub(is IniSection,
 			_else = true
 		}
 		if _else {
-			return Error("Not enclosed in \"")
+			// Any other text is a string expression, such as a map or a
+			// concatenation
+			be, err := c.fullExpression(&data, VT_SFalse)
+			if err != nil {
+				return err
+			}
+			sc.add(displayToClipboard_textexp, sc.beToExp(be))
+			return nil
 		}
 		sc.add(displayToClipboard_text,
 			sc.iToExp(int32(sys.stringPool[c.playerNo].Add(data))))
@@ -7494,13 +7665,16 @@ func (c *Compiler) mapSetSub(is IniSection, sc *StateControllerBase) error {
 			if len(data) < 2 || data[0] != '"' || data[len(data)-1] != '"' {
 				return Error("Not enclosed in \"")
 			}
+			if err := c.mapNameCheck(strings.ToLower(data[1 : len(data)-1])); err != nil {
+				return err
+			}
 			sc.add(mapSet_mapArray, sc.beToExp(BytecodeExp(data[1:len(data)-1])))
 			return nil
 		}); err != nil {
 			return err
 		}
 		if err := c.paramValue(is, sc, "value",
-			mapSet_value, VT_Float, 1, false); err != nil {
+			mapSet_value, VT_SFalse, 1, false); err != nil {
 			return err
 		}
 		return nil
@@ -7950,6 +8124,82 @@ func (c *Compiler) null(is IniSection, sc *StateControllerBase,
 	return nullStateController, nil
 }
 
+// Adds what is known of the current position to err, unless it is a
+// CompileError that already has it
+func (c *Compiler) compileError(err error, line, col int) error {
+	ce, ok := err.(*CompileError)
+	if !ok {
+		ce = &CompileError{Ctrl: c.ctrlName, Err: err}
+	}
+	if ce.File == "" {
+		ce.File = c.file
+	}
+	if ce.Line == 0 {
+		ce.Line, ce.Col = line, col
+	}
+	return ce
+}
+
+// An error in the parameter name of the controller being compiled
+func (c *Compiler) paramError(name string, err error) error {
+	if ce, ok := err.(*CompileError); ok {
+		return ce
+	}
+	pos := c.params[name]
+	return &CompileError{File: c.file, Line: pos.line, Col: pos.col,
+		Ctrl: c.ctrlName, Param: name, Err: err}
+}
+
+// Column of the current token in ZSS line lineNo, rest being what is left of
+// the line after the token
+func (c *Compiler) zssCol(rest string) int {
+	if c.lineNo < 1 || c.lineNo > len(c.lines) {
+		return 0
+	}
+	end := len(strings.TrimRightFunc(c.lines[c.lineNo-1], unicode.IsSpace))
+	col := end - len(rest) - len(c.token) + 1
+	if col < 1 || col > end+1 {
+		return 0
+	}
+	return col
+}
+
+// Position in the ZSS file of the expression value that failed to compile,
+// if it belongs to the last sentence read
+func (c *Compiler) expErrPos() (line, col int, ok bool) {
+	if c.expErrRest == nil || c.sentencePos.line < 1 {
+		return 0, 0, false
+	}
+	lead := len(c.sentence) - len(strings.TrimLeftFunc(c.sentence,
+		unicode.IsSpace))
+	sen := strings.TrimSpace(c.sentence)
+	rest, tok := *c.expErrRest, c.expErrToken
+	off := len(sen) - len(rest) - len(tok)
+	if !strings.HasSuffix(sen, rest) || off < 0 ||
+		!strings.EqualFold(sen[off:off+len(tok)], tok) {
+		return 0, 0, false
+	}
+	off += lead
+	nl := strings.LastIndex(c.sentence[:off], "\n")
+	if nl < 0 {
+		if c.sentencePos.col < 1 {
+			return 0, 0, false
+		}
+		return c.sentencePos.line, c.sentencePos.col + off, true
+	}
+	line = c.sentencePos.line + strings.Count(c.sentence[:off], "\n")
+	if line > len(c.lines) {
+		return 0, 0, false
+	}
+	src := c.lines[line-1]
+	col = len(src) - len(strings.TrimLeftFunc(src, unicode.IsSpace)) +
+		off - nl
+	return line, col, true
+}
+
+// Sections read by the prepass, which skips the ZSS files without any
+var zssPrepassSection = regexp.MustCompile(`(?i)\[\s*(trigger|module|import)\b`)
+
 // Compile a state file
 func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 	filename, def string) error {
@@ -7966,11 +8216,14 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 				return err
 			}
 			str = string(b)
-			return c.stateCompileZ(states, fnz, str)
+			c.sources = append(c.sources, filename)
+			return nil
 		}
 
 		// Try reading as an st file
-		str, err = LoadText(filename)
+		if str, err = LoadText(filename); err == nil {
+			c.sources = append(c.sources, filename)
+		}
 		return err
 	}); err != nil {
 		// If filename doesn't exist, see if a zss file exists
@@ -7981,15 +8234,29 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 				return err
 			}
 			str = string(b)
+			c.sources = append(c.sources, filename)
 			return nil
 		}); err == nil {
+			if c.prepass && !zssPrepassSection.MatchString(str) {
+				return nil
+			}
 			return c.stateCompileZ(states, fnz, str)
 		}
 		return err
 	}
-	c.lines, c.i = SplitAndTrim(str, "\n"), 0
+	if zss {
+		if c.prepass && !zssPrepassSection.MatchString(str) {
+			return nil
+		}
+		return c.stateCompileZ(states, filename, str)
+	}
+	if c.prepass {
+		return nil
+	}
+	c.lines, c.i = strings.Split(str, "\n"), 0
+	c.file, c.ctrlName = filename, ""
 	errmes := func(err error) error {
-		return Error(fmt.Sprintf("%v:%v:\n%v", filename, c.i+1, err.Error()))
+		return c.compileError(err, c.i+1, 0)
 	}
 	// Keep a map of states that have already been found in this file
 	existInThisFile := make(map[int32]bool)
@@ -8014,11 +8281,23 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 		}
 		existInThisFile[c.stateNo] = true
 
+		c.ctrlName = "statedef"
+		if err := c.moduleStateCheck(states); err != nil {
+			if err = errmes(err); c.lintError(err) {
+				continue
+			}
+			return err
+		}
 		c.i++
 		// Parse the statedef properties
 		is, _, err := c.parseSection(nil)
 		if err != nil {
-			return errmes(err)
+			// While linting, errors are reported and compiling goes on
+			// with the next state or controller
+			if err = errmes(err); c.lintError(err) {
+				continue
+			}
+			return err
 		}
 		sbc := newStateBytecode(c.playerNo)
 		if _, ok := states[c.stateNo]; ok && c.stateNo < 0 {
@@ -8026,7 +8305,10 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 		}
 		// Interpret the statedef properties
 		if err := c.stateDef(is, sbc); err != nil {
-			return errmes(err)
+			if err = errmes(err); c.lintError(err) {
+				continue
+			}
+			return err
 		}
 
 		// Continue looping through state file lines to define the current state
@@ -8045,7 +8327,7 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 			c.i++
 
 			// Create this sctrl and get its properties
-			c.block = newStateBlock()
+			c.block, c.ctrlName = newStateBlock(), ""
 			sc := newStateControllerBase()
 			var scf scFunc
 			var triggerall []BytecodeExp
@@ -8058,7 +8340,8 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 				switch name {
 				case "type":
 					var ok bool
-					scf, ok = c.scmap[strings.ToLower(data)]
+					c.ctrlName = strings.ToLower(data)
+					scf, ok = c.scmap[c.ctrlName]
 					if !ok {
 						return Error("Invalid state controller: " + data)
 					}
@@ -8097,6 +8380,7 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 					tn, ok := readDigit(name[7:])
 					if !ok || tn < 1 || tn > 65536 {
 						if sys.ignoreMostErrors {
+							c.lintWarn("Ignored invalid trigger name: " + name)
 							break
 						}
 						return Error("Invalid trigger name: " + name)
@@ -8122,6 +8406,7 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 								}
 							}
 							if _break {
+								c.lintWarn("Ignored trigger: " + name + ": " + err.Error())
 								break
 							}
 						}
@@ -8143,17 +8428,21 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 				}
 				return nil
 			})
-			if err != nil {
-				return errmes(err)
-			}
-
-			// Check that the sctrl has a valid type parameter
-			if scf == nil {
-				return errmes(Error("type parameter not specified"))
+			if err == nil {
+				// Check that the sctrl has a valid type parameter
+				if scf == nil {
+					err = Error("type parameter not specified")
+				} else if len(trexist) == 0 || (!allUtikiri && trexist[0] == 0) {
+					err = Error("Missing trigger1")
+				}
 			}
-			if len(trexist) == 0 || (!allUtikiri && trexist[0] == 0) {
-				return errmes(Error("Missing trigger1"))
+			if err != nil {
+				if err = errmes(err); c.lintError(err) {
+					continue
+				}
+				return err
 			}
+			c.lintTriggers(allUtikiri, trexist)
 
 			/* Create trigger bytecode */
 			var texp BytecodeExp
@@ -8223,7 +8512,10 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 			// For this sctrl type, call the function to construct the sctrl
 			sctrl, err := scf(is, sc, _ihp)
 			if err != nil {
-				return errmes(err)
+				if err = errmes(err); c.lintError(err) {
+					continue
+				}
+				return err
 			}
 
 			// Check if the triggers can ever be true before appending the new sctrl
@@ -8278,6 +8570,7 @@ func (c *Compiler) nextLine() (string, bool) {
 	if s == nil {
 		return "", false
 	}
+	c.lineNo++
 	return *s, true
 }
 func (c *Compiler) scan(line *string) string {
@@ -8346,7 +8639,11 @@ func (c *Compiler) readSentenceLine(line *string) (s string, assign bool,
 	return
 }
 func (c *Compiler) readSentence(line *string) (s string, a bool, err error) {
-
+	c.sentence, c.expErrRest = "", nil
+	c.sentencePos = srcPos{c.lineNo, c.zssCol(*line)}
+	if c.sentencePos.col > 0 {
+		c.sentencePos.col += len(c.token)
+	}
 	if s, a, err = c.readSentenceLine(line); err != nil {
 		return
 	}
@@ -8363,6 +8660,7 @@ func (c *Compiler) readSentence(line *string) (s string, a bool, err error) {
 			a = a || ass
 		}
 	}
+	c.sentence = s
 	return strings.TrimSpace(s), a, nil
 }
 func (c *Compiler) statementEnd(line *string) error {
@@ -8382,6 +8680,7 @@ func (c *Compiler) readKeyValue(is IniSection, end string,
 	if name == end {
 		return nil
 	}
+	c.params[name] = srcPos{c.lineNo, c.zssCol(*line)}
 	c.scan(line)
 	if err := c.needToken(":"); err != nil {
 		return err
@@ -8511,19 +8810,46 @@ func (c *Compiler) subBlock(line *string, root bool,
 		if bl.trigger, err = c.fullExpression(&expr, VT_Bool); err != nil {
 			return nil, err
 		}
+		c.lintCondition(bl.trigger)
+		c.token = otk
+		if err := c.needToken("{"); err != nil {
+			return nil, err
+		}
+	case "while":
+		expr, _, err := c.readSentence(line)
+		if err != nil {
+			return nil, err
+		}
+		otk := c.token
+		if bl.trigger, err = c.fullExpression(&expr, VT_Bool); err != nil {
+			return nil, err
+		}
+		c.lintCondition(bl.trigger)
 		c.token = otk
 		if err := c.needToken("{"); err != nil {
 			return nil, err
 		}
+		bl.loop = true
+	case "for":
+		if err := c.forHeader(line, bl, numVars); err != nil {
+			return nil, err
+		}
+		bl.loop = true
 	default:
 		return nil, c.yokisinaiToken()
 	}
+	if bl.loop {
+		c.loops++
+	}
 	if err := c.stateBlock(line, bl, false,
 		sbc, &bl.ctrls, numVars); err != nil {
 		return nil, err
 	}
+	if bl.loop {
+		c.loops--
+	}
 	if root {
-		if len(bl.trigger) > 0 {
+		if len(bl.trigger) > 0 && !bl.loop {
 			if c.token = c.tokenizer(line); c.token != "else" {
 				if len(c.token) == 0 || c.token[0] == '#' {
 					c.token, *line = "", ""
@@ -8541,7 +8867,7 @@ func (c *Compiler) subBlock(line *string, root bool,
 	} else {
 		c.scan(line)
 	}
-	if len(bl.trigger) > 0 && c.token == "else" {
+	if len(bl.trigger) > 0 && !bl.loop && c.token == "else" {
 		c.scan(line)
 		var err error
 		if bl.elseBlock, err = c.subBlock(line, root,
@@ -8554,11 +8880,68 @@ func (c *Compiler) subBlock(line *string, root bool,
 	}
 	return bl, nil
 }
+
+// Reads "var = begin; end [; step] {" of a for loop, where var is a local
+// variable that is declared if it does not exist yet
+func (c *Compiler) forHeader(line *string, bl *StateBlock,
+	numVars *int32) error {
+	name := c.scan(line)
+	if name == "" || name == "=" {
+		return c.yokisinaiToken()
+	}
+	if err := c.varNameCheck(name); err != nil {
+		return err
+	}
+	if name == "_" {
+		return Error("Invalid name: " + name)
+	}
+	vi, ok := c.vars[name]
+	if !ok {
+		vi = uint8(*numVars)
+		c.vars[name] = vi
+		if err := c.inclNumVars(numVars); err != nil {
+			return err
+		}
+	}
+	bl.forLoop, bl.forVar = true, vi
+	c.scan(line)
+	if err := c.needToken("="); err != nil {
+		return err
+	}
+	for i := range bl.forExp {
+		expr, _, err := c.readSentence(line)
+		if err != nil {
+			return err
+		}
+		otk := c.token
+		if bl.forExp[i], err = c.fullExpression(&expr, VT_Int); err != nil {
+			return err
+		}
+		c.token = otk
+		if i > 0 && c.token == "{" {
+			return nil
+		}
+		if i == len(bl.forExp)-1 {
+			return c.needToken("{")
+		}
+		if err := c.needToken(";"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 func (c *Compiler) callFunc(line *string, root bool,
 	ctrls *[]StateController, ret []uint8) error {
 	var cf callFunction
 	var ok bool
-	cf.bytecodeFunction, ok = c.funcs[c.scan(line)]
+	name, err := c.funcName(c.scan(line), func(name string) bool {
+		_, ok := c.funcs[name]
+		return ok
+	})
+	if err != nil {
+		return err
+	}
+	cf.bytecodeFunction, ok = c.funcs[name]
 	cf.ret = ret
 	if !ok {
 		if c.token == "" || c.token == "(" {
@@ -8566,7 +8949,7 @@ func (c *Compiler) callFunc(line *string, root bool,
 		}
 		return Error("Undefined function: " + c.token)
 	}
-	c.funcUsed[c.token] = true
+	c.funcUsed[name] = true
 	if len(ret) > 0 && len(ret) != int(cf.numRets) {
 		return Error(fmt.Sprintf("Mismatch in number of assignments and return values: %v = %v",
 			len(ret), cf.numRets))
@@ -8648,7 +9031,7 @@ func (c *Compiler) stateBlock(line *string, bl *StateBlock, root bool,
 				return c.yokisinaiToken()
 			}
 			return nil
-		case "if", "ignorehitpause", "persistent":
+		case "if", "while", "for", "ignorehitpause", "persistent":
 			if sbl, err := c.subBlock(line, root, sbc, numVars); err != nil {
 				return err
 			} else {
@@ -8663,6 +9046,26 @@ func (c *Compiler) stateBlock(line *string, bl *StateBlock, root bool,
 				return err
 			}
 			continue
+		case "break", "continue":
+			if c.loops == 0 {
+				return Error(c.token + " outside of a loop")
+			}
+			jump := loopJump(LJ_Break)
+			if c.token == "continue" {
+				jump = loopJump(LJ_Continue)
+			}
+			c.scan(line)
+			if err := c.needToken(";"); err != nil {
+				return err
+			}
+			if root {
+				if err := c.statementEnd(line); err != nil {
+					return err
+				}
+			}
+			*ctrls = append(*ctrls, jump)
+			c.scan(line)
+			continue
 		case "let":
 			names, err := c.varNames("=", line)
 			if err != nil {
@@ -8680,6 +9083,9 @@ func (c *Compiler) stateBlock(line *string, bl *StateBlock, root bool,
 					if err := c.inclNumVars(numVars); err != nil {
 						return err
 					}
+					if n != "_" {
+						c.lintVarDeclared(n)
+					}
 				}
 				varis[i] = vi
 			}
@@ -8740,6 +9146,7 @@ func (c *Compiler) stateBlock(line *string, bl *StateBlock, root bool,
 			}
 			if ok {
 				scname := c.token
+				c.ctrlName, c.params = scname, make(map[string]srcPos)
 				c.scan(line)
 				if err := c.needToken("{"); err != nil {
 					return err
@@ -8774,6 +9181,7 @@ func (c *Compiler) stateBlock(line *string, bl *StateBlock, root bool,
 				} else {
 					*ctrls = append(*ctrls, sctrl)
 				}
+				c.ctrlName = ""
 				c.scan(line)
 				continue
 			} else {
@@ -8816,23 +9224,22 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode,
 	}(sys.ignoreMostErrors)
 	sys.ignoreMostErrors = false
 	c.block = nil
-	c.lines, c.i = SplitAndTrim(src, "\n"), 0
+	c.lines, c.i = strings.Split(src, "\n"), 0
+	c.file, c.lineNo, c.ctrlName = filename, 0, ""
 	c.linechan = make(chan *string)
 	endchan := make(chan bool, 1)
-	stop := func() int {
+	stop := func() {
 		if c.linechan == nil {
-			return 0
+			return
 		}
 		endchan <- true
-		lineOffset := 1
 		for {
 			if sp := <-c.linechan; sp != nil && *sp == "\n" {
 				close(endchan)
 				close(c.linechan)
 				c.linechan = nil
-				return c.i + lineOffset
+				return
 			}
-			lineOffset--
 		}
 	}
 	defer stop()
@@ -8856,128 +9263,566 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode,
 			c.linechan <- sp
 		}
 	}()
+	var line string
 	errmes := func(err error) error {
-		return Error(fmt.Sprintf("%v:%v:\n%v", filename, stop(), err.Error()))
+		if l, col, ok := c.expErrPos(); ok {
+			return c.compileError(err, l, col)
+		}
+		return c.compileError(err, c.lineNo, c.zssCol(line))
 	}
 	existInThisFile := make(map[int32]bool)
 	funcExistInThisFile := make(map[string]bool)
-	var line string
-	c.token = ""
-	for {
+	c.token, c.module = "", ""
+	defer func() { c.module = "" }()
+	for sections := 0; ; sections++ {
 		if c.token == "" {
 			c.scan(&line)
 			if c.token == "" {
 				break
 			}
 		}
-		if c.token != "[" {
-			return errmes(c.yokisinaiToken())
+		// A module that is not imported is only read by the prepass
+		if c.module != "" && !c.prepass && !c.imports[c.module] {
+			break
+		}
+		err := c.yokisinaiToken()
+		if c.token == "[" {
+			err = c.stateSectionZ(states, &line, existInThisFile,
+				funcExistInThisFile, sections == 0)
 		}
-		switch c.scan(&line) {
-		case "":
-			return errmes(c.yokisinaiToken())
-		case "statedef":
-			var err error
-			if c.stateNo, err = c.scanI32(&line); err != nil {
-				return errmes(err)
+		if err != nil {
+			// While linting, the error is reported and the file is compiled
+			// on from the next section
+			if err = errmes(err); !c.lintError(err) {
+				return err
 			}
-			c.scan(&line)
-			if existInThisFile[c.stateNo] {
-				return errmes(Error(fmt.Sprintf("State %v overloaded", c.stateNo)))
-			}
-			existInThisFile[c.stateNo] = true
-			is := NewIniSection()
-			for c.token != "]" {
-				switch c.token {
-				case ";":
-					if err := c.readKeyValue(is, "]", &line); err != nil {
-						return errmes(err)
-					}
-				default:
-					return errmes(c.yokisinaiToken())
+			c.ctrlName = ""
+			c.skipSectionZ(&line)
+		}
+	}
+	return nil
+}
+
+// Skips to the next line that starts a section
+func (c *Compiler) skipSectionZ(line *string) {
+	for *line, c.token = "", ""; ; {
+		l, ok := c.nextLine()
+		if !ok {
+			break
+		}
+		if strings.HasPrefix(l, "[") {
+			*line = l
+			break
+		}
+	}
+}
+
+// Compiles the statedef or function that starts at the current token
+func (c *Compiler) stateSectionZ(states map[int32]StateBytecode, line *string,
+	existInThisFile map[int32]bool, funcExistInThisFile map[string]bool,
+	first bool) error {
+	// Trigger functions are all read by the prepass, and nothing else is but
+	// modules and imports, which both passes need
+	switch c.scan(line) {
+	case "module":
+		return c.moduleSection(line, first)
+	case "import":
+		return c.importSection(line)
+	}
+	if c.prepass != (c.token == "trigger") {
+		c.skipSectionZ(line)
+		return nil
+	}
+	switch c.token {
+	case "":
+		return c.yokisinaiToken()
+	case "trigger":
+		return c.triggerSection(line, funcExistInThisFile)
+	case "statedef":
+		var err error
+		if c.stateNo, err = c.scanI32(line); err != nil {
+			return err
+		}
+		c.scan(line)
+		if existInThisFile[c.stateNo] {
+			return Error(fmt.Sprintf("State %v overloaded", c.stateNo))
+		}
+		existInThisFile[c.stateNo] = true
+		if err := c.moduleStateCheck(states); err != nil {
+			return err
+		}
+		is := NewIniSection()
+		c.ctrlName, c.params = "statedef", make(map[string]srcPos)
+		for c.token != "]" {
+			switch c.token {
+			case ";":
+				if err := c.readKeyValue(is, "]", line); err != nil {
+					return err
 				}
+			default:
+				return c.yokisinaiToken()
 			}
-			sbc := newStateBytecode(c.playerNo)
-			if _, ok := states[c.stateNo]; ok && c.stateNo < 0 {
-				*sbc = states[c.stateNo]
-			}
-			c.vars = make(map[string]uint8)
-			if err := c.stateDef(is, sbc); err != nil {
-				return errmes(err)
-			}
-			if err := c.statementEnd(&line); err != nil {
-				return errmes(err)
-			}
-			if err := c.stateBlock(&line, &sbc.block, true,
-				sbc, &sbc.block.ctrls, &sbc.numVars); err != nil {
-				return errmes(err)
-			}
-			if _, ok := states[c.stateNo]; !ok || c.stateNo < 0 {
-				states[c.stateNo] = *sbc
+		}
+		sbc := newStateBytecode(c.playerNo)
+		if _, ok := states[c.stateNo]; ok && c.stateNo < 0 {
+			*sbc = states[c.stateNo]
+		}
+		c.vars, c.loops = make(map[string]uint8), 0
+		if err := c.stateDef(is, sbc); err != nil {
+			return err
+		}
+		c.ctrlName = ""
+		if err := c.statementEnd(line); err != nil {
+			return err
+		}
+		if err := c.stateBlock(line, &sbc.block, true,
+			sbc, &sbc.block.ctrls, &sbc.numVars); err != nil {
+			return err
+		}
+		c.lintUnusedVars()
+		if _, ok := states[c.stateNo]; !ok || c.stateNo < 0 {
+			states[c.stateNo] = *sbc
+		}
+	case "function":
+		name := c.scan(line)
+		if name == "" || name == "(" || name == "]" {
+			return c.yokisinaiToken()
+		}
+		if err := c.varNameCheck(name); err != nil {
+			return err
+		}
+		if funcExistInThisFile[name] {
+			return Error("Function already defined in the same file: " + name)
+		}
+		funcExistInThisFile[name] = true
+		if c.module != "" {
+			name = c.module + "." + name
+		}
+		c.scan(line)
+		if err := c.needToken("("); err != nil {
+			return err
+		}
+		fun := bytecodeFunction{}
+		c.vars, c.loops = make(map[string]uint8), 0
+		if args, err := c.varNames(")", line); err != nil {
+			return err
+		} else {
+			for _, a := range args {
+				c.vars[a] = uint8(fun.numVars)
+				if err := c.inclNumVars(&fun.numVars); err != nil {
+					return err
+				}
 			}
-		case "function":
-			name := c.scan(&line)
-			if name == "" || name == "(" || name == "]" {
-				return errmes(c.yokisinaiToken())
+			fun.numArgs = int32(len(args))
+		}
+		if rets, err := c.varNames("]", line); err != nil {
+			return err
+		} else {
+			for _, r := range rets {
+				if r == "_" {
+					return Error("The return value name is _")
+				} else if _, ok := c.vars[r]; ok {
+					return Error("Duplicated name: " + r)
+				} else {
+					c.vars[r] = uint8(fun.numVars)
+				}
+				if err := c.inclNumVars(&fun.numVars); err != nil {
+					return err
+				}
 			}
-			if err := c.varNameCheck(name); err != nil {
-				return errmes(err)
+			fun.numRets = int32(len(rets))
+		}
+		if err := c.stateBlock(line, nil, true,
+			nil, &fun.ctrls, &fun.numVars); err != nil {
+			return err
+		}
+		c.lintUnusedVars()
+		if _, ok := c.funcs[name]; ok {
+			return nil
+			//return Error("Function already defined in other file: " + name)
+		}
+		c.funcs[name] = fun
+		//c.funcUsed[name] = true
+	default:
+		return Error("Unrecognized section (group) name: " + c.token)
+	}
+	return nil
+}
+
+// A trigger function, which is expanded in place of each call, with every
+// $arg in the body replaced by the text of the argument. An argument can
+// therefore be a redirect as well as a value, as in myDist(enemy).
+type triggerFunction struct {
+	args   []string
+	body   string
+	module string
+}
+
+// Reads "[Trigger name(args)]" followed by the expression of the body
+func (c *Compiler) triggerSection(line *string,
+	funcExistInThisFile map[string]bool) error {
+	name := c.scan(line)
+	if name == "" || name == "(" || name == "]" {
+		return c.yokisinaiToken()
+	}
+	if err := c.varNameCheck(name); err != nil {
+		return err
+	}
+	if _, ok := triggerMap[name]; ok {
+		return Error("Trigger already exists: " + name)
+	}
+	if funcExistInThisFile[name] {
+		return Error("Function already defined in the same file: " + name)
+	}
+	funcExistInThisFile[name] = true
+	c.ctrlName = name
+	c.scan(line)
+	if err := c.needToken("("); err != nil {
+		return err
+	}
+	args, err := c.varNames(")", line)
+	if err != nil {
+		return err
+	}
+	c.scan(line)
+	if err := c.needToken("]"); err != nil {
+		return err
+	}
+	body, _, err := c.readSentence(line)
+	if err != nil {
+		return err
+	}
+	if err := c.needToken(";"); err != nil {
+		return err
+	}
+	if body == "" {
+		return Error("Nothing assigned")
+	}
+	// Only the arguments can be read, as there are no local variables
+	for in := body; ; {
+		t := c.tokenizer(&in)
+		if t == "" {
+			break
+		}
+		if t == "\"" {
+			if _, err := c.readString(&in); err != nil {
+				return err
 			}
-			if funcExistInThisFile[name] {
-				return errmes(Error("Function already defined in the same file: " + name))
+		} else if len(t) >= 2 && t[0] == '$' {
+			found := false
+			for _, a := range args {
+				found = found || t[1:] == a
 			}
-			funcExistInThisFile[name] = true
-			c.scan(&line)
-			if err := c.needToken("("); err != nil {
-				return errmes(err)
+			if !found {
+				return Error(t + " is not an argument of " + name)
 			}
-			fun := bytecodeFunction{}
-			c.vars = make(map[string]uint8)
-			if args, err := c.varNames(")", &line); err != nil {
-				return errmes(err)
+		}
+	}
+	if c.scan(line); c.token != "" && c.token != "[" {
+		return c.yokisinaiToken()
+	}
+	if c.module != "" {
+		name = c.module + "." + name
+	}
+	if _, ok := c.trigFuncs[name]; !ok {
+		c.trigFuncs[name] = triggerFunction{args: args, body: body,
+			module: c.module}
+	}
+	return nil
+}
+
+// Compiles a call of a trigger function, whose name has just been read, by
+// expanding its body in place
+func (c *Compiler) triggerFunc(out *BytecodeExp, in *string, name string,
+	tf triggerFunction) (BytecodeValue, error) {
+	if c.tokenizer(in) != "(" {
+		return bvNone(), Error("Missing '(' after " + name)
+	}
+	var args []string
+	depth, start, end := 0, 0, -1
+	for i := 0; i < len(*in) && end < 0; i++ {
+		switch (*in)[i] {
+		case '"':
+			if j := strings.Index((*in)[i+1:], "\""); j >= 0 {
+				i += j + 1
+			}
+		case '(', '[':
+			depth++
+		case ')', ']':
+			if depth == 0 {
+				end = i
 			} else {
-				for _, a := range args {
-					c.vars[a] = uint8(fun.numVars)
-					if err := c.inclNumVars(&fun.numVars); err != nil {
-						return errmes(err)
-					}
-				}
-				fun.numArgs = int32(len(args))
+				depth--
 			}
-			if rets, err := c.varNames("]", &line); err != nil {
-				return errmes(err)
-			} else {
-				for _, r := range rets {
-					if r == "_" {
-						return errmes(Error("The return value name is _"))
-					} else if _, ok := c.vars[r]; ok {
-						return errmes(Error("Duplicated name: " + r))
+		case ',':
+			if depth == 0 {
+				args = append(args, strings.TrimSpace((*in)[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if end < 0 {
+		return bvNone(), Error("Missing ')' after " + name)
+	}
+	if arg := strings.TrimSpace((*in)[start:end]); arg != "" || len(args) > 0 {
+		args = append(args, arg)
+	}
+	*in = (*in)[end+1:]
+	if len(args) != len(tf.args) {
+		return bvNone(), Error(fmt.Sprintf("%v takes %v arguments, got %v",
+			name, len(tf.args), len(args)))
+	}
+	if c.expanding[name] {
+		return bvNone(), Error("Recursive call of " + name)
+	}
+	c.expanding[name] = true
+	defer delete(c.expanding, name)
+	// The body is compiled as part of the module it was declared in
+	defer func(m string) { c.module = m }(c.module)
+	c.module = tf.module
+	body := c.expandTrigger(tf, args)
+	c.token = c.tokenizer(&body)
+	bv, err := c.expBoolOr(out, &body)
+	if err == nil && len(c.token) > 0 {
+		err = Error("Invalid data: " + c.token)
+	}
+	if err != nil {
+		return bvNone(), Error(name + ": " + err.Error())
+	}
+	c.token, c.usiroOp, c.norange = ")", true, false
+	return bv, nil
+}
+
+// The body of a trigger function with its arguments substituted, where a
+// redirect is put as it is and anything else in parentheses
+func (c *Compiler) expandTrigger(tf triggerFunction, args []string) string {
+	var sb strings.Builder
+	for in := tf.body; ; {
+		t := c.tokenizerCS(&in)
+		if t == "" {
+			break
+		}
+		sb.WriteString(" ")
+		if t == "\"" {
+			s, _ := c.readString(&in)
+			sb.WriteString("\"" + s + "\"")
+			continue
+		}
+		if len(t) >= 2 && t[0] == '$' {
+			for i, a := range tf.args {
+				if strings.ToLower(t[1:]) == a {
+					arg := args[i]
+					if rd, ok := triggerMap[c.tokenizer(&arg)]; !ok || rd != 0 {
+						t = "(" + args[i] + ")"
 					} else {
-						c.vars[r] = uint8(fun.numVars)
-					}
-					if err := c.inclNumVars(&fun.numVars); err != nil {
-						return errmes(err)
+						t = args[i]
 					}
+					break
 				}
-				fun.numRets = int32(len(rets))
 			}
-			if err := c.stateBlock(&line, nil, true,
-				nil, &fun.ctrls, &fun.numVars); err != nil {
-				return errmes(err)
+		}
+		sb.WriteString(t)
+	}
+	return sb.String()
+}
+
+// A ZSS file that starts with [Module name], whose states and functions are
+// only compiled into the characters that import it. Outside the module, its
+// functions are called as name.function and its map names start with name.
+type compilerModule struct {
+	file    string
+	exports map[string]bool
+	imports []string
+}
+
+// Reads "[Module name; export: ...]", where the exports are the functions,
+// trigger functions and state numbers that importers can use
+func (c *Compiler) moduleSection(line *string, first bool) error {
+	name := c.scan(line)
+	if name == "" || name == ";" || name == "]" {
+		return c.yokisinaiToken()
+	}
+	if err := c.varNameCheck(name); err != nil {
+		return err
+	}
+	if !first {
+		return Error("Module must be declared before any other section: " + name)
+	}
+	is := NewIniSection()
+	c.ctrlName, c.params = "module", make(map[string]srcPos)
+	for c.scan(line); c.token != "]"; {
+		switch c.token {
+		case ";":
+			if err := c.readKeyValue(is, "]", line); err != nil {
+				return err
+			}
+		default:
+			return c.yokisinaiToken()
+		}
+	}
+	if c.prepass {
+		if m, ok := c.modules[name]; ok && m.file != c.file {
+			return Error("Module already declared in " + m.file + ": " + name)
+		}
+		m := &compilerModule{file: c.file, exports: make(map[string]bool)}
+		for _, e := range SplitAndTrim(strings.ToLower(is["export"]), ",") {
+			if _, err := strconv.Atoi(e); err != nil {
+				if err := c.varNameCheck(e); err != nil {
+					return err
+				}
 			}
-			if _, ok := c.funcs[name]; ok {
+			m.exports[e] = true
+		}
+		c.modules[name] = m
+	}
+	c.ctrlName, c.module = "", name
+	return c.statementEnd(line)
+}
+
+// Reads "[Import name]", which is recorded by the prepass for the module or
+// the character that the file belongs to
+func (c *Compiler) importSection(line *string) error {
+	name := c.scan(line)
+	if name == "" || name == "]" {
+		return c.yokisinaiToken()
+	}
+	c.scan(line)
+	if err := c.needToken("]"); err != nil {
+		return err
+	}
+	if name == c.module {
+		return Error("Module imports itself: " + name)
+	}
+	if c.prepass {
+		if c.module != "" {
+			c.modules[c.module].imports = append(c.modules[c.module].imports, name)
+		} else {
+			c.imports[name] = true
+		}
+	} else if _, ok := c.modules[name]; !ok {
+		return Error("Module not found: " + name)
+	}
+	return c.statementEnd(line)
+}
+
+// Imports what the imported modules import in turn, once the prepass has
+// read every module
+func (c *Compiler) resolveImports(def string) error {
+	for todo := true; todo; {
+		todo = false
+		for name := range c.imports {
+			m, ok := c.modules[name]
+			if !ok {
 				continue
-				//return errmes(Error("Function already defined in other file: " + name))
 			}
-			c.funcs[name] = fun
-			//c.funcUsed[name] = true
-		default:
-			return errmes(Error("Unrecognized section (group) name: " + c.token))
+			for _, i := range m.imports {
+				if !c.imports[i] {
+					c.imports[i], todo = true, true
+				}
+			}
+		}
+	}
+	var missing []string
+	for name := range c.imports {
+		if _, ok := c.modules[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return &CompileError{File: def, Ctrl: "files", Param: "import",
+			Err: Error("Module not found: " + strings.Join(missing, ", "))}
+	}
+	return nil
+}
+
+// Resolves the name of a called function, exists telling whether a name is
+// defined. Within a module its functions are called by their own name, and
+// elsewhere as module.function once the module is imported and exports it.
+func (c *Compiler) funcName(name string,
+	exists func(string) bool) (string, error) {
+	if c.module != "" && exists(c.module+"."+name) {
+		return c.module + "." + name, nil
+	}
+	i := strings.Index(name, ".")
+	if i < 0 {
+		return name, nil
+	}
+	m, ok := c.modules[name[:i]]
+	if !ok || name[:i] == c.module {
+		return name, nil
+	}
+	if !c.imports[name[:i]] {
+		return "", Error("Module not imported: " + name[:i])
+	}
+	if !m.exports[name[i+1:]] {
+		return "", Error(name[i+1:] + " is not exported by module " + name[:i])
+	}
+	return name, nil
+}
+func (c *Compiler) trigFuncName(name string) (string, bool, error) {
+	name, err := c.funcName(name, func(name string) bool {
+		_, ok := c.trigFuncs[name]
+		return ok
+	})
+	_, ok := c.trigFuncs[name]
+	return name, ok, err
+}
+
+// States of a module must be exported, and cannot share their number with
+// any other state. Negative states are run by everyone and are not checked.
+func (c *Compiler) moduleStateCheck(states map[int32]StateBytecode) error {
+	if c.stateNo < 0 {
+		return nil
+	}
+	if m, ok := c.moduleStates[c.stateNo]; ok && m != c.module {
+		return Error(fmt.Sprintf("State %v already defined by module %v",
+			c.stateNo, m))
+	}
+	if c.module == "" {
+		return nil
+	}
+	if !c.modules[c.module].exports[strconv.Itoa(int(c.stateNo))] {
+		return Error(fmt.Sprintf("State %v is not exported by module %v",
+			c.stateNo, c.module))
+	}
+	if _, ok := states[c.stateNo]; ok {
+		return Error(fmt.Sprintf("State %v of module %v is already defined",
+			c.stateNo, c.module))
+	}
+	c.moduleStates[c.stateNo] = c.module
+	return nil
+}
+
+// Map names that start with the name of a module and a dot belong to it, so
+// the maps of a module cannot collide with those of characters or of other
+// modules. A module can only use its own maps.
+func (c *Compiler) mapNameCheck(name string) error {
+	i := strings.Index(name, ".")
+	if c.module != "" && (i < 0 || name[:i] != c.module) {
+		return Error("Map " + name + " of module " + c.module +
+			" must be named " + c.module + "." + name[i+1:])
+	}
+	if i > 0 && name[:i] != c.module {
+		if _, ok := c.modules[name[:i]]; ok {
+			return Error("Map " + name + " belongs to module " + name[:i])
 		}
 	}
 	return nil
 }
 
+// The command list of a character, made if it does not exist yet
+func charCommandList(pn int) *CommandList {
+	if sys.chars[pn][0].cmd == nil {
+		sys.chars[pn][0].cmd = make([]CommandList, MaxSimul*2+MaxAttachedChar)
+		b := NewCommandBuffer()
+		for i := range sys.chars[pn][0].cmd {
+			sys.chars[pn][0].cmd[i] = *NewCommandList(b)
+		}
+	}
+	return &sys.chars[pn][0].cmd[pn]
+}
+
 // Compile a character definition file
 func (c *Compiler) Compile(pn int, def string) (map[int32]StateBytecode,
 	error) {
@@ -8989,7 +9834,9 @@ func (c *Compiler) Compile(pn int, def string) (map[int32]StateBytecode,
 	if err != nil {
 		return nil, err
 	}
+	c.sources = append(c.sources, def)
 	lines, i, cmd, stcommon := SplitAndTrim(str, "\n"), 0, "", ""
+	cmdLines := 0
 	var st [11]string
 	info, files := true, true
 	for i < len(lines) {
@@ -9020,6 +9867,11 @@ func (c *Compiler) Compile(pn int, def string) (map[int32]StateBytecode,
 			if files {
 				files = false
 				cmd, stcommon = is["cmd"], is["stcommon"]
+				for _, m := range SplitAndTrim(is["import"], ",") {
+					if m != "" {
+						c.imports[strings.ToLower(m)] = true
+					}
+				}
 				st[0] = is["st"]
 				for i := 1; i < len(st); i++ {
 					st[i] = is[fmt.Sprintf("st%v", i-1)]
@@ -9034,6 +9886,8 @@ func (c *Compiler) Compile(pn int, def string) (map[int32]StateBytecode,
 		if err != nil {
 			return err
 		}
+		c.sources = append(c.sources, filename)
+		cmdLines = len(SplitAndTrim(str, "\n"))
 		str = str + sys.commonCmd
 		lines, i = SplitAndTrim(str, "\n"), 0
 		return nil
@@ -9041,20 +9895,14 @@ func (c *Compiler) Compile(pn int, def string) (map[int32]StateBytecode,
 		return nil, err
 	}
 
-	// Initialize command list data
-	if sys.chars[pn][0].cmd == nil {
-		sys.chars[pn][0].cmd = make([]CommandList, MaxSimul*2+MaxAttachedChar)
-		b := NewCommandBuffer()
-		for i := range sys.chars[pn][0].cmd {
-			sys.chars[pn][0].cmd[i] = *NewCommandList(b)
-		}
-	}
-	c.cmdl = &sys.chars[pn][0].cmd[pn]
+	c.cmdl = charCommandList(pn)
 	remap, defaults, ckr := true, true, NewCommandKeyRemap()
 
 	var cmds []IniSection
+	var cmdPos []srcPos
 	for i < len(lines) {
 		// Read ini sections of command file
+		start := i
 		is, name, _ := ReadIniSection(lines, &i)
 		switch name {
 		case "remap":
@@ -9110,20 +9958,40 @@ func (c *Compiler) Compile(pn int, def string) (map[int32]StateBytecode,
 			// Read input commands
 			if len(name) >= 7 && name[:7] == "command" {
 				cmds = append(cmds, is)
+				for ; start < i; start++ {
+					if n, _ := SectionName(lines[start]); n != "" {
+						break
+					}
+				}
+				cmdPos = append(cmdPos, srcPos{start + 1, 1})
 			}
 		}
 	}
 	// Parse input commands
-	for _, is := range cmds {
+	for n, is := range cmds {
+		// Commands past the end of the command file come from the common one
+		cmdErr := func(param string, err error) error {
+			ce := &CompileError{File: cmd, Line: cmdPos[n].line,
+				Col: cmdPos[n].col, Ctrl: "command", Param: param, Err: err}
+			if ce.Line > cmdLines {
+				ce.File, ce.Line = sys.commonCmdFile, ce.Line-cmdLines
+			}
+			return ce
+		}
 		name, _, err := is.getText("name")
 		if err != nil {
-			return nil, Error(fmt.Sprintf("%v:\nname: %v\n%v",
-				cmd, name, err.Error()))
+			if err = cmdErr("name", err); c.lintError(err) {
+				continue
+			}
+			return nil, err
 		}
 		cm, err := ReadCommand(name, is["command"], ckr)
 		if err != nil {
-			return nil, Error(cmd + ":\nname = " + is["name"] +
-				"\ncommand = " + is["command"] + "\n" + err.Error())
+			err = cmdErr("command", Error(name+": "+err.Error()))
+			if c.lintError(err) {
+				continue
+			}
+			return nil, err
 		}
 		cm.time, cm.buftime = c.cmdl.DefaultTime, c.cmdl.DefaultBufferTime
 		is.ReadI32("time", &cm.time)
@@ -9138,29 +10006,53 @@ func (c *Compiler) Compile(pn int, def string) (map[int32]StateBytecode,
 	sys.stringPool[pn].Clear()
 	sys.cgi[pn].wakewakaLength = 0
 	c.funcUsed = make(map[string]bool)
+	// Read trigger functions first, so that they can be used in any file.
+	// Files that fail to load are left to be reported below.
+	c.prepass = true
+	for _, s := range append(append(st[:], cmd, stcommon), sys.commonStates...) {
+		if len(s) > 0 {
+			if err := c.stateCompile(states, s, def); err != nil {
+				if _, ok := err.(*CompileError); ok && !c.lintError(err) {
+					c.prepass = false
+					return nil, err
+				}
+			}
+		}
+	}
+	c.prepass = false
+	if err := c.resolveImports(def); err != nil && !c.lintError(err) {
+		return nil, err
+	}
 	// Compile state files
 	for _, s := range st {
 		if len(s) > 0 {
-			if err := c.stateCompile(states, s, def); err != nil {
+			if err := c.stateCompile(states, s, def); err != nil &&
+				!c.lintError(&CompileError{File: s, Err: err}) {
 				return nil, err
 			}
 		}
 	}
 	// Compile states in command file
-	if err := c.stateCompile(states, cmd, def); err != nil {
+	if err := c.stateCompile(states, cmd, def); err != nil &&
+		!c.lintError(&CompileError{File: cmd, Err: err}) {
 		return nil, err
 	}
 	// Compile states in common state file
 	if len(stcommon) > 0 {
-		if err := c.stateCompile(states, stcommon, def); err != nil {
+		if err := c.stateCompile(states, stcommon, def); err != nil &&
+			!c.lintError(&CompileError{File: stcommon, Err: err}) {
 			return nil, err
 		}
 	}
 	// Compile common states from config
 	for _, s := range sys.commonStates {
-		if err := c.stateCompile(states, s, def); err != nil {
+		if err := c.stateCompile(states, s, def); err != nil &&
+			!c.lintError(&CompileError{File: s, Err: err}) {
 			return nil, err
 		}
 	}
+	if !sys.noOptimize && c.lint == nil {
+		c.optimize(states, def)
+	}
 	return states, nil
 }
@@ -0,0 +1,673 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// Prints the compiled states of a character, or only stateno if it is not
+// empty, as a listing of their controllers and bytecode
+func disasmChar(def, stateno string, w io.Writer) int {
+	if !strings.HasSuffix(strings.ToLower(def), ".def") {
+		def = filepath.Join("chars", def, filepath.Base(def)+".def")
+	}
+	sys.chars[0] = []*Char{newChar(0, 0)}
+	states, err := newCompiler().Compile(0, def)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+	nos := make([]int, 0, len(states))
+	for no := range states {
+		nos = append(nos, int(no))
+	}
+	if stateno != "" {
+		no, err := strconv.Atoi(stateno)
+		if _, ok := states[int32(no)]; err != nil || !ok {
+			fmt.Fprintf(w, "State %v not found in %v\n", stateno, def)
+			return 1
+		}
+		nos = []int{no}
+	}
+	sort.Ints(nos)
+	d := &disassembler{w: w}
+	for _, no := range nos {
+		sb := states[int32(no)]
+		d.line(0, "state %v (type %v, movetype %v, physics %v, %v vars)", no,
+			sb.stateType, sb.moveType, sb.physics, sb.numVars)
+		d.params(StateControllerBase(sb.stateDef), nil, 1)
+		d.ctrls(sb.block.ctrls, 1)
+	}
+	return 0
+}
+
+type disassembler struct {
+	w  io.Writer
+	pn int
+}
+
+func (d *disassembler) line(depth int, format string, a ...interface{}) {
+	fmt.Fprintf(d.w, "%v%v\n", strings.Repeat("  ", depth),
+		fmt.Sprintf(format, a...))
+}
+func (d *disassembler) ctrls(ctrls []StateController, depth int) {
+	for i, sc := range ctrls {
+		switch sc := sc.(type) {
+		case StateBlock:
+			d.block(&sc, fmt.Sprintf("%v: block", i+1), depth)
+		case varAssign:
+			d.line(depth, "%v: let $%v", i+1, sc.vari)
+			d.exp(sc.be, depth+1)
+		case callFunction:
+			d.line(depth, "%v: call (%v args, %v vars)", i+1, sc.numArgs,
+				sc.numVars)
+			d.exp(sc.arg, depth+1)
+			d.ctrls(sc.ctrls, depth+1)
+		case StateExpr:
+			d.line(depth, "%v: expression", i+1)
+			d.exp(BytecodeExp(sc), depth+1)
+		case loopJump:
+			if LoopJump(sc) == LJ_Break {
+				d.line(depth, "%v: break", i+1)
+			} else {
+				d.line(depth, "%v: continue", i+1)
+			}
+		default:
+			d.line(depth, "%v: %v", i+1,
+				strings.TrimPrefix(reflect.TypeOf(sc).String(), "main."))
+			// Most controllers are a StateControllerBase under another name
+			if v := reflect.ValueOf(sc); v.Kind() == reflect.Slice &&
+				v.Type().Elem().Kind() == reflect.Uint8 {
+				d.params(StateControllerBase(v.Bytes()),
+					disasmStringParams[v.Type()], depth+1)
+			}
+		}
+	}
+}
+func (d *disassembler) block(b *StateBlock, name string, depth int) {
+	switch {
+	case b.forLoop:
+		name += fmt.Sprintf(" for $%v", b.forVar)
+	case b.loop:
+		name += " while"
+	}
+	if b.persistent != 1 {
+		name += fmt.Sprintf(" persistent %v", b.persistent)
+	}
+	if b.ignorehitpause >= -1 {
+		name += " ignorehitpause"
+	}
+	d.line(depth, "%v", name)
+	if b.forLoop {
+		for i, e := range b.forExp {
+			if len(e) > 0 {
+				d.line(depth+1, "for %v:", i+1)
+				d.exp(e, depth+2)
+			}
+		}
+	}
+	if len(b.trigger) > 0 {
+		d.line(depth+1, "trigger:")
+		d.exp(b.trigger, depth+2)
+	}
+	d.ctrls(b.ctrls, depth+1)
+	if b.elseBlock != nil {
+		d.block(b.elseBlock, "else", depth)
+	}
+}
+
+// Parameters that the compiler stores as the bytes of a string literal
+// rather than as bytecode, by controller
+var disasmStringParams = map[reflect.Type][]byte{
+	reflect.TypeOf(helper{}):        {helper_name},
+	reflect.TypeOf(dialogue{}):      {dialogue_text},
+	reflect.TypeOf(lifebarAction{}): {lifebarAction_text},
+	reflect.TypeOf(loadFile{}):      {loadFile_path},
+	reflect.TypeOf(mapSet{}):        {mapSet_mapArray},
+	reflect.TypeOf(matchRestart{}): {matchRestart_stagedef,
+		matchRestart_p1def, matchRestart_p2def, matchRestart_p3def,
+		matchRestart_p4def, matchRestart_p5def, matchRestart_p6def,
+		matchRestart_p7def, matchRestart_p8def},
+	reflect.TypeOf(rankAdd{}):     {rankAdd_icon, rankAdd_type},
+	reflect.TypeOf(remapSprite{}): {remapSprite_preset},
+	reflect.TypeOf(saveFile{}):    {saveFile_path},
+}
+
+func (d *disassembler) params(scb StateControllerBase, strs []byte,
+	depth int) {
+	for i := 0; i+2 <= len(scb); {
+		id, n := scb[i], int(scb[i+1])
+		i += 2
+		for m := 0; m < n && i+4 <= len(scb); m++ {
+			l := int(*(*int32)(unsafe.Pointer(&scb[i])))
+			i += 4
+			if l < 0 || i+l > len(scb) {
+				return
+			}
+			d.line(depth, "param %v[%v]:", id, m)
+			be := (*(*BytecodeExp)(unsafe.Pointer(&scb)))[i : i+l]
+			// Some parameters are raw data rather than bytecode
+			if bytes.IndexByte(strs, id) >= 0 {
+				d.line(depth+1, "string %q", string(scb[i:i+l]))
+			} else if _, ok := decodeExp(be); ok {
+				d.exp(be, depth+1)
+			} else {
+				d.line(depth+1, "raw %q", string(scb[i:i+l]))
+			}
+			i += l
+		}
+	}
+}
+
+// Prints an expression one instruction per line, with the bodies of runs
+// indented under them
+func (d *disassembler) exp(be BytecodeExp, depth int) {
+	for i := 0; i < len(be); {
+		n := be.instrLen(i)
+		if n == 0 {
+			d.line(depth, "%4v: truncated %v", i, be[i:])
+			return
+		}
+		d.line(depth, "%4v: %v", i, disasmInstr(be, i, n, d.pn))
+		if be[i] == OC_run || be[i] == OC_nordrun {
+			d.exp(be[i+5:i+n], depth+1)
+		}
+		i += n
+	}
+}
+
+// Fast variable access, where op is an index into ivar or fvar
+func disasmVar(op OpCode) string {
+	switch {
+	case op < OC_sysvar0:
+		return fmt.Sprintf("var(%v)", op-OC_var0)
+	case op < OC_fvar0:
+		return fmt.Sprintf("sysvar(%v)", op-OC_sysvar0)
+	case op < OC_sysfvar0:
+		return fmt.Sprintf("fvar(%v)", op-OC_fvar0)
+	}
+	return fmt.Sprintf("sysfvar(%v)", op-OC_sysfvar0)
+}
+
+func disasmInstr(be BytecodeExp, i, n, pn int) string {
+	op := be[i]
+	i32 := func() int32 { return *(*int32)(unsafe.Pointer(&be[i+n-4])) }
+	str := func() string {
+		l := sys.stringPool[pn].List
+		if idx := int(i32()); idx >= 0 && idx < len(l) {
+			return strconv.Quote(l[idx])
+		}
+		return fmt.Sprintf("string#%v", i32())
+	}
+	name, ok := opCodeNames[op]
+	switch {
+	case op < OC_var:
+		return disasmVar(op)
+	case !ok:
+		return fmt.Sprintf("unknown %v", op)
+	case isJump8(op):
+		if be[i+1] == 0 {
+			return name + " -> end"
+		}
+		return fmt.Sprintf("%v -> %v", name, i+n+int(uint8(be[i+1])))
+	case isJump32(op) || isRedirect(op):
+		return fmt.Sprintf("%v -> %v", name, i+n+int(i32()))
+	case op == OC_run || op == OC_nordrun:
+		return fmt.Sprintf("%v (%v bytes)", name, n-5)
+	case op == OC_int8:
+		return fmt.Sprintf("%v %v", name, int8(be[i+1]))
+	case op == OC_float:
+		return fmt.Sprintf("%v %v", name, *(*float32)(unsafe.Pointer(&be[i+1])))
+	case n == 2 && op != OC_st_ && op != OC_const_ && op != OC_ex_:
+		return fmt.Sprintf("%v %v", name, be[i+1])
+	case op == OC_int || op == OC_command || op == OC_hitdefattr:
+		return fmt.Sprintf("%v %v", name, i32())
+	case op == OC_st_:
+		sub := be[i+1]
+		if sn, ok := stOpCodeNames[sub]; ok {
+			return "st." + sn
+		} else if sub < OC_var {
+			return "st." + disasmVar(sub)
+		} else if sub < OC_var*2 {
+			return "st." + disasmVar(sub-OC_var) + "add"
+		}
+	case op == OC_const_:
+		sn, ok := constOpCodeNames[be[i+1]]
+		if !ok {
+			break
+		}
+		if n == 6 {
+			return fmt.Sprintf("const.%v %v", sn, str())
+		}
+		return "const." + sn
+	case op == OC_ex_:
+		sn, ok := exOpCodeNames[be[i+1]]
+		if !ok {
+			break
+		}
+		switch be[i+1] {
+		case OC_ex_gamemode, OC_ex_helpername, OC_ex_maparray, OC_ex_string:
+			return fmt.Sprintf("ex.%v %v", sn, str())
+		}
+		switch n {
+		case 6:
+			return fmt.Sprintf("ex.%v %v", sn, i32())
+		case 3:
+			return fmt.Sprintf("ex.%v %v", sn, be[i+2])
+		}
+		return "ex." + sn
+	default:
+		return name
+	}
+	return fmt.Sprintf("%v unknown %v", name, be[i+1])
+}
+
+var opCodeNames = map[OpCode]string{
+	OC_var:               "var",
+	OC_sysvar:            "sysvar",
+	OC_fvar:              "fvar",
+	OC_sysfvar:           "sysfvar",
+	OC_localvar:          "localvar",
+	OC_int8:              "int8",
+	OC_int:               "int",
+	OC_float:             "float",
+	OC_pop:               "pop",
+	OC_dup:               "dup",
+	OC_swap:              "swap",
+	OC_run:               "run",
+	OC_nordrun:           "nordrun",
+	OC_jsf8:              "jsf8",
+	OC_jmp8:              "jmp8",
+	OC_jz8:               "jz8",
+	OC_jnz8:              "jnz8",
+	OC_jmp:               "jmp",
+	OC_jz:                "jz",
+	OC_jnz:               "jnz",
+	OC_eq:                "eq",
+	OC_ne:                "ne",
+	OC_gt:                "gt",
+	OC_le:                "le",
+	OC_lt:                "lt",
+	OC_ge:                "ge",
+	OC_neg:               "neg",
+	OC_blnot:             "blnot",
+	OC_bland:             "bland",
+	OC_blxor:             "blxor",
+	OC_blor:              "blor",
+	OC_not:               "not",
+	OC_and:               "and",
+	OC_xor:               "xor",
+	OC_or:                "or",
+	OC_add:               "add",
+	OC_sub:               "sub",
+	OC_mul:               "mul",
+	OC_div:               "div",
+	OC_mod:               "mod",
+	OC_pow:               "pow",
+	OC_abs:               "abs",
+	OC_exp:               "exp",
+	OC_ln:                "ln",
+	OC_log:               "log",
+	OC_cos:               "cos",
+	OC_sin:               "sin",
+	OC_tan:               "tan",
+	OC_acos:              "acos",
+	OC_asin:              "asin",
+	OC_atan:              "atan",
+	OC_floor:             "floor",
+	OC_ceil:              "ceil",
+	OC_ifelse:            "ifelse",
+	OC_time:              "time",
+	OC_animtime:          "animtime",
+	OC_animelemtime:      "animelemtime",
+	OC_animelemno:        "animelemno",
+	OC_statetype:         "statetype",
+	OC_movetype:          "movetype",
+	OC_ctrl:              "ctrl",
+	OC_command:           "command",
+	OC_random:            "random",
+	OC_pos_x:             "pos_x",
+	OC_pos_y:             "pos_y",
+	OC_vel_x:             "vel_x",
+	OC_vel_y:             "vel_y",
+	OC_screenpos_x:       "screenpos_x",
+	OC_screenpos_y:       "screenpos_y",
+	OC_facing:            "facing",
+	OC_anim:              "anim",
+	OC_animexist:         "animexist",
+	OC_selfanimexist:     "selfanimexist",
+	OC_alive:             "alive",
+	OC_life:              "life",
+	OC_lifemax:           "lifemax",
+	OC_power:             "power",
+	OC_powermax:          "powermax",
+	OC_canrecover:        "canrecover",
+	OC_roundstate:        "roundstate",
+	OC_ishelper:          "ishelper",
+	OC_numhelper:         "numhelper",
+	OC_numexplod:         "numexplod",
+	OC_numprojid:         "numprojid",
+	OC_numproj:           "numproj",
+	OC_teammode:          "teammode",
+	OC_teamside:          "teamside",
+	OC_hitdefattr:        "hitdefattr",
+	OC_inguarddist:       "inguarddist",
+	OC_movecontact:       "movecontact",
+	OC_movehit:           "movehit",
+	OC_moveguarded:       "moveguarded",
+	OC_movereversed:      "movereversed",
+	OC_projcontacttime:   "projcontacttime",
+	OC_projhittime:       "projhittime",
+	OC_projguardedtime:   "projguardedtime",
+	OC_projcanceltime:    "projcanceltime",
+	OC_backedge:          "backedge",
+	OC_backedgedist:      "backedgedist",
+	OC_backedgebodydist:  "backedgebodydist",
+	OC_frontedge:         "frontedge",
+	OC_frontedgedist:     "frontedgedist",
+	OC_frontedgebodydist: "frontedgebodydist",
+	OC_leftedge:          "leftedge",
+	OC_rightedge:         "rightedge",
+	OC_topedge:           "topedge",
+	OC_bottomedge:        "bottomedge",
+	OC_camerapos_x:       "camerapos_x",
+	OC_camerapos_y:       "camerapos_y",
+	OC_camerazoom:        "camerazoom",
+	OC_gamewidth:         "gamewidth",
+	OC_gameheight:        "gameheight",
+	OC_screenwidth:       "screenwidth",
+	OC_screenheight:      "screenheight",
+	OC_stateno:           "stateno",
+	OC_prevstateno:       "prevstateno",
+	OC_id:                "id",
+	OC_playeridexist:     "playeridexist",
+	OC_gametime:          "gametime",
+	OC_numtarget:         "numtarget",
+	OC_numenemy:          "numenemy",
+	OC_numpartner:        "numpartner",
+	OC_ailevel:           "ailevel",
+	OC_palno:             "palno",
+	OC_hitcount:          "hitcount",
+	OC_uniqhitcount:      "uniqhitcount",
+	OC_hitpausetime:      "hitpausetime",
+	OC_hitover:           "hitover",
+	OC_hitshakeover:      "hitshakeover",
+	OC_hitfall:           "hitfall",
+	OC_hitvel_x:          "hitvel_x",
+	OC_hitvel_y:          "hitvel_y",
+	OC_roundsexisted:     "roundsexisted",
+	OC_parent:            "parent",
+	OC_root:              "root",
+	OC_helper:            "helper",
+	OC_target:            "target",
+	OC_partner:           "partner",
+	OC_enemy:             "enemy",
+	OC_enemynear:         "enemynear",
+	OC_playerid:          "playerid",
+	OC_p2:                "p2",
+	OC_rdreset:           "rdreset",
+	OC_const_:            "const_",
+	OC_st_:               "st_",
+	OC_ex_:               "ex_",
+}
+
+var stOpCodeNames = map[OpCode]string{
+	OC_st_var:        "var",
+	OC_st_sysvar:     "sysvar",
+	OC_st_fvar:       "fvar",
+	OC_st_sysfvar:    "sysfvar",
+	OC_st_varadd:     "varadd",
+	OC_st_sysvaradd:  "sysvaradd",
+	OC_st_fvaradd:    "fvaradd",
+	OC_st_sysfvaradd: "sysfvaradd",
+}
+
+var constOpCodeNames = map[OpCode]string{
+	OC_const_data_life:                                          "data_life",
+	OC_const_data_power:                                         "data_power",
+	OC_const_data_guardpoints:                                   "data_guardpoints",
+	OC_const_data_dizzypoints:                                   "data_dizzypoints",
+	OC_const_data_attack:                                        "data_attack",
+	OC_const_data_defence:                                       "data_defence",
+	OC_const_data_fall_defence_mul:                              "data_fall_defence_mul",
+	OC_const_data_liedown_time:                                  "data_liedown_time",
+	OC_const_data_airjuggle:                                     "data_airjuggle",
+	OC_const_data_sparkno:                                       "data_sparkno",
+	OC_const_data_guard_sparkno:                                 "data_guard_sparkno",
+	OC_const_data_ko_echo:                                       "data_ko_echo",
+	OC_const_data_intpersistindex:                               "data_intpersistindex",
+	OC_const_data_floatpersistindex:                             "data_floatpersistindex",
+	OC_const_size_xscale:                                        "size_xscale",
+	OC_const_size_yscale:                                        "size_yscale",
+	OC_const_size_ground_back:                                   "size_ground_back",
+	OC_const_size_ground_front:                                  "size_ground_front",
+	OC_const_size_air_back:                                      "size_air_back",
+	OC_const_size_air_front:                                     "size_air_front",
+	OC_const_size_z_width:                                       "size_z_width",
+	OC_const_size_height:                                        "size_height",
+	OC_const_size_attack_dist:                                   "size_attack_dist",
+	OC_const_size_attack_z_width_back:                           "size_attack_z_width_back",
+	OC_const_size_attack_z_width_front:                          "size_attack_z_width_front",
+	OC_const_size_proj_attack_dist:                              "size_proj_attack_dist",
+	OC_const_size_proj_doscale:                                  "size_proj_doscale",
+	OC_const_size_head_pos_x:                                    "size_head_pos_x",
+	OC_const_size_head_pos_y:                                    "size_head_pos_y",
+	OC_const_size_mid_pos_x:                                     "size_mid_pos_x",
+	OC_const_size_mid_pos_y:                                     "size_mid_pos_y",
+	OC_const_size_shadowoffset:                                  "size_shadowoffset",
+	OC_const_size_draw_offset_x:                                 "size_draw_offset_x",
+	OC_const_size_draw_offset_y:                                 "size_draw_offset_y",
+	OC_const_velocity_walk_fwd_x:                                "velocity_walk_fwd_x",
+	OC_const_velocity_walk_back_x:                               "velocity_walk_back_x",
+	OC_const_velocity_walk_up_x:                                 "velocity_walk_up_x",
+	OC_const_velocity_walk_down_x:                               "velocity_walk_down_x",
+	OC_const_velocity_run_fwd_x:                                 "velocity_run_fwd_x",
+	OC_const_velocity_run_fwd_y:                                 "velocity_run_fwd_y",
+	OC_const_velocity_run_back_x:                                "velocity_run_back_x",
+	OC_const_velocity_run_back_y:                                "velocity_run_back_y",
+	OC_const_velocity_run_up_x:                                  "velocity_run_up_x",
+	OC_const_velocity_run_up_y:                                  "velocity_run_up_y",
+	OC_const_velocity_run_down_x:                                "velocity_run_down_x",
+	OC_const_velocity_run_down_y:                                "velocity_run_down_y",
+	OC_const_velocity_jump_y:                                    "velocity_jump_y",
+	OC_const_velocity_jump_neu_x:                                "velocity_jump_neu_x",
+	OC_const_velocity_jump_back_x:                               "velocity_jump_back_x",
+	OC_const_velocity_jump_fwd_x:                                "velocity_jump_fwd_x",
+	OC_const_velocity_jump_up_x:                                 "velocity_jump_up_x",
+	OC_const_velocity_jump_down_x:                               "velocity_jump_down_x",
+	OC_const_velocity_runjump_back_x:                            "velocity_runjump_back_x",
+	OC_const_velocity_runjump_back_y:                            "velocity_runjump_back_y",
+	OC_const_velocity_runjump_y:                                 "velocity_runjump_y",
+	OC_const_velocity_runjump_fwd_x:                             "velocity_runjump_fwd_x",
+	OC_const_velocity_runjump_up_x:                              "velocity_runjump_up_x",
+	OC_const_velocity_runjump_down_x:                            "velocity_runjump_down_x",
+	OC_const_velocity_airjump_y:                                 "velocity_airjump_y",
+	OC_const_velocity_airjump_neu_x:                             "velocity_airjump_neu_x",
+	OC_const_velocity_airjump_back_x:                            "velocity_airjump_back_x",
+	OC_const_velocity_airjump_fwd_x:                             "velocity_airjump_fwd_x",
+	OC_const_velocity_airjump_up_x:                              "velocity_airjump_up_x",
+	OC_const_velocity_airjump_down_x:                            "velocity_airjump_down_x",
+	OC_const_velocity_air_gethit_groundrecover_x:                "velocity_air_gethit_groundrecover_x",
+	OC_const_velocity_air_gethit_groundrecover_y:                "velocity_air_gethit_groundrecover_y",
+	OC_const_velocity_air_gethit_airrecover_mul_x:               "velocity_air_gethit_airrecover_mul_x",
+	OC_const_velocity_air_gethit_airrecover_mul_y:               "velocity_air_gethit_airrecover_mul_y",
+	OC_const_velocity_air_gethit_airrecover_add_x:               "velocity_air_gethit_airrecover_add_x",
+	OC_const_velocity_air_gethit_airrecover_add_y:               "velocity_air_gethit_airrecover_add_y",
+	OC_const_velocity_air_gethit_airrecover_back:                "velocity_air_gethit_airrecover_back",
+	OC_const_velocity_air_gethit_airrecover_fwd:                 "velocity_air_gethit_airrecover_fwd",
+	OC_const_velocity_air_gethit_airrecover_up:                  "velocity_air_gethit_airrecover_up",
+	OC_const_velocity_air_gethit_airrecover_down:                "velocity_air_gethit_airrecover_down",
+	OC_const_movement_airjump_num:                               "movement_airjump_num",
+	OC_const_movement_airjump_height:                            "movement_airjump_height",
+	OC_const_movement_yaccel:                                    "movement_yaccel",
+	OC_const_movement_stand_friction:                            "movement_stand_friction",
+	OC_const_movement_crouch_friction:                           "movement_crouch_friction",
+	OC_const_movement_stand_friction_threshold:                  "movement_stand_friction_threshold",
+	OC_const_movement_crouch_friction_threshold:                 "movement_crouch_friction_threshold",
+	OC_const_movement_air_gethit_groundlevel:                    "movement_air_gethit_groundlevel",
+	OC_const_movement_air_gethit_groundrecover_ground_threshold: "movement_air_gethit_groundrecover_ground_threshold",
+	OC_const_movement_air_gethit_groundrecover_groundlevel:      "movement_air_gethit_groundrecover_groundlevel",
+	OC_const_movement_air_gethit_airrecover_threshold:           "movement_air_gethit_airrecover_threshold",
+	OC_const_movement_air_gethit_airrecover_yaccel:              "movement_air_gethit_airrecover_yaccel",
+	OC_const_movement_air_gethit_trip_groundlevel:               "movement_air_gethit_trip_groundlevel",
+	OC_const_movement_down_bounce_offset_x:                      "movement_down_bounce_offset_x",
+	OC_const_movement_down_bounce_offset_y:                      "movement_down_bounce_offset_y",
+	OC_const_movement_down_bounce_yaccel:                        "movement_down_bounce_yaccel",
+	OC_const_movement_down_bounce_groundlevel:                   "movement_down_bounce_groundlevel",
+	OC_const_movement_down_friction_threshold:                   "movement_down_friction_threshold",
+	OC_const_name:                                               "name",
+	OC_const_p2name:                                             "p2name",
+	OC_const_p3name:                                             "p3name",
+	OC_const_p4name:                                             "p4name",
+	OC_const_p5name:                                             "p5name",
+	OC_const_p6name:                                             "p6name",
+	OC_const_p7name:                                             "p7name",
+	OC_const_p8name:                                             "p8name",
+	OC_const_authorname:                                         "authorname",
+	OC_const_stagevar_info_author:                               "stagevar_info_author",
+	OC_const_stagevar_info_displayname:                          "stagevar_info_displayname",
+	OC_const_stagevar_info_name:                                 "stagevar_info_name",
+	OC_const_constants:                                          "constants",
+	OC_const_stage_constants:                                    "stage_constants",
+	OC_const_constants_cached:                                   "constants_cached",
+	OC_const_stage_constants_cached:                             "stage_constants_cached",
+}
+
+var exOpCodeNames = map[OpCode]string{
+	OC_ex_p2dist_x:                      "p2dist_x",
+	OC_ex_p2dist_y:                      "p2dist_y",
+	OC_ex_p2bodydist_x:                  "p2bodydist_x",
+	OC_ex_parentdist_x:                  "parentdist_x",
+	OC_ex_parentdist_y:                  "parentdist_y",
+	OC_ex_rootdist_x:                    "rootdist_x",
+	OC_ex_rootdist_y:                    "rootdist_y",
+	OC_ex_win:                           "win",
+	OC_ex_winko:                         "winko",
+	OC_ex_wintime:                       "wintime",
+	OC_ex_winperfect:                    "winperfect",
+	OC_ex_winspecial:                    "winspecial",
+	OC_ex_winhyper:                      "winhyper",
+	OC_ex_lose:                          "lose",
+	OC_ex_loseko:                        "loseko",
+	OC_ex_losetime:                      "losetime",
+	OC_ex_drawgame:                      "drawgame",
+	OC_ex_matchover:                     "matchover",
+	OC_ex_matchno:                       "matchno",
+	OC_ex_roundno:                       "roundno",
+	OC_ex_ishometeam:                    "ishometeam",
+	OC_ex_tickspersecond:                "tickspersecond",
+	OC_ex_majorversion:                  "majorversion",
+	OC_ex_drawpalno:                     "drawpalno",
+	OC_ex_const240p:                     "const240p",
+	OC_ex_const480p:                     "const480p",
+	OC_ex_const720p:                     "const720p",
+	OC_ex_gethitvar_animtype:            "gethitvar_animtype",
+	OC_ex_gethitvar_airtype:             "gethitvar_airtype",
+	OC_ex_gethitvar_groundtype:          "gethitvar_groundtype",
+	OC_ex_gethitvar_damage:              "gethitvar_damage",
+	OC_ex_gethitvar_hitcount:            "gethitvar_hitcount",
+	OC_ex_gethitvar_fallcount:           "gethitvar_fallcount",
+	OC_ex_gethitvar_hitshaketime:        "gethitvar_hitshaketime",
+	OC_ex_gethitvar_hittime:             "gethitvar_hittime",
+	OC_ex_gethitvar_slidetime:           "gethitvar_slidetime",
+	OC_ex_gethitvar_ctrltime:            "gethitvar_ctrltime",
+	OC_ex_gethitvar_recovertime:         "gethitvar_recovertime",
+	OC_ex_gethitvar_xoff:                "gethitvar_xoff",
+	OC_ex_gethitvar_yoff:                "gethitvar_yoff",
+	OC_ex_gethitvar_xvel:                "gethitvar_xvel",
+	OC_ex_gethitvar_yvel:                "gethitvar_yvel",
+	OC_ex_gethitvar_yaccel:              "gethitvar_yaccel",
+	OC_ex_gethitvar_chainid:             "gethitvar_chainid",
+	OC_ex_gethitvar_guarded:             "gethitvar_guarded",
+	OC_ex_gethitvar_isbound:             "gethitvar_isbound",
+	OC_ex_gethitvar_fall:                "gethitvar_fall",
+	OC_ex_gethitvar_fall_damage:         "gethitvar_fall_damage",
+	OC_ex_gethitvar_fall_xvel:           "gethitvar_fall_xvel",
+	OC_ex_gethitvar_fall_yvel:           "gethitvar_fall_yvel",
+	OC_ex_gethitvar_fall_recover:        "gethitvar_fall_recover",
+	OC_ex_gethitvar_fall_time:           "gethitvar_fall_time",
+	OC_ex_gethitvar_fall_recovertime:    "gethitvar_fall_recovertime",
+	OC_ex_gethitvar_fall_kill:           "gethitvar_fall_kill",
+	OC_ex_gethitvar_fall_envshake_time:  "gethitvar_fall_envshake_time",
+	OC_ex_gethitvar_fall_envshake_freq:  "gethitvar_fall_envshake_freq",
+	OC_ex_gethitvar_fall_envshake_ampl:  "gethitvar_fall_envshake_ampl",
+	OC_ex_gethitvar_fall_envshake_phase: "gethitvar_fall_envshake_phase",
+	OC_ex_gethitvar_attr:                "gethitvar_attr",
+	OC_ex_gethitvar_dizzypoints:         "gethitvar_dizzypoints",
+	OC_ex_gethitvar_guardpoints:         "gethitvar_guardpoints",
+	OC_ex_gethitvar_id:                  "gethitvar_id",
+	OC_ex_gethitvar_playerno:            "gethitvar_playerno",
+	OC_ex_gethitvar_redlife:             "gethitvar_redlife",
+	OC_ex_gethitvar_score:               "gethitvar_score",
+	OC_ex_gethitvar_hitdamage:           "gethitvar_hitdamage",
+	OC_ex_gethitvar_guarddamage:         "gethitvar_guarddamage",
+	OC_ex_gethitvar_hitpower:            "gethitvar_hitpower",
+	OC_ex_gethitvar_guardpower:          "gethitvar_guardpower",
+	OC_ex_ailevelf:                      "ailevelf",
+	OC_ex_animelemlength:                "animelemlength",
+	OC_ex_animlength:                    "animlength",
+	OC_ex_combocount:                    "combocount",
+	OC_ex_consecutivewins:               "consecutivewins",
+	OC_ex_dizzy:                         "dizzy",
+	OC_ex_dizzypoints:                   "dizzypoints",
+	OC_ex_dizzypointsmax:                "dizzypointsmax",
+	OC_ex_firstattack:                   "firstattack",
+	OC_ex_float:                         "float",
+	OC_ex_gamemode:                      "gamemode",
+	OC_ex_getplayerid:                   "getplayerid",
+	OC_ex_groundangle:                   "groundangle",
+	OC_ex_guardbreak:                    "guardbreak",
+	OC_ex_guardpoints:                   "guardpoints",
+	OC_ex_guardpointsmax:                "guardpointsmax",
+	OC_ex_helpername:                    "helpername",
+	OC_ex_hitoverridden:                 "hitoverridden",
+	OC_ex_incustomstate:                 "incustomstate",
+	OC_ex_indialogue:                    "indialogue",
+	OC_ex_isassertedchar:                "isassertedchar",
+	OC_ex_isassertedglobal:              "isassertedglobal",
+	OC_ex_ishost:                        "ishost",
+	OC_ex_localscale:                    "localscale",
+	OC_ex_maparray:                      "maparray",
+	OC_ex_max:                           "max",
+	OC_ex_min:                           "min",
+	OC_ex_memberno:                      "memberno",
+	OC_ex_movecountered:                 "movecountered",
+	OC_ex_pausetime:                     "pausetime",
+	OC_ex_physics:                       "physics",
+	OC_ex_playerno:                      "playerno",
+	OC_ex_rand:                          "rand",
+	OC_ex_rank:                          "rank",
+	OC_ex_ratiolevel:                    "ratiolevel",
+	OC_ex_receiveddamage:                "receiveddamage",
+	OC_ex_receivedhits:                  "receivedhits",
+	OC_ex_redlife:                       "redlife",
+	OC_ex_round:                         "round",
+	OC_ex_roundtype:                     "roundtype",
+	OC_ex_score:                         "score",
+	OC_ex_scoretotal:                    "scoretotal",
+	OC_ex_selfstatenoexist:              "selfstatenoexist",
+	OC_ex_sprpriority:                   "sprpriority",
+	OC_ex_stagebackedge:                 "stagebackedge",
+	OC_ex_stagefrontedge:                "stagefrontedge",
+	OC_ex_stagetime:                     "stagetime",
+	OC_ex_standby:                       "standby",
+	OC_ex_teamleader:                    "teamleader",
+	OC_ex_teamsize:                      "teamsize",
+	OC_ex_timeelapsed:                   "timeelapsed",
+	OC_ex_timeremaining:                 "timeremaining",
+	OC_ex_timetotal:                     "timetotal",
+	OC_ex_pos_z:                         "pos_z",
+	OC_ex_vel_z:                         "vel_z",
+	OC_ex_string:                        "string",
+	OC_ex_array:                         "array",
+	OC_ex_index:                         "index",
+	OC_ex_st_index:                      "st_index",
+	OC_ex_len:                           "len",
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/Windblade-GR01/Ikemen_GO/src/src/env"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// envEngine plays the matches of an env.Env the way the quick versus of
+// main.lua does, without the menus of the Lua scripts. Programs can import
+// the env package to train agents in Go, or use the JSON requests served by
+// serveEnv when the engine is started with -env.
+type envEngine struct {
+	motif     string
+	lifebar   string
+	charRefs  map[string]int
+	stageRefs map[string]int
+}
+
+// Gives the player the keys of an agent of the Env
+type envController struct {
+	input func(i int) env.Keys
+	index int
+}
+
+func (ec *envController) Input(_ *AiView) InputBits {
+	return InputBits(ec.input(ec.index))
+}
+
+func newEnvEngine(motif string) *envEngine {
+	return &envEngine{motif: motif, charRefs: make(map[string]int),
+		stageRefs: make(map[string]int)}
+}
+
+// Returns the index of def in the select list, adding it the first time
+func (e *envEngine) charRef(def string) (int, error) {
+	if cn, ok := e.charRefs[def]; ok {
+		return cn, nil
+	}
+	cn := len(sys.sel.charlist)
+	sys.sel.addChar(def)
+	if sys.sel.charlist[cn].def == "" {
+		return 0, Error("Character not found: " + def)
+	}
+	e.charRefs[def] = cn
+	return cn, nil
+}
+func (e *envEngine) stageRef(def string) (int, error) {
+	if sn, ok := e.stageRefs[def]; ok {
+		return sn, nil
+	}
+	if err := sys.sel.AddStage(def); err != nil {
+		return 0, err
+	}
+	sn := len(sys.sel.stagelist)
+	e.stageRefs[def] = sn
+	return sn, nil
+}
+
+var envMotifFight = regexp.MustCompile(`(?mi)^\s*fight\s*=\s*(.+?\.def)`)
+
+// The lifebar of the motif, looked for the way main.lua does
+func (e *envEngine) motifLifebar() (string, error) {
+	str, err := LoadText(e.motif)
+	if err != nil {
+		return "", err
+	}
+	m := envMotifFight.FindStringSubmatch(str)
+	if m == nil {
+		return "", Error("No lifebar in " + e.motif)
+	}
+	dir := e.motif[:strings.LastIndexAny(e.motif, "/\\")+1]
+	for _, f := range []string{m[1], dir + m[1], "data/" + m[1]} {
+		if fileExists(f) {
+			return f, nil
+		}
+	}
+	return "", Error("Lifebar not found: " + m[1])
+}
+
+// Sets up the match of cfg and waits for it to load
+func (e *envEngine) Start(cfg env.EnvConfig, input func(i int) env.Keys) (err error) {
+	if len(cfg.Chars) < 2 || len(cfg.Chars) > MaxSimul*2 {
+		return Error(fmt.Sprintf("Between 2 and %v characters are needed", MaxSimul*2))
+	}
+	if cfg.Lifebar == "" {
+		if cfg.Lifebar, err = e.motifLifebar(); err != nil {
+			return
+		}
+	}
+	if cfg.Lifebar != e.lifebar {
+		lb, err := loadLifebar(cfg.Lifebar)
+		if err != nil {
+			return err
+		}
+		sys.lifebar, e.lifebar = *lb, cfg.Lifebar
+	}
+	sys.sel.ClearSelected()
+	for tn := 0; tn < 2; tn++ {
+		nt := int32((len(cfg.Chars) + 1 - tn) / 2)
+		sys.tmode[tn], sys.numSimul[tn], sys.numTurns[tn] = TM_Single, nt, nt
+		if nt > 1 {
+			sys.tmode[tn] = TM_Simul
+		}
+		sys.lifebar.ro.match_wins[tn] = cfg.Rounds
+	}
+	for i := range sys.com {
+		sys.com[i], sys.aiController[i] = 0, nil
+	}
+	for i, def := range cfg.Chars {
+		cn, err := e.charRef(def)
+		if err != nil {
+			return err
+		}
+		pal := 1
+		if i < len(cfg.Pals) && cfg.Pals[i] > 0 {
+			pal = cfg.Pals[i]
+		}
+		sys.sel.AddSelectedChar(i&1, cn, pal)
+		sys.com[i] = cfg.Level
+		if cfg.Bot != "" {
+			f, ok := aiControllers[cfg.Bot]
+			if !ok {
+				return Error("Unknown AI controller: " + cfg.Bot)
+			}
+			sys.aiController[i] = f(i)
+		}
+	}
+	sn, err := e.stageRef(cfg.Stage)
+	if err != nil {
+		return err
+	}
+	sys.sel.SelectStage(sn)
+	for i, p := range cfg.Players {
+		sys.aiController[p-1] = &envController{input: input, index: i}
+	}
+	sys.roundTime = -1
+	if cfg.Time > 0 {
+		sys.roundTime = cfg.Time * sys.lifebar.ti.framespercount
+	}
+	sys.match = 1
+	sys.commonLua = nil
+	sys.loadStart()
+	for sys.loader.state != LS_Complete {
+		if sys.loader.state == LS_Error {
+			return sys.loader.err
+		}
+		sys.await(FPS)
+	}
+	// The loader runs on a thread of its own, so the seed is only set once
+	// it is done with it
+	Srand(cfg.Seed)
+	return nil
+}
+
+// Plays the match with the game function of the Lua scripts
+func (e *envEngine) Play() (int32, error) {
+	l := sys.luaLState
+	top := l.GetTop()
+	defer l.SetTop(top)
+	if err := l.CallByParam(lua.P{Fn: l.GetGlobal("game"), NRet: 1,
+		Protect: true}); err != nil {
+		return -1, err
+	}
+	return int32(lua.LVAsNumber(l.Get(-1))), nil
+}
+
+func (e *envEngine) EndMatch() {
+	sys.endMatch = true
+}
+
+func (e *envEngine) Observe(pns []int) (views []*AiView, life, wins [2]int32) {
+	for i, p := range sys.chars {
+		if len(p) > 0 && p[0].teamside != -1 {
+			life[i&1] += Max(0, p[0].life)
+		}
+	}
+	for _, pn := range pns {
+		views = append(views, newAiView(pn))
+	}
+	return views, life, sys.wins
+}
+
+// A request of serveEnv, holding either the match to reset to or the inputs
+// of a step, each being env.Keys or a string of keys as read by
+// env.ParseKeys
+type envRequest struct {
+	Reset *env.EnvConfig `json:"reset"`
+	Step  *struct {
+		Inputs []json.RawMessage `json:"inputs"`
+		Frames int               `json:"frames"`
+	} `json:"step"`
+}
+
+// Serves an Env to the program connecting to addr, which sends requests as
+// lines of JSON and is answered with an EnvStep for each of them
+func serveEnv(addr, motif string) error {
+	conn, err := acceptLocal(addr)
+	if err != nil {
+		return err
+	}
+	e := env.NewEnv(newEnvEngine(motif))
+	go func() {
+		defer e.Close()
+		defer conn.Close()
+		r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+		var last *env.EnvStep
+		for {
+			line, err := r.ReadBytes('\n')
+			if err != nil {
+				if err != io.EOF {
+					sys.errLog.Println(err.Error())
+				}
+				return
+			}
+			var req envRequest
+			var st *env.EnvStep
+			switch err = json.Unmarshal(line, &req); {
+			case err != nil:
+				st = &env.EnvStep{Error: err.Error()}
+			case req.Reset != nil:
+				st, _ = e.Reset(*req.Reset)
+			case req.Step != nil:
+				inputs := make([]env.Keys, len(req.Step.Inputs))
+				for i, raw := range req.Step.Inputs {
+					var keys string
+					if json.Unmarshal(raw, &keys) == nil {
+						if last != nil && i < len(last.Obs) && last.Obs[i] != nil {
+							inputs[i] = env.ParseKeys(keys, last.Obs[i].Self.Facing)
+						} else {
+							inputs[i] = env.ParseKeys(keys, 1)
+						}
+					} else {
+						json.Unmarshal(raw, &inputs[i])
+					}
+				}
+				st, _ = e.Step(inputs, req.Step.Frames)
+			default:
+				st = &env.EnvStep{Error: "reset or step expected"}
+			}
+			if st.Error == "" {
+				last = st
+			}
+			b, _ := json.Marshal(st)
+			w.Write(append(b, '\n'))
+			if err = w.Flush(); err != nil {
+				sys.errLog.Println(err.Error())
+				return
+			}
+		}
+	}()
+	return e.Run()
+}
@@ -0,0 +1,388 @@
+// Package env runs the matches of the engine for training agents, one step
+// of frames at a time. The engine plays the matches through the Engine
+// interface, and agents drive players with Reset and Step, either from Go by
+// importing this package or through the lines of JSON that the engine
+// serves when it is started with -env.
+package env
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Keys are the keys held by a player, one bit each, with left and right as
+// seen on the screen. They are laid out like the InputBits of the engine.
+type Keys int32
+
+const (
+	KeyUp Keys = 1 << iota
+	KeyDown
+	KeyLeft
+	KeyRight
+	KeyA
+	KeyB
+	KeyC
+	KeyX
+	KeyY
+	KeyZ
+	KeyS
+	KeyD
+	KeyW
+	KeyM
+)
+
+// ParseKeys returns the keys named in s, separated by spaces, commas or
+// plus signs, where B and F are taken as back and forward of a player
+// facing the given way
+func ParseKeys(s string, facing float32) (k Keys) {
+	for _, name := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ' ' || r == ',' || r == '+'
+	}) {
+		switch name {
+		case "U":
+			k |= KeyUp
+		case "D":
+			k |= KeyDown
+		case "L":
+			k |= KeyLeft
+		case "R":
+			k |= KeyRight
+		case "B":
+			if facing < 0 {
+				k |= KeyRight
+			} else {
+				k |= KeyLeft
+			}
+		case "F":
+			if facing < 0 {
+				k |= KeyLeft
+			} else {
+				k |= KeyRight
+			}
+		case "a":
+			k |= KeyA
+		case "b":
+			k |= KeyB
+		case "c":
+			k |= KeyC
+		case "x":
+			k |= KeyX
+		case "y":
+			k |= KeyY
+		case "z":
+			k |= KeyZ
+		case "s":
+			k |= KeyS
+		case "d":
+			k |= KeyD
+		case "w":
+			k |= KeyW
+		case "m":
+			k |= KeyM
+		}
+	}
+	return
+}
+
+// AiView is a copy of the state of the match as seen by player Player, so
+// that it can not be changed by writing to it. Distances are measured from
+// the player towards the way it faces, like P2DistX.
+type AiView struct {
+	Player     int          `json:"player"`
+	Level      float32      `json:"level"`
+	GameTime   int32        `json:"gametime"`
+	Round      int32        `json:"round"`
+	RoundState int32        `json:"roundstate"`
+	Self       AiCharView   `json:"self"`
+	P2         *AiCharView  `json:"p2"`
+	Enemies    []AiCharView `json:"enemies"`
+	Partners   []AiCharView `json:"partners"`
+}
+
+type AiCharView struct {
+	Player    int        `json:"player"`
+	Name      string     `json:"name"`
+	Pos       [2]float32 `json:"pos"`
+	Vel       [2]float32 `json:"vel"`
+	Facing    float32    `json:"facing"`
+	DistX     float32    `json:"distx"`
+	DistY     float32    `json:"disty"`
+	StateNo   int32      `json:"stateno"`
+	StateType string     `json:"statetype"`
+	MoveType  string     `json:"movetype"`
+	Anim      int32      `json:"anim"`
+	AnimTime  int32      `json:"animtime"`
+	Ctrl      bool       `json:"ctrl"`
+	Alive     bool       `json:"alive"`
+	HitPause  bool       `json:"hitpause"`
+	Life      int32      `json:"life"`
+	LifeMax   int32      `json:"lifemax"`
+	Power     int32      `json:"power"`
+	PowerMax  int32      `json:"powermax"`
+}
+
+// EnvConfig describes the match started by Reset. Chars are the defs of the
+// players in order, so odd players are on team 1 and even ones on team 2.
+// Players are the player numbers driven by Step, and the others are played
+// by the AI of the given level, or by the named Go AI controller.
+type EnvConfig struct {
+	Chars   []string `json:"chars"`
+	Pals    []int    `json:"pals"`
+	Stage   string   `json:"stage"`
+	Lifebar string   `json:"lifebar"`
+	Seed    int32    `json:"seed"`
+	Rounds  int32    `json:"rounds"`
+	Time    int32    `json:"time"`
+	Players []int    `json:"players"`
+	Level   float32  `json:"level"`
+	Bot     string   `json:"bot"`
+}
+
+// EnvStep is what the players in EnvConfig.Players, in the same order, see
+// after a step. The reward of a player is the life taken from the other
+// team less the life it lost, in units of its own maximum life, plus 1 for
+// a round won and -1 for a round lost.
+type EnvStep struct {
+	Obs     []*AiView `json:"obs"`
+	Rewards []float32 `json:"rewards"`
+	Info    []EnvInfo `json:"info"`
+	Done    bool      `json:"done"`
+	WinTeam int32     `json:"winteam"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type EnvInfo struct {
+	DamageDealt int32 `json:"damagedealt"`
+	DamageTaken int32 `json:"damagetaken"`
+	RoundWon    bool  `json:"roundwon"`
+	RoundLost   bool  `json:"roundlost"`
+}
+
+// Engine plays the matches of an Env. Its methods are called from the
+// thread that calls Env.Run.
+type Engine interface {
+	// Loads the match of cfg, where player cfg.Players[i] is given the keys
+	// returned by input(i) on every frame of the match
+	Start(cfg EnvConfig, input func(i int) Keys) error
+	// Plays the loaded match, and returns the winning team, 0 on a draw or
+	// -1 if the match was quit
+	Play() (int32, error)
+	// Ends the match being played
+	EndMatch()
+	// What the players numbered pns see, with the life of each team and the
+	// rounds won by each team
+	Observe(pns []int) (views []*AiView, life, wins [2]int32)
+}
+
+// Env runs the matches of an Engine for training agents. Run plays the
+// matches and must be called on the thread the engine runs on, while Reset,
+// Step and Close are called from a single goroutine of the agent. The
+// players driven by Step get no input while the match is not under control,
+// such as during intros, so every step starts at a frame where their input
+// matters.
+type Env struct {
+	engine  Engine
+	cmd     chan envCmd
+	out     chan *EnvStep
+	players []int
+	lead    int
+	keys    []Keys
+	hold    int
+	next    *EnvConfig
+	closed  bool
+	first   bool
+	life    [2]int32
+	wins    [2]int32
+	winp    int32
+}
+
+type envCmd struct {
+	reset  *EnvConfig
+	inputs []Keys
+	frames int
+	close  bool
+}
+
+func NewEnv(engine Engine) *Env {
+	return &Env{engine: engine, cmd: make(chan envCmd),
+		out: make(chan *EnvStep)}
+}
+
+// Starts a new match, ending the one being played if any, and returns what
+// is seen on its first frame under control
+func (e *Env) Reset(cfg EnvConfig) (*EnvStep, error) {
+	e.cmd <- envCmd{reset: &cfg}
+	return e.result()
+}
+
+// Holds inputs, one for each of the players in EnvConfig.Players, for the
+// given number of frames
+func (e *Env) Step(inputs []Keys, frames int) (*EnvStep, error) {
+	e.cmd <- envCmd{inputs: inputs, frames: frames}
+	return e.result()
+}
+
+// Ends the match being played, and makes Run return
+func (e *Env) Close() {
+	e.cmd <- envCmd{close: true}
+}
+func (e *Env) result() (*EnvStep, error) {
+	st := <-e.out
+	if st.Error != "" {
+		return st, errors.New(st.Error)
+	}
+	return st, nil
+}
+
+// The keys of the i-th player of EnvConfig.Players. The one with the lowest
+// player number, whose input the engine reads before the others, waits for
+// the agent on the first frame of a step.
+func (e *Env) input(i int) Keys {
+	if i == e.lead {
+		if e.hold > 0 {
+			e.hold--
+		} else {
+			e.sync()
+		}
+	}
+	return e.keys[i]
+}
+
+// Waits for the input of the agent
+func (e *Env) sync() {
+	e.out <- e.observe(false)
+	cmd := <-e.cmd
+	switch {
+	case cmd.close:
+		e.closed = true
+	case cmd.reset != nil:
+		e.next = cmd.reset
+	default:
+		for i := range e.keys {
+			e.keys[i] = 0
+			if i < len(cmd.inputs) {
+				e.keys[i] = cmd.inputs[i]
+			}
+		}
+		e.hold = cmd.frames - 1
+		if e.hold < 0 {
+			e.hold = 0
+		}
+		return
+	}
+	for i := range e.keys {
+		e.keys[i] = 0
+	}
+	e.engine.EndMatch()
+}
+
+// Plays the matches asked for until Close is called
+func (e *Env) Run() error {
+	for {
+		var cmd envCmd
+		if e.next != nil {
+			cmd.reset, e.next = e.next, nil
+		} else {
+			cmd = <-e.cmd
+		}
+		switch {
+		case cmd.close:
+			return nil
+		case cmd.reset == nil:
+			e.out <- &EnvStep{Error: "no match is being played"}
+			continue
+		}
+		if err := e.start(*cmd.reset); err != nil {
+			e.out <- &EnvStep{Error: err.Error()}
+			continue
+		}
+		winp, err := e.engine.Play()
+		if e.closed {
+			return err
+		}
+		if e.next != nil {
+			continue
+		}
+		if err != nil {
+			e.out <- &EnvStep{Error: err.Error()}
+			continue
+		}
+		e.winp = winp
+		e.out <- e.observe(true)
+	}
+}
+
+// Fills in the defaults of cfg and has the engine load its match
+func (e *Env) start(cfg EnvConfig) error {
+	if cfg.Rounds <= 0 {
+		cfg.Rounds = 2
+	}
+	if cfg.Time == 0 {
+		cfg.Time = 99
+	}
+	if cfg.Level <= 0 {
+		cfg.Level = 4
+	}
+	e.players = e.players[:0]
+	for _, p := range cfg.Players {
+		if p < 1 || p > len(cfg.Chars) {
+			return fmt.Errorf("Invalid player number: %v", p)
+		}
+		for _, pn := range e.players {
+			if pn == p-1 {
+				return fmt.Errorf("Player %v is given twice", p)
+			}
+		}
+		e.players = append(e.players, p-1)
+	}
+	e.keys, e.hold, e.first = make([]Keys, len(e.players)), 0, true
+	e.lead = 0
+	for i, pn := range e.players {
+		if pn < e.players[e.lead] {
+			e.lead = i
+		}
+	}
+	return e.engine.Start(cfg, e.input)
+}
+
+// Sums up what each player has gained and lost since the last step
+func (e *Env) observe(done bool) *EnvStep {
+	views, life, wins := e.engine.Observe(e.players)
+	if e.first {
+		e.life, e.wins, e.first = life, wins, false
+	}
+	st := &EnvStep{Done: done, Obs: views}
+	if done {
+		st.WinTeam = e.winp
+	}
+	for i, pn := range e.players {
+		team := pn & 1
+		in := EnvInfo{DamageDealt: max(0, e.life[team^1]-life[team^1]),
+			DamageTaken: max(0, e.life[team]-life[team]),
+			RoundWon:    wins[team] > e.wins[team],
+			RoundLost:   wins[team^1] > e.wins[team^1]}
+		lifeMax := float32(1000)
+		if i < len(views) && views[i] != nil && views[i].Self.LifeMax > 0 {
+			lifeMax = float32(views[i].Self.LifeMax)
+		}
+		st.Rewards = append(st.Rewards, float32(in.DamageDealt-in.DamageTaken)/lifeMax+
+			float32(btoi(in.RoundWon)-btoi(in.RoundLost)))
+		st.Info = append(st.Info, in)
+	}
+	e.life, e.wins = life, wins
+	return st
+}
+
+func max(a, b int32) int32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+func btoi(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
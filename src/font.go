@@ -337,6 +337,9 @@ func loadFntTtf(f *Fnt, fontfile string, filename string, height int32) {
 	} else {
 		f.Size[1] = uint16(height)
 	}
+	if sys.headless {
+		return
+	}
 	glfont.FontShaderVer = "#version " + sys.fontShaderVer
 	ttf, err := glfont.LoadFont(fileDir, height, int(sys.gameWidth), int(sys.gameHeight))
 	if err != nil {
@@ -416,7 +419,9 @@ func (f *Fnt) CharWidth(c rune) int32 {
 func (f *Fnt) TextWidth(txt string) (w int32) {
 	for _, c := range txt {
 		if f.Type == "truetype" {
-			w += int32(f.ttf.Width(1, string(c)))
+			if f.ttf != nil {
+				w += int32(f.ttf.Width(1, string(c)))
+			}
 		} else {
 			w += f.CharWidth(c) + f.Spacing[0]
 		}
@@ -557,7 +562,8 @@ func (f *Fnt) DrawText(txt string, x, y, xscl, yscl float32, bank, align int32,
 func (f *Fnt) DrawTtf(txt string, x, y, xscl, yscl float32, align int32,
 	blend bool, window *[4]int32, frgba [4]float32) {
 
-	if len(txt) == 0 {
+	// No font is loaded in headless mode
+	if len(txt) == 0 || sys.headless {
 		return
 	}
 
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// FrameData is the startup, active and recovery frames of a move, and how
+// many frames earlier than the opponent its attacker could act again after
+// it hit or was guarded. Frames spent in hitpause are not counted.
+type FrameData struct {
+	State     int32
+	Startup   int32
+	Active    int32
+	Recovery  int32
+	Contact   string
+	Advantage int32
+}
+
+// FrameDataTracker follows the moves of a player in training mode. A move
+// starts whenever the player goes into an attack state, is active while the
+// frame of its animation has Clsn1 boxes and it can attack, and ends when
+// the player gets control back. After a contact it also waits for the
+// opponent to get control back, to know the advantage.
+type FrameDataTracker struct {
+	last       FrameData
+	cur        FrameData
+	tracking   bool
+	frame      int32
+	firstAct   int32
+	lastAct    int32
+	done       bool
+	target     *Char
+	atkFrames  int32
+	defFrames  int32
+	targetDone bool
+	wasAttack  bool
+}
+
+func (c *Char) frameDataActive() bool {
+	return c.curFrame != nil && len(c.curFrame.Clsn1()) > 0 && c.atktmp != 0
+}
+
+// Updates the tracker with the frame c has just played
+func (ft *FrameDataTracker) update(c *Char) {
+	attack := c.ss.moveType == MT_A
+	// Going into another attack state starts a new move, so that cancels
+	// are told apart from the move they cancel
+	if attack && (!ft.wasAttack && !ft.tracking || c.ss.no != ft.cur.State) {
+		*ft = FrameDataTracker{last: ft.last, tracking: true,
+			cur: FrameData{State: c.ss.no}, firstAct: -1, lastAct: -1}
+	}
+	ft.wasAttack = attack
+	if !ft.tracking {
+		return
+	}
+	if c.ss.moveType == MT_H || ft.frame > 600 {
+		// Interrupted, or never getting control back
+		ft.tracking = false
+		return
+	}
+	if !ft.done && !c.hitPause() {
+		if c.ctrl() && ft.frame > 0 {
+			ft.done = true
+		} else {
+			ft.frame++
+			if c.frameDataActive() {
+				if ft.firstAct < 0 {
+					ft.firstAct = ft.frame
+				}
+				ft.lastAct = ft.frame
+			}
+		}
+	}
+	if ft.cur.Contact == "" && (c.moveHit() == 1 || c.moveGuarded() == 1) {
+		ft.cur.Contact = "hit"
+		if c.mctype == MC_Guarded {
+			ft.cur.Contact = "block"
+		}
+		if ft.target = c.p2(); ft.target == nil {
+			ft.targetDone = true
+		}
+	}
+	if ft.target != nil && !ft.targetDone {
+		if !ft.done && !c.hitPause() {
+			ft.atkFrames++
+		}
+		if ft.target.ctrl() || ft.target.scf(SCF_ko) {
+			ft.targetDone = true
+		} else if !ft.target.hitPause() {
+			ft.defFrames++
+		}
+	}
+	if ft.done && (ft.target == nil || ft.targetDone) {
+		if ft.firstAct > 0 {
+			ft.cur.Startup = ft.firstAct
+			ft.cur.Active = ft.lastAct - ft.firstAct + 1
+			ft.cur.Recovery = ft.frame - ft.lastAct
+			if ft.target != nil && !ft.target.scf(SCF_ko) {
+				ft.cur.Advantage = ft.defFrames - ft.atkFrames
+			}
+			ft.last = ft.cur
+		}
+		ft.tracking = false
+	}
+}
+
+func (fd *FrameData) String() string {
+	if fd.State == 0 && fd.Startup == 0 {
+		return ""
+	}
+	s := fmt.Sprintf("State %v: startup %v, active %v, recovery %v", fd.State,
+		fd.Startup, fd.Active, fd.Recovery)
+	if fd.Contact != "" {
+		s += fmt.Sprintf(", %+d on %v", fd.Advantage, fd.Contact)
+	}
+	return s
+}
+
+// Reads the parameters of a state controller, those without a constant
+// value being set to nil
+func constParams(scb StateControllerBase) map[byte][]BytecodeValue {
+	params := make(map[byte][]BytecodeValue)
+	scb.run(nil, func(id byte, exp []BytecodeExp) bool {
+		var vs []BytecodeValue
+		for _, be := range exp {
+			v, ok := constValue(be)
+			if !ok {
+				params[id] = nil
+				return true
+			}
+			vs = append(vs, v)
+		}
+		params[id] = vs
+		return true
+	})
+	return params
+}
+
+// Calls f with the controllers of a block and of the blocks in it, in order
+func blockCtrls(b *StateBlock, f func(sc StateController)) {
+	for _, sc := range b.ctrls {
+		f(sc)
+		if sb, ok := sc.(StateBlock); ok {
+			blockCtrls(&sb, f)
+			if sb.elseBlock != nil {
+				blockCtrls(sb.elseBlock, f)
+			}
+		}
+	}
+}
+
+// The first HitDef of a state, looking into its blocks
+func firstHitDef(b *StateBlock) (hd hitDef, ok bool) {
+	blockCtrls(b, func(sc StateController) {
+		if h, isHitDef := sc.(hitDef); isHitDef && !ok {
+			hd, ok = h, true
+		}
+	})
+	return
+}
+
+// The animations played by the move starting in state no until control is
+// given back. Each state is taken to last until its animation ends, and to
+// then go to the state of its last ChangeState. Control is given back by a
+// constant ctrl of that ChangeState or of the StateDef of the next state, by
+// a CtrlSet with a constant value in the state, or by going back to a common
+// state below 200. A state without any ChangeState ends the move. Returns
+// false if the animations can not be known without playing the move.
+func frameDataMove(states map[int32]StateBytecode, at AnimationTable,
+	no int32) (anims []*Animation, ok bool) {
+	var anim int32
+	animSet := false
+	visited := make(map[int32]bool)
+	for first := true; ; first = false {
+		sb, found := states[no]
+		if !found || visited[no] {
+			return nil, false
+		}
+		visited[no] = true
+		sd := constParams(StateControllerBase(sb.stateDef))
+		if v, set := sd[stateDef_ctrl]; set && !first {
+			if len(v) == 0 {
+				return nil, false
+			}
+			if v[0].ToB() {
+				return anims, true
+			}
+		}
+		if v, set := sd[stateDef_anim]; set && !animSet {
+			if len(v) < 2 {
+				return nil, false
+			}
+			anim, animSet = v[1].ToI(), true
+		}
+		// Without any, the animation of the previous state would go on
+		if !animSet || at[anim] == nil {
+			return nil, false
+		}
+		anims = append(anims, at[anim])
+		var last *changeState
+		ctrl := false
+		blockCtrls(&sb.block, func(sc StateController) {
+			switch sc := sc.(type) {
+			case changeState:
+				last = &sc
+			case ctrlSet:
+				v := constParams(StateControllerBase(sc))[ctrlSet_value]
+				ctrl = ctrl || len(v) > 0 && v[0].ToB()
+			}
+		})
+		if ctrl || last == nil {
+			return anims, true
+		}
+		cp := constParams(StateControllerBase(*last))
+		v := cp[changeState_value]
+		if len(v) == 0 {
+			return nil, false
+		}
+		if c, set := cp[changeState_ctrl]; set {
+			if len(c) == 0 {
+				return nil, false
+			}
+			if c[0].ToB() {
+				return anims, true
+			}
+		}
+		if no = v[0].ToI(); no < 200 {
+			return anims, true
+		}
+		animSet = false
+		if a, set := cp[changeState_anim]; set {
+			if len(a) < 2 {
+				return nil, false
+			}
+			anim, animSet = a[1].ToI(), true
+		}
+	}
+}
+
+// Prints the frame data of every attack state of a character, read from the
+// animations of the states it goes through until control is given back, as
+// followed by frameDataMove, and from its first HitDef. The triggers of the
+// controllers are not evaluated, so the dump is only a guess for moves that
+// change state or give control back before their animation ends, cancel
+// into other moves, or pick a state or animation at run time, which are
+// skipped. The move is taken to make contact on its first active frame.
+func frameDataChar(def string, w io.Writer) int {
+	if !strings.HasSuffix(strings.ToLower(def), ".def") {
+		def = filepath.Join("chars", def, filepath.Base(def)+".def")
+	}
+	sys.chars[0] = []*Char{newChar(0, 0)}
+	states, err := newCompiler().Compile(0, def)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+	str, err := LoadText(def)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+	var anim string
+	lines, i := SplitAndTrim(str, "\n"), 0
+	for i < len(lines) {
+		is, name, _ := ReadIniSection(lines, &i)
+		if name == "files" {
+			anim = is["anim"]
+			break
+		}
+	}
+	var at AnimationTable
+	if err := LoadFile(&anim, def, func(filename string) error {
+		str, err := LoadText(filename)
+		if err != nil {
+			return err
+		}
+		lines, i := SplitAndTrim(str+sys.commonAir, "\n"), 0
+		at = ReadAnimationTable(nil, lines, &i)
+		return nil
+	}); err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+	nos := make([]int, 0, len(states))
+	for no, sb := range states {
+		if sb.moveType == MT_A {
+			nos = append(nos, int(no))
+		}
+	}
+	sort.Ints(nos)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "State\tAnim\tStartup\tActive\tRecovery\tTotal\tOn hit\tOn block")
+	for _, no := range nos {
+		sb := states[int32(no)]
+		anims, ok := frameDataMove(states, at, int32(no))
+		if !ok {
+			fmt.Fprintf(tw, "%v\t?\n", no)
+			continue
+		}
+		var total, firstAct, lastAct int32 = 0, -1, -1
+		for _, a := range anims {
+			for _, f := range a.frames {
+				if f.Time < 0 {
+					total = -1
+					break
+				}
+				if len(f.Clsn1()) > 0 {
+					if firstAct < 0 {
+						firstAct = total + 1
+					}
+					lastAct = total + f.Time
+				}
+				total += f.Time
+			}
+			if total < 0 {
+				break
+			}
+		}
+		p := constParams(StateControllerBase(sb.stateDef))[stateDef_anim]
+		row := []interface{}{no, p[1].ToI(), "-", "-", "-", "-", "-", "-"}
+		if total >= 0 {
+			row[5] = total
+		}
+		if firstAct > 0 {
+			row[2], row[3] = firstAct, lastAct-firstAct+1
+			if total >= 0 {
+				row[4] = total - lastAct
+			}
+		}
+		if hd, ok := firstHitDef(&sb.block); ok && firstAct > 0 && total >= 0 {
+			hp := constParams(StateControllerBase(hd))
+			// The opponent is in hitstun for hittime frames after the contact,
+			// while the attacker plays the rest of the move
+			rest := total - firstAct
+			if v := hp[hitDef_ground_hittime]; len(v) > 0 {
+				row[6] = fmt.Sprintf("%+d", v[0].ToI()-rest)
+				row[7] = row[6]
+			}
+			if v := hp[hitDef_guard_hittime]; len(v) > 0 {
+				row[7] = fmt.Sprintf("%+d", v[0].ToI()-rest)
+			}
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", row...)
+	}
+	tw.Flush()
+	return 0
+}
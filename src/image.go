@@ -531,6 +531,10 @@ func (s *Sprite) SetPxl(px []byte) {
 	if int64(len(px)) != int64(s.Size[0])*int64(s.Size[1]) {
 		return
 	}
+	// Without a GL context sprites are kept texture-less and never drawn
+	if sys.headless {
+		return
+	}
 	sys.mainThreadTask <- func() {
 		gl.Enable(gl.TEXTURE_2D)
 		s.Tex = newTexture()
@@ -934,6 +938,9 @@ func (s *Sprite) readV2(f *os.File, offset int64, datasize uint32) error {
 				rgba = image.NewRGBA(rect)
 				draw.Draw(rgba, rect, img, rect.Min, draw.Src)
 			}
+			if sys.headless {
+				return nil
+			}
 			// TODO: Check why ths channel operation uses too much memory.
 			sys.mainThreadTask <- func() {
 				gl.Enable(gl.TEXTURE_2D)
@@ -1357,6 +1364,9 @@ func (s *Sff) getOwnPalSprite(g, n int16) *Sprite {
 	return &osp
 }
 func captureScreen() {
+	if sys.headless {
+		return
+	}
 	width, height := sys.window.Window.GetSize()
 	pixdata := make([]uint8, 4*width*height)
 	img := image.NewNRGBA(image.Rect(0, 0, width, height))
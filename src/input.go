@@ -2,9 +2,14 @@ package main
 
 import (
 	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-gl/glfw/v3.3/glfw"
@@ -608,6 +613,9 @@ func keyCallback(_ *glfw.Window, key glfw.Key, _ int,
 		if key == glfw.KeyF12 {
 			captureScreen()
 		}
+		if sys.fileInput != nil {
+			sys.fileInput.viewerKey(key)
+		}
 		if key == glfw.KeyEnter && mk&(glfw.ModAlt) != 0 {
 			sys.window.toggleFullscreen()
 		}
@@ -628,7 +636,7 @@ func JoystickState(joy, button int) bool {
 	if joy < 0 {
 		return sys.keyState[glfw.Key(button)]
 	}
-	if joy >= len(joystick) {
+	if joy >= len(joystick) || sys.headless {
 		return false
 	}
 	btns := joystick[joy].GetButtons()
@@ -732,6 +740,30 @@ func (ib InputBits) GetInput(cb *CommandBuffer, facing int32) {
 		ib&IB_D != 0, ib&IB_W != 0, ib&IB_M != 0)
 }
 
+// Same as SetInput, but reads the devices the way local matches do, with the
+// keyboard only used when it has no joystick assigned
+func (ib *InputBits) SetLocalInput(in int) {
+	key := 0 <= in && in < len(sys.keyConfig) && sys.keyConfig[in].Joy == -1
+	joy := 0 <= in && in < len(sys.joystickConfig) && sys.joystickConfig[in].Joy >= 0
+	btn := func(f func(KeyConfig) bool) bool {
+		return key && f(sys.keyConfig[in]) || joy && f(sys.joystickConfig[in])
+	}
+	*ib = InputBits(Btoi(btn(KeyConfig.U)) |
+		Btoi(btn(KeyConfig.D))<<1 |
+		Btoi(btn(KeyConfig.L))<<2 |
+		Btoi(btn(KeyConfig.R))<<3 |
+		Btoi(btn(KeyConfig.a))<<4 |
+		Btoi(btn(KeyConfig.b))<<5 |
+		Btoi(btn(KeyConfig.c))<<6 |
+		Btoi(btn(KeyConfig.x))<<7 |
+		Btoi(btn(KeyConfig.y))<<8 |
+		Btoi(btn(KeyConfig.z))<<9 |
+		Btoi(btn(KeyConfig.s))<<10 |
+		Btoi(btn(KeyConfig.d))<<11 |
+		Btoi(btn(KeyConfig.w))<<12 |
+		Btoi(btn(KeyConfig.m))<<13)
+}
+
 type CommandKeyRemap struct {
 	a, b, c, x, y, z, s, d, w, m, na, nb, nc, nx, ny, nz, ns, nd, nw, nm CommandKey
 }
@@ -1032,18 +1064,23 @@ func (__ *CommandBuffer) LastChangeTime() int32 {
 }
 
 type NetBuffer struct {
-	buf              [32]InputBits
-	curT, inpT, senT int32
+	buf                    [32]InputBits
+	curT, inpT, senT, ackT int32
 }
 
 func (nb *NetBuffer) reset(time int32) {
-	nb.curT, nb.inpT, nb.senT = time, time, time
+	nb.curT, nb.inpT, nb.senT, nb.ackT = time, time, time, time
 }
-func (nb *NetBuffer) localUpdate(in int) {
-	if nb.inpT-nb.curT < 32 {
+
+// Frames the other side has not acknowledged are kept to be sent again, so
+// they cannot be overwritten either
+func (nb *NetBuffer) localUpdate(in int) bool {
+	if nb.inpT-nb.curT < 32 && nb.inpT-nb.ackT < 32 {
 		nb.buf[nb.inpT&31].SetInput(in)
 		nb.inpT++
+		return true
 	}
+	return false
 }
 func (nb *NetBuffer) input(cb *CommandBuffer, f int32) {
 	if nb.curT < nb.inpT {
@@ -1052,8 +1089,7 @@ func (nb *NetBuffer) input(cb *CommandBuffer, f int32) {
 }
 
 type NetInput struct {
-	ln         *net.TCPListener
-	conn       *net.TCPConn
+	conn       *NetConn
 	st         NetState
 	sendEnd    chan bool
 	recvEnd    chan bool
@@ -1064,7 +1100,52 @@ type NetInput struct {
 	stoppedcnt int32
 	delay      int32
 	rep        *os.File
+	spec       *NetSpectators
 	host       bool
+	rb         *NetRollback
+	check      *NetCheck
+	checkMu    sync.Mutex
+	checks     []netCheckMsg
+	err        error
+}
+
+// NetRollback lets a match run ahead of the remote input by predicting it.
+// When the real input arrives and differs from the prediction, the state of
+// the mispredicted frame is loaded and the frames since then are simulated
+// again.
+type NetRollback struct {
+	frames  int32
+	cur     int32
+	verT    int32
+	pred    [32]InputBits
+	resim   bool
+	save    func(t int32)
+	load    func(t int32)
+	advance func()
+}
+
+// NetCheck sends a checksum of the game state to the other side every
+// netCheckInterval frames during a match, so that a desync ends it with an
+// error instead of both players watching different fights.
+type NetCheck struct {
+	start  int32
+	conf   int32
+	local  map[int32][]int32
+	remote map[int32]int32
+	dumps  map[int32][]int32
+}
+
+const netCheckInterval = 60
+
+// Messages on the reliable stream besides the -1 that ends a session
+const (
+	netMsgChecksum int32 = -2 // frame, checksum
+	netMsgDump     int32 = -3 // frame, count, values
+)
+
+type netCheckMsg struct {
+	kind, t int32
+	vals    []int32
 }
 
 func NewNetInput() *NetInput {
@@ -1075,13 +1156,13 @@ func NewNetInput() *NetInput {
 	return ni
 }
 func (ni *NetInput) Close() {
-	if ni.ln != nil {
-		ni.ln.Close()
-		ni.ln = nil
-	}
 	if ni.conn != nil {
 		ni.conn.Close()
 	}
+	if ni.spec != nil {
+		ni.spec.Close()
+		ni.spec = nil
+	}
 	if ni.sendEnd != nil {
 		<-ni.sendEnd
 		close(ni.sendEnd)
@@ -1114,19 +1195,18 @@ func (ni *NetInput) GetHostGuestRemap() (host, guest int) {
 	return
 }
 func (ni *NetInput) Accept(port string) error {
-	if ln, err := net.Listen("tcp", ":"+port); err != nil {
+	if nc, err := ListenNetConn(port); err != nil {
 		return err
 	} else {
-		ni.ln = ln.(*net.TCPListener)
+		ni.conn = nc
 		ni.host = true
 		ni.locIn, ni.remIn = ni.GetHostGuestRemap()
-		go func() {
-			ln := ni.ln
-			if conn, err := ln.AcceptTCP(); err == nil {
-				ni.conn = conn
-			}
-			ln.Close()
-		}()
+		// Spectators are optional, the match goes on without them
+		if ns, err := ListenNetSpectators(port, sys.spectatorDelay); err != nil {
+			sys.errLog.Println(err.Error())
+		} else {
+			ni.spec = ns
+		}
 	}
 	return nil
 }
@@ -1134,17 +1214,31 @@ func (ni *NetInput) Connect(server, port string) {
 	ni.host = false
 	ni.remIn, ni.locIn = ni.GetHostGuestRemap()
 	go func() {
-		if conn, err := net.Dial("tcp", server+":"+port); err == nil {
-			ni.conn = conn.(*net.TCPConn)
+		if nc, err := DialNetConn(server, port); err == nil {
+			ni.conn = nc
 		}
 	}()
 }
 func (ni *NetInput) IsConnected() bool {
-	return ni != nil && ni.conn != nil
+	return ni != nil && ni.conn != nil && ni.conn.Connected()
+}
+
+// Round trip time to the other player
+func (ni *NetInput) RTT() time.Duration {
+	if !ni.IsConnected() {
+		return 0
+	}
+	return ni.conn.RTT()
 }
 func (ni *NetInput) Input(cb *CommandBuffer, i int, facing int32) {
 	if i >= 0 && i < len(ni.buf) {
-		ni.buf[sys.inputRemap[i]].input(cb, facing)
+		if in := sys.inputRemap[i]; ni.rb != nil && in == ni.locIn {
+			ni.buf[in].buf[ni.rb.cur&31].GetInput(cb, facing)
+		} else if ni.rb != nil && in == ni.remIn {
+			ni.rb.pred[ni.rb.cur&31].GetInput(cb, facing)
+		} else {
+			ni.buf[in].input(cb, facing)
+		}
 	}
 }
 func (ni *NetInput) AnyButton() bool {
@@ -1174,99 +1268,137 @@ func (ni *NetInput) end() {
 	}
 	ni.Close()
 }
-func (ni *NetInput) readI32() (int32, error) {
-	b := [4]byte{}
-	if _, err := ni.conn.Read(b[:]); err != nil {
-		return 0, err
-	}
-	return int32(b[0]) | int32(b[1])<<8 | int32(b[2])<<16 | int32(b[3])<<24, nil
-}
-func (ni *NetInput) writeI32(i32 int32) error {
-	b := [...]byte{byte(i32), byte(i32 >> 8), byte(i32 >> 16), byte(i32 >> 24)}
-	if _, err := ni.conn.Write(b[:]); err != nil {
-		return err
+
+// Where the seed and confirmed inputs go: the replay file and the
+// spectators, or nil if neither is there
+func (ni *NetInput) recorder() io.Writer {
+	switch {
+	case ni.rep != nil && ni.spec != nil:
+		return io.MultiWriter(ni.rep, ni.spec)
+	case ni.rep != nil:
+		return ni.rep
+	case ni.spec != nil:
+		return ni.spec
 	}
 	return nil
 }
 func (ni *NetInput) Synchronize() error {
 	if !ni.IsConnected() || ni.st == NS_Error {
+		if ni.err != nil {
+			return ni.err
+		}
 		return Error("Can not connect to the other player")
 	}
 	ni.Stop()
 	var seed int32
 	if ni.host {
 		seed = Random()
-		if err := ni.writeI32(seed); err != nil {
+		if err := ni.conn.WriteI32(seed); err != nil {
 			return err
 		}
 	} else {
 		var err error
-		if seed, err = ni.readI32(); err != nil {
+		if seed, err = ni.conn.ReadI32(); err != nil {
 			return err
 		}
 	}
 	Srand(seed)
-	if ni.rep != nil {
-		binary.Write(ni.rep, binary.LittleEndian, &seed)
+	if ni.spec != nil {
+		ni.spec.StartMatch()
+	}
+	if w := ni.recorder(); w != nil {
+		writeReplayMatch(w)
+		binary.Write(w, binary.LittleEndian, &seed)
 	}
-	if err := ni.writeI32(ni.time); err != nil {
+	if err := ni.conn.WriteI32(ni.time); err != nil {
 		return err
 	}
-	if tmp, err := ni.readI32(); err != nil {
+	if tmp, err := ni.conn.ReadI32(); err != nil {
 		return err
 	} else if tmp != ni.time {
 		return Error("Synchronization error")
 	}
 	ni.buf[ni.locIn].reset(ni.time)
 	ni.buf[ni.remIn].reset(ni.time)
+	ni.conn.Start(&ni.buf[ni.locIn], &ni.buf[ni.remIn])
 	ni.st = NS_Playing
 	<-ni.sendEnd
 	go func(nb *NetBuffer) {
 		defer func() { ni.sendEnd <- true }()
 		for ni.st == NS_Playing {
 			if nb.senT < nb.inpT {
-				if err := ni.writeI32(int32(nb.buf[nb.senT&31])); err != nil {
+				if err := ni.conn.SendInputs(); err != nil {
 					ni.st = NS_Error
 					return
 				}
-				nb.senT++
+				nb.senT = nb.inpT
 			}
 			time.Sleep(time.Millisecond)
 		}
-		ni.writeI32(-1)
+		// The connection keeps sending the frames that have not been
+		// acknowledged, give it a second to get them through
+		for i := 0; i < 60 && nb.ackT < nb.inpT; i++ {
+			time.Sleep(netTick)
+		}
+		ni.conn.WriteI32(-1)
 	}(&ni.buf[ni.locIn])
 	<-ni.recvEnd
-	go func(nb *NetBuffer) {
+	// Remote frames are stored by the connection as they arrive, this only
+	// passes on the checksums and waits for the other side to stop
+	go func() {
 		defer func() { ni.recvEnd <- true }()
-		for ni.st == NS_Playing {
-			if nb.inpT-nb.curT < 32 {
-				if tmp, err := ni.readI32(); err != nil {
+		var m netCheckMsg
+		var n int32
+		read := func(v *int32) bool {
+			var err error
+			if *v, err = ni.conn.ReadI32(); err != nil {
+				if ni.st == NS_Playing {
 					ni.st = NS_Error
+				}
+				return false
+			}
+			return true
+		}
+		for read(&m.kind) {
+			switch m.kind {
+			case -1:
+				if ni.st == NS_Playing {
+					ni.st = NS_Stopped
+				}
+				return
+			case netMsgChecksum:
+				m.vals = make([]int32, 1)
+				if !read(&m.t) || !read(&m.vals[0]) {
 					return
-				} else {
-					nb.buf[nb.inpT&31] = InputBits(tmp)
-					if tmp < 0 {
-						ni.st = NS_Stopped
+				}
+			case netMsgDump:
+				if !read(&m.t) || !read(&n) {
+					return
+				}
+				m.vals = make([]int32, Max(0, n))
+				for i := range m.vals {
+					if !read(&m.vals[i]) {
 						return
-					} else {
-						nb.inpT++
-						nb.senT = nb.inpT
 					}
 				}
+			default:
+				continue
 			}
-			time.Sleep(time.Millisecond)
-		}
-		for tmp := int32(0); tmp != -1; {
-			var err error
-			if tmp, err = ni.readI32(); err != nil {
-				break
-			}
+			// Queued without a limit, as a message lost here could hide a
+			// desync
+			ni.checkMu.Lock()
+			ni.checks = append(ni.checks, m)
+			ni.checkMu.Unlock()
 		}
-	}(&ni.buf[ni.remIn])
+	}()
 	ni.Update()
 	return nil
 }
 func (ni *NetInput) Update() bool {
+	if ni.spec != nil {
+		ni.spec.Update(ni.time)
+	}
+	ni.compare()
 	if ni.st != NS_Stopped {
 		ni.stoppedcnt = 0
 	}
@@ -1280,6 +1412,12 @@ func (ni *NetInput) Update() bool {
 			}
 			fallthrough
 		case NS_Playing:
+			if ni.rb != nil {
+				ni.rollbackUpdate()
+				break
+			}
+			ni.record(ni.time)
+			ni.confirm(ni.time)
 			for {
 				foo := Min(ni.buf[ni.locIn].senT, ni.buf[ni.remIn].senT)
 				tmp := ni.buf[ni.remIn].inpT + ni.delay>>3 - ni.buf[ni.locIn].inpT
@@ -1299,9 +1437,9 @@ func (ni *NetInput) Update() bool {
 				}
 				ni.buf[ni.locIn].curT = ni.time
 				ni.buf[ni.remIn].curT = ni.time
-				if ni.rep != nil {
+				if w := ni.recorder(); w != nil {
 					for _, nb := range ni.buf {
-						binary.Write(ni.rep, binary.LittleEndian, &nb.buf[ni.time&31])
+						binary.Write(w, binary.LittleEndian, &nb.buf[ni.time&31])
 					}
 				}
 				ni.time++
@@ -1320,14 +1458,245 @@ func (ni *NetInput) Update() bool {
 	return !sys.gameEnd
 }
 
+// Switches a running match to rollback mode. Frames before the current one
+// have been confirmed by the lockstep synchronization.
+func (ni *NetInput) StartRollback(frames int32, save, load func(t int32),
+	advance func()) {
+	ni.rb = &NetRollback{frames: frames, cur: ni.time - 1, verT: ni.time,
+		save: save, load: load, advance: advance}
+	ni.rb.pred[ni.rb.cur&31] = ni.buf[ni.remIn].buf[ni.rb.cur&31]
+	ni.buf[ni.locIn].curT = ni.time
+	ni.buf[ni.remIn].curT = ni.time
+}
+func (ni *NetInput) StopRollback() {
+	ni.rb = nil
+}
+
+// Sounds are not played while rollback simulates frames again or the
+// replay viewer seeks
+func (s *System) resimulating() bool {
+	return s.netInput != nil && s.netInput.rb != nil && s.netInput.rb.resim ||
+		s.fileInput != nil && s.fileInput.seeking()
+}
+
+// Remote input for frame t, or the last input received if it has not
+// arrived yet
+func (ni *NetInput) predict(t int32) InputBits {
+	nb := &ni.buf[ni.remIn]
+	if t < nb.inpT {
+		return nb.buf[t&31]
+	} else if nb.inpT > 0 {
+		return nb.buf[(nb.inpT-1)&31]
+	}
+	return 0
+}
+
+// Confirms the frames whose remote input has arrived, returning the first
+// mispredicted frame or -1
+func (ni *NetInput) verify() int32 {
+	rb, loc, rem := ni.rb, &ni.buf[ni.locIn], &ni.buf[ni.remIn]
+	for ; rb.verT < ni.time && rb.verT < rem.inpT; rb.verT++ {
+		if rem.buf[rb.verT&31] != rb.pred[rb.verT&31] {
+			return rb.verT
+		}
+		if w := ni.recorder(); w != nil {
+			for _, nb := range ni.buf {
+				binary.Write(w, binary.LittleEndian, &nb.buf[rb.verT&31])
+			}
+		}
+		loc.curT, rem.curT = rb.verT+1, rb.verT+1
+	}
+	return -1
+}
+
+// Loads the state of frame f and simulates the frames up to the current
+// one again with the input known by now
+func (ni *NetInput) rollback(f int32) {
+	rb := ni.rb
+	rb.load(f)
+	rb.resim = true
+	for t := f; t < ni.time; t++ {
+		if t > f {
+			rb.save(t)
+			ni.record(t)
+		}
+		rb.cur = t
+		rb.pred[t&31] = ni.predict(t)
+		rb.advance()
+	}
+	rb.resim = false
+}
+func (ni *NetInput) rollbackUpdate() {
+	rb, loc, rem := ni.rb, &ni.buf[ni.locIn], &ni.buf[ni.remIn]
+	for {
+		if f := ni.verify(); f >= 0 {
+			ni.rollback(f)
+			continue
+		}
+		// Round transitions are never rolled back, so they wait until
+		// every frame has been confirmed
+		if ni.time-rem.inpT > rb.frames || ni.time-loc.ackT >= 32 ||
+			sys.roundOver() && rb.verT < ni.time {
+			if sys.esc || !sys.await(FPS) || ni.st != NS_Playing {
+				return
+			}
+			continue
+		}
+		break
+	}
+	for loc.inpT <= ni.time && loc.localUpdate(0) {
+	}
+	rb.save(ni.time)
+	ni.record(ni.time)
+	ni.confirm(rb.verT)
+	rb.cur = ni.time
+	rb.pred[ni.time&31] = ni.predict(ni.time)
+	ni.time++
+}
+
+// Starts checking for desyncs in a match that begins at the current frame
+func (ni *NetInput) StartCheck() {
+	ni.check = &NetCheck{start: ni.time, conf: ni.time - 1,
+		local: make(map[int32][]int32), remote: make(map[int32]int32),
+		dumps: make(map[int32][]int32)}
+}
+func (ni *NetInput) StopCheck() {
+	ni.check = nil
+}
+
+// Keeps the values of the state frame t starts from. With rollback they
+// are recorded again every time the frame is simulated again.
+func (ni *NetInput) record(t int32) {
+	if ni.check != nil && t > ni.check.conf && t%netCheckInterval == 0 {
+		ni.check.local[t] = sys.syncValues()
+	}
+}
+
+// Sends the checksums of the frames up to t, which no rollback can change
+// anymore
+func (ni *NetInput) confirm(t int32) {
+	if ni.check == nil {
+		return
+	}
+	for ni.check.conf < t {
+		ni.check.conf++
+		if v, ok := ni.check.local[ni.check.conf]; ok {
+			ni.conn.WriteI32s(netMsgChecksum, ni.check.conf, syncChecksum(v))
+		}
+	}
+}
+
+// Returns the messages received since the last call
+func (ni *NetInput) takeChecks() []netCheckMsg {
+	ni.checkMu.Lock()
+	defer ni.checkMu.Unlock()
+	m := ni.checks
+	ni.checks = nil
+	return m
+}
+
+// Compares the checksums received from the other side with the confirmed
+// local ones
+func (ni *NetInput) compare() {
+	for _, m := range ni.takeChecks() {
+		if ni.check == nil || m.t < ni.check.start {
+			continue
+		}
+		switch m.kind {
+		case netMsgChecksum:
+			ni.check.remote[m.t] = m.vals[0]
+		case netMsgDump:
+			// Sent by the other side when it finds the desync first
+			ni.check.dumps[m.t] = m.vals
+		}
+	}
+	if ni.check == nil {
+		return
+	}
+	for t, sum := range ni.check.remote {
+		if t > ni.check.conf {
+			continue
+		}
+		if v, ok := ni.check.local[t]; ok && syncChecksum(v) != sum {
+			ni.desync(t)
+			return
+		}
+		delete(ni.check.remote, t)
+		delete(ni.check.local, t)
+	}
+}
+
+// Exchanges the values of frame t with the other side, writes both to a file
+// and ends the session
+func (ni *NetInput) desync(t int32) {
+	local := ni.check.local[t]
+	ni.conn.WriteI32s(append([]int32{netMsgDump, t, int32(len(local))}, local...)...)
+	remote := ni.check.dumps[t]
+	// Give the other side a few seconds to send its values
+	for i := 0; remote == nil && i < 5*FPS; i++ {
+		for _, m := range ni.takeChecks() {
+			if m.kind == netMsgDump && m.t == t {
+				remote = m.vals
+			}
+		}
+		if remote == nil && (ni.st != NS_Playing || !sys.await(FPS)) {
+			break
+		}
+	}
+	side := [...]string{"guest", "host"}[Btoi(ni.host)]
+	dump := fmt.Sprintf("Desync at frame %v\n\n[Local (%v)]\n%v\n[Remote]\n", t, side, syncDump(local))
+	if remote != nil {
+		dump += syncDump(remote)
+	} else {
+		dump += "not received\n"
+	}
+	filename := "save/desync_" + time.Now().Format("2006-01-02_15-04-05") + ".log"
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		filename = ""
+	} else if err := ioutil.WriteFile(filename, []byte(dump), 0644); err != nil {
+		filename = ""
+	}
+	ni.err = Error(fmt.Sprintf("Netplay desync detected at frame %v", t))
+	if filename != "" {
+		ni.err = Error(fmt.Sprintf("%v, state saved to %v", ni.err.Error(), filename))
+	}
+	sys.errLog.Printf("%v\n%v", ni.err.Error(), dump)
+	ni.st = NS_Error
+}
+
 type FileInput struct {
-	f  *os.File
-	ib [MaxSimul*2 + MaxAttachedChar]InputBits
+	f      io.ReadCloser
+	ib     [MaxSimul*2 + MaxAttachedChar]InputBits
+	header *ReplayHeader
+	next   *ReplayMatch
+	ai     *[MaxSimul*2 + MaxAttachedChar]AiController
+	err    error
+	replayViewer
 }
 
 func OpenFileInput(filename string) *FileInput {
-	fi := &FileInput{}
-	fi.f, _ = os.Open(filename)
+	fi := &FileInput{replayViewer: newReplayViewer()}
+	var f *os.File
+	if f, fi.err = os.Open(filename); fi.err == nil {
+		fi.f = f
+		if fi.header, fi.err = readReplayHeader(f); fi.err != nil {
+			fi.Close()
+		}
+	}
+	return fi
+}
+
+// Watches the netplay session hosted on server, which streams the same data
+// as a replay file
+func ConnectFileInput(server, port string) *FileInput {
+	fi := &FileInput{replayViewer: newReplayViewer()}
+	var conn net.Conn
+	if conn, fi.err = net.DialTimeout("tcp", server+":"+port, 5*time.Second); fi.err == nil {
+		fi.f = conn
+		if fi.header, fi.err = readReplayStreamHeader(conn); fi.err != nil {
+			fi.Close()
+		}
+	}
 	return fi
 }
 func (fi *FileInput) Close() {
@@ -1335,6 +1704,10 @@ func (fi *FileInput) Close() {
 		fi.f.Close()
 		fi.f = nil
 	}
+	if fi.ai != nil {
+		sys.aiController = *fi.ai
+		fi.ai = nil
+	}
 }
 func (fi *FileInput) Input(cb *CommandBuffer, i int, facing int32) {
 	if i >= 0 && i < len(fi.ib) {
@@ -1342,18 +1715,55 @@ func (fi *FileInput) Input(cb *CommandBuffer, i int, facing int32) {
 	}
 }
 func (fi *FileInput) AnyButton() bool {
-	for _, b := range fi.ib {
-		if b&IB_anybutton != 0 {
+	// AI bits are recorded too, but were not counted while recording
+	for i, b := range fi.ib {
+		if b&IB_anybutton != 0 && humanInput(i) {
 			return true
 		}
 	}
 	return false
 }
+
+// Reads the match played back by the next synchronization, which stays
+// available until then
+func (fi *FileInput) nextMatch() (*ReplayMatch, error) {
+	if fi.next == nil {
+		if fi.f == nil || fi.header == nil {
+			return nil, Error("Replay has no match information")
+		}
+		m := &ReplayMatch{}
+		if err := readReplayJSON(fi.f, m); err != nil {
+			return nil, err
+		}
+		fi.next = m
+	}
+	return fi.next, nil
+}
 func (fi *FileInput) Synchronize() {
+	if fi.f != nil && fi.header != nil {
+		// Refuse to play back a match that would desync
+		m, err := fi.nextMatch()
+		fi.next = nil
+		if err == nil {
+			cur := sys.replayMatch()
+			if diff := m.mismatch(&cur); diff != "" {
+				err = Error("Replay mismatch: " + diff)
+			} else {
+				fi.setAiControllers(m)
+			}
+		}
+		if err != nil {
+			sys.errLog.Println(err.Error())
+			fi.err = err
+			fi.Close()
+			sys.esc = true
+		}
+	}
 	if fi.f != nil {
 		var seed int32
 		if binary.Read(fi.f, binary.LittleEndian, &seed) == nil {
 			Srand(seed)
+			fi.frame = 0
 			fi.Update()
 		}
 	}
@@ -1362,9 +1772,13 @@ func (fi *FileInput) Update() bool {
 	if fi.f == nil {
 		sys.esc = true
 	} else {
-		if sys.oldNextAddTime > 0 &&
-			binary.Read(fi.f, binary.LittleEndian, fi.ib[:]) != nil {
-			sys.esc = true
+		if sys.oldNextAddTime > 0 {
+			fi.viewerUpdate()
+			if binary.Read(fi.f, binary.LittleEndian, fi.ib[:]) != nil {
+				sys.esc = true
+			} else {
+				fi.frame++
+			}
 		}
 		if sys.esc {
 			fi.Close()
@@ -1373,15 +1787,144 @@ func (fi *FileInput) Update() bool {
 	return !sys.gameEnd
 }
 
+// LocalInput feeds keyboard and joystick input to local matches while they
+// are being recorded, writing the same seed and InputBits stream that
+// FileInput plays back.
+type LocalInput struct {
+	ib      [MaxSimul*2 + MaxAttachedChar]InputBits
+	ai      [MaxSimul*2 + MaxAttachedChar]InputBits
+	rep     *os.File
+	playing bool
+}
+
+func CreateLocalInput(filename string) *LocalInput {
+	return &LocalInput{rep: createReplay(filename)}
+}
+func (li *LocalInput) Close() {
+	if li.rep != nil {
+		li.rep.Close()
+		li.rep = nil
+	}
+	li.playing = false
+}
+func (li *LocalInput) Input(cb *CommandBuffer, i int, facing int32) {
+	if i >= 0 && i < len(li.ib) {
+		li.ib[sys.inputRemap[i]].GetInput(cb, facing)
+	}
+}
+func (li *LocalInput) AnyButton() bool {
+	for _, b := range li.ib {
+		if b&IB_anybutton != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if any human controlled player reads the given input slot
+func humanInput(in int) bool {
+	for _, p := range sys.chars {
+		if len(p) > 0 && p[0].key >= 0 && p[0].key < len(sys.inputRemap) &&
+			sys.inputRemap[p[0].key] == in {
+			return true
+		}
+	}
+	return false
+}
+
+// Stores the input the AI of player pn has just pressed, which is recorded
+// in its slot unless the slot is taken by a human player. The AI bits are
+// kept apart from ib, which only holds what was pressed on the hardware.
+// Playback makes the random AI again from the recorded seed, and plays back
+// these bits for the players that had an AiController.
+func (li *LocalInput) aiInput(pn int) {
+	if pn < 0 || pn >= len(li.ai) || pn >= len(sys.aiInput) {
+		return
+	}
+	ai := &sys.aiInput[pn]
+	li.ai[pn] = InputBits(Btoi(ai.U()) | Btoi(ai.D())<<1 | Btoi(ai.L())<<2 |
+		Btoi(ai.R())<<3 | Btoi(ai.a())<<4 | Btoi(ai.b())<<5 | Btoi(ai.c())<<6 |
+		Btoi(ai.x())<<7 | Btoi(ai.y())<<8 | Btoi(ai.z())<<9 | Btoi(ai.s())<<10 |
+		Btoi(ai.d())<<11 | Btoi(ai.w())<<12 | Btoi(ai.m())<<13)
+}
+func (li *LocalInput) poll() {
+	for i := range li.ib {
+		if humanInput(i) {
+			li.ib[i].SetLocalInput(i)
+		}
+	}
+}
+func (li *LocalInput) Synchronize() {
+	seed := Random()
+	Srand(seed)
+	li.ib, li.ai = [len(li.ib)]InputBits{}, [len(li.ai)]InputBits{}
+	if li.rep != nil {
+		writeReplayMatch(li.rep)
+		binary.Write(li.rep, binary.LittleEndian, &seed)
+		li.playing = true
+	}
+	li.poll()
+}
+func (li *LocalInput) Stop() {
+	li.write()
+	li.playing = false
+}
+
+// Writes the input of the frame that has just been run, once the AI has
+// pressed its keys for it
+func (li *LocalInput) write() {
+	if li.playing && li.rep != nil {
+		ib := li.ib
+		for i := range ib {
+			if !humanInput(i) {
+				ib[i] = li.ai[i]
+			}
+		}
+		binary.Write(li.rep, binary.LittleEndian, ib[:])
+	}
+}
+func (li *LocalInput) Update() bool {
+	if sys.oldNextAddTime > 0 {
+		li.write()
+		li.poll()
+	}
+	if sys.esc && li.playing {
+		// A match that was quit halfway can not be played back past this
+		// point, so the recording ends here
+		li.Close()
+	}
+	return !sys.gameEnd
+}
+
+// AiInput is the input of a computer controlled player, either random keys
+// pressed more often at higher levels or the keys returned by the
+// AiController set for the player.
 type AiInput struct {
 	dir, dirt, at, bt, ct, xt, yt, zt, st, dt, wt, mt int32
+	ib                                                InputBits
+	custom                                            bool
+	frame                                             int32
 }
 
-func (ai *AiInput) Update(level float32) {
+func (ai *AiInput) Update(pn int, level float32) {
+	ai.custom = sys.aiController[pn] != nil
 	if sys.intro != 0 {
 		ai.dirt, ai.at, ai.bt, ai.ct = 0, 0, 0, 0
 		ai.xt, ai.yt, ai.zt, ai.st = 0, 0, 0, 0
 		ai.dt, ai.wt, ai.mt = 0, 0, 0
+		ai.ib = 0
+		return
+	}
+	if ai.custom {
+		// Helpers with a command buffer of their own update the input again
+		// in the same frame, which should not ask the controller twice
+		if ai.frame == sys.gameTime+1 {
+			return
+		}
+		ai.frame, ai.ib = sys.gameTime+1, 0
+		if v := newAiView(pn); v != nil {
+			ai.ib = sys.aiController[pn].Input(v)
+		}
 		return
 	}
 	var osu, hanasu int32 = 15, 60
@@ -1413,47 +1956,66 @@ func (ai *AiInput) Update(level float32) {
 	dec(&ai.st)
 	//dec(&ai.mt)
 }
+func (ai *AiInput) pressed(b InputBits, t int32) bool {
+	// t is what is left of the time the random input holds the button
+	if ai.custom {
+		return ai.ib&b != 0
+	}
+	return t != 0
+}
 func (ai *AiInput) L() bool {
+	if ai.custom {
+		return ai.ib&IB_PL != 0
+	}
 	return ai.dirt != 0 && (ai.dir == 5 || ai.dir == 6 || ai.dir == 7)
 }
 func (ai *AiInput) R() bool {
+	if ai.custom {
+		return ai.ib&IB_PR != 0
+	}
 	return ai.dirt != 0 && (ai.dir == 1 || ai.dir == 2 || ai.dir == 3)
 }
 func (ai *AiInput) U() bool {
+	if ai.custom {
+		return ai.ib&IB_PU != 0
+	}
 	return ai.dirt != 0 && (ai.dir == 7 || ai.dir == 0 || ai.dir == 1)
 }
 func (ai *AiInput) D() bool {
+	if ai.custom {
+		return ai.ib&IB_PD != 0
+	}
 	return ai.dirt != 0 && (ai.dir == 3 || ai.dir == 4 || ai.dir == 5)
 }
 func (ai *AiInput) a() bool {
-	return ai.at != 0
+	return ai.pressed(IB_A, ai.at)
 }
 func (ai *AiInput) b() bool {
-	return ai.bt != 0
+	return ai.pressed(IB_B, ai.bt)
 }
 func (ai *AiInput) c() bool {
-	return ai.ct != 0
+	return ai.pressed(IB_C, ai.ct)
 }
 func (ai *AiInput) x() bool {
-	return ai.xt != 0
+	return ai.pressed(IB_X, ai.xt)
 }
 func (ai *AiInput) y() bool {
-	return ai.yt != 0
+	return ai.pressed(IB_Y, ai.yt)
 }
 func (ai *AiInput) z() bool {
-	return ai.zt != 0
+	return ai.pressed(IB_Z, ai.zt)
 }
 func (ai *AiInput) s() bool {
-	return ai.st != 0
+	return ai.pressed(IB_S, ai.st)
 }
 func (ai *AiInput) d() bool {
-	return ai.dt != 0
+	return ai.pressed(IB_D, ai.dt)
 }
 func (ai *AiInput) w() bool {
-	return ai.wt != 0
+	return ai.pressed(IB_W, ai.wt)
 }
 func (ai *AiInput) m() bool {
-	return ai.mt != 0
+	return ai.pressed(IB_M, ai.mt)
 }
 
 type cmdElem struct {
@@ -1502,6 +2064,7 @@ type Command struct {
 	cmdi, tamei         int
 	time, cur           int32
 	buftime, curbuftime int32
+	fired               bool
 }
 
 func newCommand() *Command { return &Command{tamei: -1, time: 1, buftime: 1} }
@@ -1908,6 +2471,7 @@ func (c *Command) bufTest(cbuf *CommandBuffer, ai bool,
 	return true
 }
 func (c *Command) Step(cbuf *CommandBuffer, ai, hitpause bool, buftime int32) {
+	c.fired = false
 	if !hitpause && c.curbuftime > 0 {
 		c.curbuftime--
 	}
@@ -1941,6 +2505,7 @@ func (c *Command) Step(cbuf *CommandBuffer, ai, hitpause bool, buftime int32) {
 	c.Clear()
 	if complete {
 		c.curbuftime = c.buftime + buftime
+		c.fired = true
 	}
 }
 
@@ -1962,7 +2527,10 @@ func (cl *CommandList) Input(i int, facing int32, aiLevel float32) bool {
 	}
 	step := cl.Buffer.Bb != 0
 	if i < 0 && ^i < len(sys.aiInput) {
-		sys.aiInput[^i].Update(aiLevel) // 乱数を使うので同期がずれないようここで / Here we use random numbers so we can not get out of sync
+		sys.aiInput[^i].Update(^i, aiLevel) // 乱数を使うので同期がずれないようここで / Here we use random numbers so we can not get out of sync
+		if sys.localInput != nil {
+			sys.localInput.aiInput(^i)
+		}
 	}
 	_else := i < 0
 	if _else {
@@ -1970,6 +2538,8 @@ func (cl *CommandList) Input(i int, facing int32, aiLevel float32) bool {
 		sys.fileInput.Input(cl.Buffer, i, facing)
 	} else if sys.netInput != nil {
 		sys.netInput.Input(cl.Buffer, i, facing)
+	} else if sys.localInput != nil {
+		sys.localInput.Input(cl.Buffer, i, facing)
 	} else {
 		_else = true
 	}
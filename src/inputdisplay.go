@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const inputHistoryLen = 16
+
+// InputHistory is what the CommandBuffer of a player has registered on the
+// last frames, with directions relative to the way the player faces, and the
+// commands of its CommandList that were completed. It is shown in training
+// mode when the InputDisplay option is on.
+type InputHistory struct {
+	entries []inputHistoryEntry
+}
+
+type inputHistoryEntry struct {
+	dir      int8
+	buttons  string
+	commands []string
+	time     int32
+}
+
+// The direction in numpad notation, 6 being forward and 5 neutral
+func (__ *CommandBuffer) numpadDir() int8 {
+	dir := int8(5)
+	if __.U > 0 {
+		dir += 3
+	} else if __.D > 0 {
+		dir -= 3
+	}
+	if __.F > 0 {
+		dir++
+	} else if __.B > 0 {
+		dir--
+	}
+	return dir
+}
+func (__ *CommandBuffer) heldButtons() string {
+	var b []string
+	for _, k := range [...]struct {
+		v    int8
+		name string
+	}{{__.a, "a"}, {__.b, "b"}, {__.c, "c"}, {__.x, "x"}, {__.y, "y"},
+		{__.z, "z"}, {__.s, "s"}, {__.d, "d"}, {__.w, "w"}, {__.m, "m"}} {
+		if k.v > 0 {
+			b = append(b, k.name)
+		}
+	}
+	return strings.Join(b, "+")
+}
+
+// Adds the frame that cl has just stepped through. A frame is added to the
+// latest entry while the input stays the same and no command is completed.
+func (ih *InputHistory) record(cl *CommandList) {
+	if cl.Buffer == nil {
+		return
+	}
+	e := inputHistoryEntry{dir: cl.Buffer.numpadDir(),
+		buttons: cl.Buffer.heldButtons(), time: 1}
+	for name, i := range cl.Names {
+		for _, c := range cl.At(i) {
+			if c.fired {
+				e.commands = append(e.commands, name)
+				break
+			}
+		}
+	}
+	sort.Strings(e.commands)
+	if n := len(ih.entries); n > 0 && len(e.commands) == 0 &&
+		ih.entries[n-1].dir == e.dir && ih.entries[n-1].buttons == e.buttons {
+		ih.entries[n-1].time++
+		return
+	}
+	if len(ih.entries) >= inputHistoryLen {
+		ih.entries = append(ih.entries[:0], ih.entries[1:]...)
+	}
+	ih.entries = append(ih.entries, e)
+}
+func (ih *InputHistory) clear() {
+	ih.entries = ih.entries[:0]
+}
+
+// The lines shown for the history, newest first, each with the number of
+// frames it was held
+func (ih *InputHistory) lines() []string {
+	var lines []string
+	for i := len(ih.entries) - 1; i >= 0; i-- {
+		e := &ih.entries[i]
+		line := fmt.Sprintf("%3d %d %s", e.time, e.dir, e.buttons)
+		if len(e.commands) > 0 {
+			line += " [" + strings.Join(e.commands, " ") + "]"
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// Draws the frame data of the last move and the input history of the two
+// team leaders in training mode, on their side of the screen
+func (s *System) drawInputDisplay() {
+	if !s.inputDisplay && !s.frameDataDisplay || s.gameMode != "training" ||
+		s.debugFont == nil {
+		return
+	}
+	lineHeight := float32(s.debugFont.fnt.Size[1]) * s.debugFont.yscl / s.heightScale
+	for side := 0; side < 2; side++ {
+		x := (320-float32(s.gameWidth))/2 + 1
+		align := int32(1)
+		if side == 1 {
+			x, align = (320+float32(s.gameWidth))/2-1, -1
+		}
+		y := 240 - float32(s.gameHeight) + 64
+		s.debugFont.SetColor(255, 255, 255)
+		pn := s.teamLeader[side]
+		if pn < 0 || pn >= len(s.inputHistory) {
+			continue
+		}
+		var lines []string
+		if s.frameDataDisplay {
+			lines = append(lines, s.frameData[pn].last.String())
+		}
+		if s.inputDisplay {
+			lines = append(lines, s.inputHistory[pn].lines()...)
+		}
+		for _, l := range lines {
+			y += lineHeight
+			s.debugFont.fnt.Print(l, x, y, s.debugFont.xscl/s.widthScale,
+				s.debugFont.yscl/s.heightScale, 0, align, &s.scrrect,
+				s.debugFont.palfx, s.debugFont.frgba)
+		}
+	}
+}
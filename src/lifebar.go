@@ -1270,6 +1270,8 @@ type LifeBarCombo struct {
 	shaketime     int32
 	combo         int32
 	fakeCombo     int32
+	maxCombo      int32
+	maxDamage     int32
 }
 
 func newLifeBarCombo() *LifeBarCombo {
@@ -1339,6 +1341,7 @@ func (co *LifeBarCombo) step(combo, fakeCombo, damage int32, percentage float32,
 		if co.oldp != percentage {
 			co.curp = percentage
 		}
+		co.maxCombo, co.maxDamage = Max(co.maxCombo, co.cur), Max(co.maxDamage, co.curd)
 	}
 	co.old = fakeCombo
 	co.oldd = damage
@@ -1348,6 +1351,7 @@ func (co *LifeBarCombo) reset() {
 	co.cur, co.old, co.curd, co.oldd, co.curp, co.oldp, co.resttime = 0, 0, 0, 0, 0, 0, 0
 	co.combo = 0
 	co.fakeCombo = 0
+	co.maxCombo, co.maxDamage = 0, 0
 	co.counterX = co.start_x * 2
 	co.shaketime = 0
 }
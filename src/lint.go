@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+// LintIssue is written as one line of JSON for every error and warning that
+// -lint finds. Line is 0 when the issue concerns a whole file.
+type LintIssue struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Col      int    `json:"col"`
+	Ctrl     string `json:"controller,omitempty"`
+	Param    string `json:"param,omitempty"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// Linter collects issues while a Compiler runs in lint mode, where errors no
+// longer stop compiling, along with what can only be checked once every state
+// file has been compiled
+type Linter struct {
+	issues    []LintIssue
+	vars      map[string]lintRef
+	stateRefs []lintRef
+	helperIDs map[int32]bool
+	anyHelper bool
+	helperRef []lintRef
+}
+type lintRef struct {
+	file string
+	line int
+	id   int32
+	used bool
+}
+
+func newLinter() *Linter {
+	return &Linter{helperIDs: make(map[int32]bool)}
+}
+func (l *Linter) add(file string, line int, severity, msg string) {
+	l.issues = append(l.issues, LintIssue{File: file, Line: line,
+		Severity: severity, Message: msg})
+}
+
+// Line of the compiler's current position
+func (c *Compiler) lintLine() int {
+	if c.linechan != nil {
+		return c.lineNo
+	}
+	return c.i + 1
+}
+
+// Reports err and returns true if linting, in which case compiling goes on
+func (c *Compiler) lintError(err error) bool {
+	if c.lint == nil {
+		return false
+	}
+	is := LintIssue{File: c.file, Severity: "error", Message: err.Error()}
+	if ce, ok := err.(*CompileError); ok {
+		is.File, is.Line, is.Col = ce.File, ce.Line, ce.Col
+		is.Ctrl, is.Param, is.Message = ce.Ctrl, ce.Param, ce.Err.Error()
+	}
+	c.lint.issues = append(c.lint.issues, is)
+	c.lint.vars = nil
+	return true
+}
+func (c *Compiler) lintWarn(msg string) {
+	if c.lint != nil {
+		c.lint.issues = append(c.lint.issues, LintIssue{File: c.file,
+			Line: c.lintLine(), Ctrl: c.ctrlName, Severity: "warning", Message: msg})
+	}
+}
+
+// The value of data if it is an integer constant
+func (c *Compiler) lintConst(data string) (int32, bool) {
+	lint := c.lint
+	c.lint = nil
+	defer func() { c.lint = lint }()
+	be, err := c.fullExpression(&data, VT_Int)
+	if err != nil {
+		return 0, false
+	}
+	return constExp(be)
+}
+func constExp(be BytecodeExp) (int32, bool) {
+	switch {
+	case len(be) == 2 && be[0] == OC_int8:
+		return int32(int8(be[1])), true
+	case len(be) == 5 && be[0] == OC_int:
+		return *(*int32)(unsafe.Pointer(&be[1])), true
+	}
+	return 0, false
+}
+func (c *Compiler) lintVarIndex(sys, f bool, i int32) {
+	name, max := "var", int32(NumVar)
+	switch [...]bool{sys, f} {
+	case [...]bool{false, true}:
+		name, max = "fvar", int32(NumFvar)
+	case [...]bool{true, false}:
+		name, max = "sysvar", int32(NumSysVar)
+	case [...]bool{true, true}:
+		name, max = "sysfvar", int32(NumSysFvar)
+	}
+	if i < 0 || i >= max {
+		c.lintWarn(fmt.Sprintf("%v index %v out of range", name, i))
+	}
+}
+
+// Warns about triggers of a CNS controller that can never be true
+func (c *Compiler) lintTriggers(allFalse bool, trexist []int8) {
+	if c.lint == nil {
+		return
+	}
+	if allFalse {
+		c.lintWarn("triggerall is always false, the controller never runs")
+		return
+	}
+	for i, te := range trexist {
+		if te < 0 {
+			c.lintWarn(fmt.Sprintf("trigger%v is always false", i+1))
+		} else if te == 0 {
+			for j := i + 1; j < len(trexist); j++ {
+				if trexist[j] != 0 {
+					c.lintWarn(fmt.Sprintf("trigger%v is never checked, as trigger%v is missing",
+						j+1, i+1))
+				}
+			}
+			break
+		}
+	}
+}
+func (c *Compiler) lintCondition(be BytecodeExp) {
+	if v, ok := constExp(be); ok && v == 0 {
+		c.lintWarn("Condition is always false")
+	}
+}
+
+func (c *Compiler) lintStateRef(is IniSection) {
+	if c.lint == nil {
+		return
+	}
+	if _, ok := is["redirectid"]; ok {
+		return
+	}
+	if v, ok := c.lintConst(is["value"]); ok {
+		c.lint.stateRefs = append(c.lint.stateRefs,
+			lintRef{file: c.file, line: c.lintLine(), id: v})
+	}
+}
+func (c *Compiler) lintHelperID(is IniSection) {
+	if c.lint == nil {
+		return
+	}
+	data, ok := is["id"]
+	if !ok {
+		c.lint.helperIDs[0] = true
+	} else if v, ok := c.lintConst(data); ok {
+		c.lint.helperIDs[v] = true
+	} else {
+		c.lint.anyHelper = true
+	}
+}
+func (c *Compiler) lintHelperRef(id int32) {
+	if c.lint != nil && id >= 0 {
+		c.lint.helperRef = append(c.lint.helperRef,
+			lintRef{file: c.file, line: c.lintLine(), id: id})
+	}
+}
+
+func (c *Compiler) lintVarDeclared(name string) {
+	if c.lint == nil {
+		return
+	}
+	if c.lint.vars == nil {
+		c.lint.vars = make(map[string]lintRef)
+	}
+	c.lint.vars[name] = lintRef{file: c.file, line: c.lintLine()}
+}
+func (c *Compiler) lintVarUsed(name string) {
+	if c.lint == nil {
+		return
+	}
+	if v, ok := c.lint.vars[name]; ok {
+		v.used = true
+		c.lint.vars[name] = v
+	}
+}
+
+// Warns about the let variables of the statedef or function just compiled
+// that are never read
+func (c *Compiler) lintUnusedVars() {
+	if c.lint == nil {
+		return
+	}
+	names := make([]string, 0, len(c.lint.vars))
+	for n, v := range c.lint.vars {
+		if !v.used {
+			names = append(names, n)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return c.lint.vars[names[i]].line < c.lint.vars[names[j]].line
+	})
+	for _, n := range names {
+		v := c.lint.vars[n]
+		c.lint.add(v.file, v.line, "warning", "Unused variable: "+n)
+	}
+	c.lint.vars = nil
+}
+
+// Checks what refers to other states and helpers against the whole character
+func (l *Linter) check(states map[int32]StateBytecode) {
+	for _, r := range l.stateRefs {
+		if _, ok := states[r.id]; !ok {
+			l.add(r.file, r.line, "warning", fmt.Sprintf("State %v is not defined", r.id))
+		}
+	}
+	if !l.anyHelper {
+		for _, r := range l.helperRef {
+			if !l.helperIDs[r.id] {
+				l.add(r.file, r.line, "warning",
+					fmt.Sprintf("No helper with ID %v is ever created", r.id))
+			}
+		}
+	}
+}
+
+// Compiles a character without starting the game for -lint, writes what it
+// finds to w and returns the exit status, 1 if there were errors
+func lintChar(def string, w io.Writer) int {
+	if !strings.HasSuffix(strings.ToLower(def), ".def") {
+		def = filepath.Join("chars", def, filepath.Base(def)+".def")
+	}
+	sys.chars[0] = []*Char{newChar(0, 0)}
+	c := newCompiler()
+	c.lint = newLinter()
+	if states, err := c.Compile(0, def); err != nil {
+		c.lintError(&CompileError{File: def, Err: err})
+	} else {
+		c.lint.check(states)
+	}
+	status, enc := 0, json.NewEncoder(w)
+	for _, is := range c.lint.issues {
+		enc.Encode(is)
+		if is.Severity == "error" {
+			status = 1
+		}
+	}
+	return status
+}
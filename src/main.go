@@ -22,7 +22,9 @@ func init() {
 // Checks if error is not null, if there is an error it displays a error dialogue box and crashes the program.
 func chk(err error) {
 	if err != nil {
-		dialog.Message(err.Error()).Title("I.K.E.M.E.N Error").Error()
+		if !sys.headless {
+			dialog.Message(err.Error()).Title("I.K.E.M.E.N Error").Error()
+		}
 		panic(err)
 	}
 }
@@ -30,7 +32,9 @@ func chk(err error) {
 // Extended version of 'chk()'
 func chkEX(err error, txt string) {
 	if err != nil {
-		dialog.Message(txt + err.Error()).Title("I.K.E.M.E.N Error").Error()
+		if !sys.headless {
+			dialog.Message(txt + err.Error()).Title("I.K.E.M.E.N Error").Error()
+		}
 		panic(Error(txt + err.Error()))
 	}
 }
@@ -52,10 +56,44 @@ func main() {
 	os.Mkdir("save/replays", os.ModeSticky|0755)
 
 	processCommandLine()
+	_, sys.headless = sys.cmdFlags["-headless"]
+	_, sys.noOptimize = sys.cmdFlags["-nooptimize"]
+	_, sys.noCache = sys.cmdFlags["-nocache"]
+	// An agent on stdio gets standard output to itself from the start
+	for k, v := range sys.cmdFlags {
+		if v == "stdio" && (k == "-env" || strings.HasSuffix(k, ".agent")) {
+			reserveStdout()
+		}
+	}
+	if f, ok := sys.cmdFlags["-dumpbytecode"]; ok {
+		dump, err := os.Create(f)
+		chk(err)
+		sys.bytecodeDump = dump
+	}
+
+	// Compile a character and report what is wrong with it, without starting
+	// the game
+	if def, ok := sys.cmdFlags["-lint"]; ok {
+		setupConfig()
+		os.Exit(lintChar(def, os.Stdout))
+	}
+	// Print the frame data of the attack states of a character
+	if def, ok := sys.cmdFlags["-framedata"]; ok {
+		setupConfig()
+		os.Exit(frameDataChar(def, os.Stdout))
+	}
+	// Print the compiled states of a character, or only the one given with
+	// -state
+	if def, ok := sys.cmdFlags["-disasm"]; ok {
+		setupConfig()
+		os.Exit(disasmChar(def, sys.cmdFlags["-state"], os.Stdout))
+	}
 
 	// Initialize OpenGL
-	chk(glfw.Init())
-	defer glfw.Terminate()
+	if !sys.headless {
+		chk(glfw.Init())
+		defer glfw.Terminate()
+	}
 
 	// Try reading stats
 	if _, err := ioutil.ReadFile("save/stats.json"); err != nil {
@@ -74,7 +112,9 @@ func main() {
 	// Check if the main lua file exists.
 	if !fileExists(tmp.System) {
 		var err = Error("Main lua file '" + tmp.System + "' can not be found.")
-		dialog.Message(err.Error()).Title("I.K.E.M.E.N Error").Error()
+		if !sys.headless {
+			dialog.Message(err.Error()).Title("I.K.E.M.E.N Error").Error()
+		}
 		panic(err)
 	}
 
@@ -83,19 +123,29 @@ func main() {
 	// Initialize game and create window
 	sys.luaLState = sys.init(tmp.GameWidth, tmp.GameHeight)
 
-	// Begin processing game using its lua scripts
-	if err := sys.luaLState.DoFile(tmp.System); err != nil {
+	// Begin processing game using its lua scripts, unless serving matches
+	// to a training agent instead of running the menus
+	if addr, ok := sys.cmdFlags["-env"]; ok {
+		if err := serveEnv(addr, tmp.Motif); err != nil {
+			fmt.Fprintln(log, err)
+			panic(err)
+		}
+	} else if err := sys.luaLState.DoFile(tmp.System); err != nil {
 		// Display error logs.
 		fmt.Fprintln(log, err)
 		switch err.(type) {
 		case *lua.ApiError:
 			errstr := strings.Split(err.Error(), "\n")[0]
 			if len(errstr) < 10 || errstr[len(errstr)-10:] != "<game end>" {
-				dialog.Message("%s\n\nError saved to Ikemen.log", err).Title("I.K.E.M.E.N Error").Error()
+				if !sys.headless {
+					dialog.Message("%s\n\nError saved to Ikemen.log", err).Title("I.K.E.M.E.N Error").Error()
+				}
 				panic(err)
 			}
 		default:
-			dialog.Message("%s\n\nError saved to Ikemen.log", err).Title("I.K.E.M.E.N Error").Error()
+			if !sys.headless {
+				dialog.Message("%s\n\nError saved to Ikemen.log", err).Title("I.K.E.M.E.N Error").Error()
+			}
 			panic(err)
 		}
 	}
@@ -104,7 +154,9 @@ func main() {
 	if !sys.gameEnd {
 		sys.gameEnd = true
 	}
-	<-sys.audioClose
+	if !sys.headless {
+		<-sys.audioClose
+	}
 }
 
 // Loops through given comand line arguments and processes them for later use by the game
@@ -123,6 +175,7 @@ func processCommandLine() {
 				text := `Options (case sensitive):
 -h -?                   Help
 -log <logfile>          Records match data to <logfile>
+-results <file>         Appends the result of every match to <file> as JSON
 -r <path>               Loads motif <path>. eg. -r motifdir or -r motifdir/system.def
 -lifebar <path>         Loads lifebar <path>. eg. -lifebar data/fight.def
 -storyboard <path>      Loads storyboard <path>. eg. -storyboard chars/kfm/intro.def
@@ -130,6 +183,10 @@ func processCommandLine() {
 Quick VS Options:
 -p<n> <playername>      Loads player n, eg. -p3 kfm
 -p<n>.ai <level>        Sets player n's AI to <level>, eg. -p1.ai 8
+-p<n>.bot <name>        Sets player n's AI controller, eg. -p2.bot basic
+-p<n>.agent <address>   Lets the agent at <address> play as player n in lock step,
+                        eg. -p2.agent 127.0.0.1:7500, -p2.agent unix:/tmp/p2 or
+                        -p2.agent stdio (use with -headless for uncapped speed)
 -p<n>.color <col>       Sets player n's color to <col>
 -p<n>.power <power>     Sets player n's power to <power>
 -p<n>.life <life>       Sets player n's life to <life>
@@ -148,7 +205,24 @@ Debug Options:
 -ailevel <level>        Changes game difficulty setting to <level> (1-8)
 -speed <speed>          Changes game speed setting to <speed> (10%%-200%%)
 -stresstest <frameskip> Stability test (AI matches at speed increased by <frameskip>)
--speedtest              Speed test (match speed x100)`
+-speedtest              Speed test (match speed x100)
+-headless               Runs without window, rendering or audio (uncapped speed)
+-replay <file>          Plays back a replay file and exits
+-lint <def>             Compiles a character and prints its errors and warnings as JSON
+-nooptimize             Disables the bytecode optimizer
+-nocache                Compiles characters without reading or writing save/cache
+-dumpbytecode <file>    Writes the bytecode changed by the optimizer to <file>
+-disasm <def>           Prints the compiled bytecode of a character's states
+-state <stateno>        Only prints state <stateno> with -disasm
+-framedata <def>        Prints the startup, active and recovery frames of a
+                        character's attack states
+-env <address>          Serves matches to a training agent connecting to <address>,
+                        which sends reset and step requests as JSON lines
+-profile <file>         Times states and controllers, shown in debug mode and
+                        appended to <file> as JSON after every match
+
+Netplay Options:
+-spectate <address>     Watches the netplay session hosted at <address>`
 				//dialog.Message(text).Title("I.K.E.M.E.N Command line options").Info()
 				fmt.Printf("I.K.E.M.E.N Command line options\n\n" + text + "\nPress ENTER to exit")
 				var s string
@@ -208,12 +282,14 @@ type configSettings struct {
 	FontShaderVer              string
 	ForceStageZoomin           float32
 	ForceStageZoomout          float32
+	FrameDataDisplay           bool
 	Framerate                  int32
 	Fullscreen                 bool
 	GameWidth                  int32
 	GameHeight                 int32
 	GameSpeed                  float32
 	IP                         map[string]string
+	InputDisplay               bool
 	LifebarFontScale           float32
 	LifeMul                    float32
 	ListenPort                 string
@@ -240,11 +316,15 @@ type configSettings struct {
 	RatioLife                  [4]float32
 	RatioRecoveryBase          float32
 	RatioRecoveryBonus         float32
+	RecordReplays              bool
+	ResultsFile                string
+	RollbackFrames             int32
 	RoundsNumSimul             int32
 	RoundsNumSingle            int32
 	RoundsNumTag               int32
 	RoundTime                  int32
 	ScreenshotFolder           string
+	SpectatorDelay             int32
 	StartStage                 string
 	StereoEffects              bool
 	System                     string
@@ -322,12 +402,14 @@ func setupConfig() configSettings {
 	"FontShaderVer": "150 core",
 	"ForceStageZoomin": 0,
 	"ForceStageZoomout": 0,
+	"FrameDataDisplay": true,
 	"Framerate": 60,
 	"Fullscreen": false,
 	"GameWidth": 640,
 	"GameHeight": 480,
 	"GameSpeed": 100,
 	"IP": {},
+	"InputDisplay": true,
 	"LifebarFontScale": 1,
 	"LifeMul": 100,
 	"ListenPort": "7500",
@@ -373,11 +455,15 @@ func setupConfig() configSettings {
 	],
 	"RatioRecoveryBase": 0,
 	"RatioRecoveryBonus": 20,
+	"RecordReplays": false,
+	"ResultsFile": "",
+	"RollbackFrames": 0,
 	"RoundsNumSimul": 2,
 	"RoundsNumSingle": 2,
 	"RoundsNumTag": 2,
 	"RoundTime": 99,
 	"ScreenshotFolder": "",
+	"SpectatorDelay": 120,
 	"StartStage": "stages/stage0-720.def",
 	"StereoEffects": true,
 	"System": "external/script/main.lua",
@@ -630,6 +716,7 @@ func setupConfig() configSettings {
 	}
 	if cmd, err := ioutil.ReadFile(tmp.CommonCmd); err == nil {
 		sys.commonCmd = "\n" + string(cmd)
+		sys.commonCmdFile = tmp.CommonCmd
 	}
 	sys.commonConst = tmp.CommonConst
 	sys.commonLua = tmp.CommonLua
@@ -646,6 +733,8 @@ func setupConfig() configSettings {
 	sys.fullscreen = tmp.Fullscreen
 	FPS = int(tmp.Framerate)
 	sys.gameSpeed = tmp.GameSpeed / 100
+	sys.inputDisplay = tmp.InputDisplay
+	sys.frameDataDisplay = tmp.FrameDataDisplay
 	sys.helperMax = tmp.MaxHelper
 	sys.lifebarFontScale = tmp.LifebarFontScale
 	sys.lifeMul = tmp.LifeMul / 100
@@ -658,6 +747,15 @@ func setupConfig() configSettings {
 	sys.panningRange = tmp.PanningRange
 	sys.playerProjectileMax = tmp.MaxPlayerProjectile
 	sys.postProcessingShader = tmp.PostProcessingShader
+	sys.rollbackFrames = Min(15, Max(0, tmp.RollbackFrames))
+	sys.resultsFile = tmp.ResultsFile
+	if f, ok := sys.cmdFlags["-results"]; ok {
+		sys.resultsFile = f
+	}
+	if f, ok := sys.cmdFlags["-profile"]; ok {
+		sys.profiler.enabled, sys.profiler.file = true, f
+	}
+	sys.spectatorDelay = Max(0, tmp.SpectatorDelay)
 	sys.pngFilter = tmp.PngSpriteFilter
 	sys.powerShare = [...]bool{tmp.TeamPowerShare, tmp.TeamPowerShare}
 	tmp.ScreenshotFolder = strings.TrimSpace(tmp.ScreenshotFolder)
@@ -693,7 +791,7 @@ func setupConfig() configSettings {
 			stoki(b[9].(string)), stoki(b[10].(string)), stoki(b[11].(string)),
 			stoki(b[12].(string)), stoki(b[13].(string))})
 	}
-	if _, ok := sys.cmdFlags["-nojoy"]; !ok {
+	if _, ok := sys.cmdFlags["-nojoy"]; !ok && !sys.headless {
 		for _, jc := range tmp.JoystickConfig {
 			b := jc.Buttons
 			sys.joystickConfig = append(sys.joystickConfig, KeyConfig{jc.Joystick,
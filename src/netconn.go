@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// Netplay packets start with netMagic and one of these types. Integers are
+// little endian.
+const netMagic = 'I'
+
+const (
+	NP_Hello   byte = iota + 1 // guest -> host until welcomed
+	NP_Welcome                 // host -> guest
+	NP_Bye                     // connection closed
+	NP_Ctrl                    // first seq uint32, count uint8, int32 values
+	NP_Ack                     // next expected control seq uint32
+	NP_Input                   // session uint32, ack int32, start int32, count uint8, InputBits
+	NP_Ping                    // timestamp int64
+	NP_Pong                    // echoed timestamp int64
+)
+
+const (
+	netTick      = 16 * time.Millisecond
+	netHelloTick = 100 * time.Millisecond
+	netPingTick  = 250 * time.Millisecond
+	netTimeout   = 10 * time.Second
+	netMaxFrames = 32
+)
+
+// NetConn is the UDP connection used by NetInput. Control values such as the
+// random seed go through a small reliable and ordered stream, while input
+// frames are sent unreliably, every packet carrying all the frames the other
+// side has not acknowledged yet, so a lost or late packet is covered by the
+// next one.
+type NetConn struct {
+	conn      *net.UDPConn
+	remote    *net.UDPAddr
+	dialed    bool
+	connected bool
+	mu        sync.Mutex
+	done      chan bool
+	err       error
+	epoch     time.Time
+	lastRecv  time.Time
+	rtt       time.Duration
+	// Reliable control stream
+	ctrlOut  []int32
+	ctrlBase uint32
+	ctrlNext uint32
+	ctrlIn   chan int32
+	// Input frames of the current session
+	session  uint32
+	loc, rem *NetBuffer
+}
+
+func newNetConn(conn *net.UDPConn, remote *net.UDPAddr) *NetConn {
+	nc := &NetConn{conn: conn, remote: remote, dialed: remote != nil, done: make(chan bool),
+		epoch: time.Now(), lastRecv: time.Now(), ctrlIn: make(chan int32, 64)}
+	go nc.receive()
+	go nc.tick()
+	return nc
+}
+
+// Waits on the given port for a guest to say hello
+func ListenNetConn(port string) (*NetConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", ":"+port)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newNetConn(conn, nil), nil
+}
+
+// Says hello to the host until it answers
+func DialNetConn(server, port string) (*NetConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", server+":"+port)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newNetConn(conn, addr), nil
+}
+func (nc *NetConn) Connected() bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.connected && nc.err == nil
+}
+func (nc *NetConn) Err() error {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.err
+}
+
+// Smoothed round trip time, 0 until the first pong
+func (nc *NetConn) RTT() time.Duration {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.rtt
+}
+func (nc *NetConn) Close() {
+	nc.mu.Lock()
+	if nc.connected && nc.err == nil {
+		nc.send([]byte{netMagic, NP_Bye})
+	}
+	nc.fail(Error("Connection closed"))
+	nc.mu.Unlock()
+	nc.conn.Close()
+}
+
+// Has to be called with mu locked
+func (nc *NetConn) fail(err error) {
+	if nc.err == nil {
+		nc.err = err
+		close(nc.done)
+	}
+}
+
+// Has to be called with mu locked
+func (nc *NetConn) send(b []byte) error {
+	if nc.remote == nil {
+		return nil
+	}
+	var err error
+	if nc.dialed {
+		_, err = nc.conn.Write(b)
+	} else {
+		_, err = nc.conn.WriteToUDP(b, nc.remote)
+	}
+	return err
+}
+
+// Queues a value on the reliable stream
+func (nc *NetConn) WriteI32(i32 int32) error {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if nc.err != nil {
+		return nc.err
+	}
+	nc.ctrlOut = append(nc.ctrlOut, i32)
+	nc.sendCtrl()
+	return nil
+}
+
+// Queues several values at once, so that nothing written by another
+// goroutine ends up between them
+func (nc *NetConn) WriteI32s(v ...int32) error {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if nc.err != nil {
+		return nc.err
+	}
+	nc.ctrlOut = append(nc.ctrlOut, v...)
+	nc.sendCtrl()
+	return nil
+}
+
+// Blocks until the next value of the reliable stream arrives or the
+// connection is lost
+func (nc *NetConn) ReadI32() (int32, error) {
+	select {
+	case i32 := <-nc.ctrlIn:
+		return i32, nil
+	case <-nc.done:
+		return 0, nc.Err()
+	}
+}
+
+// Has to be called with mu locked
+func (nc *NetConn) sendCtrl() {
+	if len(nc.ctrlOut) == 0 {
+		return
+	}
+	n := Min(int32(len(nc.ctrlOut)), 255)
+	b := make([]byte, 7, 7+4*n)
+	b[0], b[1] = netMagic, NP_Ctrl
+	binary.LittleEndian.PutUint32(b[2:], nc.ctrlBase)
+	b[6] = byte(n)
+	for _, v := range nc.ctrlOut[:n] {
+		b = appendI32(b, v)
+	}
+	nc.send(b)
+}
+
+// Starts a new input session, after which the input frames of loc are sent
+// and those of the same session received from the other side go to rem.
+// Packets left over from earlier sessions are ignored.
+func (nc *NetConn) Start(loc, rem *NetBuffer) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.session++
+	nc.loc, nc.rem = loc, rem
+}
+
+// Sends every local frame the other side has not acknowledged yet
+func (nc *NetConn) SendInputs() error {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if nc.err != nil {
+		return nc.err
+	}
+	nc.sendInputs()
+	return nil
+}
+
+// Has to be called with mu locked
+func (nc *NetConn) sendInputs() {
+	if nc.loc == nil {
+		return
+	}
+	start, end := nc.loc.ackT, nc.loc.inpT
+	if end-start > netMaxFrames {
+		start = end - netMaxFrames
+	}
+	b := make([]byte, 15, 15+4*(end-start))
+	b[0], b[1] = netMagic, NP_Input
+	binary.LittleEndian.PutUint32(b[2:], nc.session)
+	binary.LittleEndian.PutUint32(b[6:], uint32(nc.rem.inpT))
+	binary.LittleEndian.PutUint32(b[10:], uint32(start))
+	b[14] = byte(end - start)
+	for t := start; t < end; t++ {
+		b = appendI32(b, int32(nc.loc.buf[t&31]))
+	}
+	nc.send(b)
+}
+func appendI32(b []byte, i32 int32) []byte {
+	return append(b, byte(i32), byte(i32>>8), byte(i32>>16), byte(i32>>24))
+}
+func (nc *NetConn) receive() {
+	buf := make([]byte, 2048)
+	for {
+		var n int
+		var addr *net.UDPAddr
+		var err error
+		if nc.dialed {
+			n, err = nc.conn.Read(buf)
+		} else {
+			n, addr, err = nc.conn.ReadFromUDP(buf)
+		}
+		select {
+		case <-nc.done:
+			return
+		default:
+		}
+		// Errors such as an unreachable host before it starts listening
+		// are not fatal, a lost connection is detected by its timeout
+		if err != nil {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if n >= 2 && buf[0] == netMagic {
+			nc.mu.Lock()
+			nc.handle(buf[:n], addr)
+			nc.mu.Unlock()
+		}
+	}
+}
+
+// Has to be called with mu locked
+func (nc *NetConn) handle(b []byte, addr *net.UDPAddr) {
+	if !nc.dialed {
+		if nc.remote == nil {
+			if b[1] != NP_Hello {
+				return
+			}
+			nc.remote = addr
+		} else if !addr.IP.Equal(nc.remote.IP) || addr.Port != nc.remote.Port {
+			return
+		}
+	}
+	nc.lastRecv = time.Now()
+	b, typ := b[2:], b[1]
+	switch typ {
+	case NP_Hello:
+		nc.connected = true
+		nc.send([]byte{netMagic, NP_Welcome})
+	case NP_Welcome:
+		nc.connected = true
+	case NP_Bye:
+		nc.fail(Error("The other player has disconnected"))
+	case NP_Ctrl:
+		if len(b) < 5 || len(b) < 5+4*int(b[4]) {
+			return
+		}
+		seq := binary.LittleEndian.Uint32(b)
+		for i := 0; i < int(b[4]); i, seq = i+1, seq+1 {
+			if seq == nc.ctrlNext {
+				select {
+				case nc.ctrlIn <- int32(binary.LittleEndian.Uint32(b[5+4*i:])):
+					nc.ctrlNext++
+				default:
+				}
+			}
+		}
+		ack := [6]byte{netMagic, NP_Ack}
+		binary.LittleEndian.PutUint32(ack[2:], nc.ctrlNext)
+		nc.send(ack[:])
+	case NP_Ack:
+		if len(b) < 4 {
+			return
+		}
+		if n := binary.LittleEndian.Uint32(b) - nc.ctrlBase; n <= uint32(len(nc.ctrlOut)) {
+			nc.ctrlOut = nc.ctrlOut[n:]
+			nc.ctrlBase += n
+		}
+	case NP_Input:
+		if len(b) < 13 || len(b) < 13+4*int(b[12]) ||
+			nc.rem == nil || binary.LittleEndian.Uint32(b) != nc.session {
+			return
+		}
+		if ack := int32(binary.LittleEndian.Uint32(b[4:])); ack > nc.loc.ackT {
+			nc.loc.ackT = ack
+		}
+		// Frames are taken in order, anything after a gap is sent again
+		// with the next packet
+		start, rem := int32(binary.LittleEndian.Uint32(b[8:])), nc.rem
+		for i := int32(0); i < int32(b[12]); i++ {
+			if start+i == rem.inpT && rem.inpT-rem.curT < 32 {
+				rem.buf[rem.inpT&31] = InputBits(binary.LittleEndian.Uint32(b[13+4*i:]))
+				rem.inpT++
+				rem.senT = rem.inpT
+			}
+		}
+	case NP_Ping:
+		if len(b) >= 8 {
+			nc.send(append([]byte{netMagic, NP_Pong}, b[:8]...))
+		}
+	case NP_Pong:
+		if len(b) >= 8 {
+			sent := time.Duration(binary.LittleEndian.Uint64(b))
+			sample := time.Since(nc.epoch) - sent
+			if nc.rtt == 0 {
+				nc.rtt = sample
+			} else {
+				nc.rtt += (sample - nc.rtt) / 8
+			}
+		}
+	}
+}
+
+// Resends whatever may have been lost, measures the round trip time and
+// gives up on a peer that has gone silent
+func (nc *NetConn) tick() {
+	var hello, ping time.Time
+	for {
+		select {
+		case <-nc.done:
+			return
+		case <-time.After(netTick):
+		}
+		nc.mu.Lock()
+		now := time.Now()
+		if !nc.connected {
+			if nc.dialed && now.Sub(hello) >= netHelloTick {
+				nc.send([]byte{netMagic, NP_Hello})
+				hello = now
+			}
+			nc.lastRecv = now
+		} else if now.Sub(nc.lastRecv) > netTimeout {
+			nc.fail(Error("Connection timed out"))
+		} else {
+			nc.sendCtrl()
+			nc.sendInputs()
+			if now.Sub(ping) >= netPingTick {
+				b := [10]byte{netMagic, NP_Ping}
+				binary.LittleEndian.PutUint64(b[2:], uint64(time.Since(nc.epoch)))
+				nc.send(b[:])
+				ping = now
+			}
+		}
+		nc.mu.Unlock()
+	}
+}
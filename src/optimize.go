@@ -0,0 +1,617 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"unsafe"
+)
+
+// Cached value of const(name) or stageconst(name), which only changes when a
+// character or a stage is loaded
+type constCacheEntry struct {
+	gen   uint32
+	pn    int
+	v     float32
+	stage *Stage
+	sv    float32
+}
+
+func (c *Char) cachedConst(idx int32, stage bool) float32 {
+	pn := sys.workingState.playerNo
+	sp := &sys.stringPool[pn]
+	if int(idx) >= len(sys.constCache[pn]) {
+		if int(idx) >= len(sp.List) {
+			return 0
+		}
+		cc := make([]constCacheEntry, len(sp.List))
+		copy(cc, sys.constCache[pn])
+		sys.constCache[pn] = cc
+	}
+	e := &sys.constCache[pn][idx]
+	if stage {
+		if e.stage != sys.stage {
+			e.stage, e.sv = sys.stage, sys.stage.constants[sp.List[idx]]
+		}
+		return e.sv
+	}
+	if e.gen != sys.constGen || e.pn != c.playerNo {
+		e.gen, e.pn, e.v = sys.constGen, c.playerNo, c.gi().constants[sp.List[idx]]
+	}
+	return e.v
+}
+
+// Size in bytes of the instruction at be[i], or 0 if it is cut short
+func (be BytecodeExp) instrLen(i int) int {
+	if i >= len(be) {
+		return 0
+	}
+	n := 1
+	switch be[i] {
+	case OC_jsf8, OC_jmp8, OC_jz8, OC_jnz8, OC_int8, OC_localvar,
+		OC_movetype, OC_statetype, OC_teammode, OC_st_:
+		n = 2
+	case OC_jmp, OC_jz, OC_jnz, OC_int, OC_float, OC_command, OC_hitdefattr,
+		OC_parent, OC_root, OC_helper, OC_target, OC_partner, OC_enemy,
+		OC_enemynear, OC_playerid, OC_p2:
+		n = 5
+	case OC_run, OC_nordrun:
+		if i+5 > len(be) {
+			return 0
+		}
+		n = 5 + int(*(*int32)(unsafe.Pointer(&be[i+1])))
+	case OC_const_:
+		if i+1 >= len(be) {
+			return 0
+		}
+		switch be[i+1] {
+		case OC_const_authorname, OC_const_name, OC_const_p2name,
+			OC_const_p3name, OC_const_p4name, OC_const_p5name, OC_const_p6name,
+			OC_const_p7name, OC_const_p8name, OC_const_stagevar_info_author,
+			OC_const_stagevar_info_displayname, OC_const_stagevar_info_name,
+			OC_const_constants, OC_const_stage_constants,
+			OC_const_constants_cached, OC_const_stage_constants_cached:
+			n = 6
+		default:
+			n = 2
+		}
+	case OC_ex_:
+		if i+1 >= len(be) {
+			return 0
+		}
+		switch be[i+1] {
+		case OC_ex_gamemode, OC_ex_helpername, OC_ex_isassertedchar,
+			OC_ex_isassertedglobal, OC_ex_maparray, OC_ex_string, OC_ex_array:
+			n = 6
+		case OC_ex_physics, OC_ex_st_index:
+			n = 3
+		default:
+			n = 2
+		}
+	}
+	if n < 1 || i+n > len(be) {
+		return 0
+	}
+	return n
+}
+
+func isJump8(op OpCode) bool {
+	return op == OC_jsf8 || op == OC_jmp8 || op == OC_jz8 || op == OC_jnz8
+}
+func isJump32(op OpCode) bool {
+	return op == OC_jmp || op == OC_jz || op == OC_jnz
+}
+func isRedirect(op OpCode) bool {
+	switch op {
+	case OC_parent, OC_root, OC_helper, OC_target, OC_partner, OC_enemy,
+		OC_enemynear, OC_playerid, OC_p2:
+		return true
+	}
+	return false
+}
+
+// An instruction of a decoded BytecodeExp. Jumps and redirects refer to the
+// instruction they go to by index, the number of instructions being the end.
+type bcInstr struct {
+	code   BytecodeExp // without the offset of a jump or the length of a run
+	jump   bool
+	target int
+	body   BytecodeExp // of OC_run and OC_nordrun
+}
+
+func (in *bcInstr) op() OpCode {
+	return in.code[0]
+}
+func (in *bcInstr) size() int {
+	switch {
+	case isJump8(in.op()):
+		return 2
+	case in.jump:
+		return 5
+	case in.op() == OC_run || in.op() == OC_nordrun:
+		return 5 + len(in.body)
+	}
+	return len(in.code)
+}
+func (in *bcInstr) value() (BytecodeValue, bool) {
+	switch in.op() {
+	case OC_int8:
+		return BytecodeInt(int32(int8(in.code[1]))), true
+	case OC_int:
+		return BytecodeInt(*(*int32)(unsafe.Pointer(&in.code[1]))), true
+	case OC_float:
+		return BytecodeFloat(*(*float32)(unsafe.Pointer(&in.code[1]))), true
+	}
+	return BytecodeSF(), false
+}
+
+func decodeExp(be BytecodeExp) ([]bcInstr, bool) {
+	var ins []bcInstr
+	index := make(map[int]int)
+	for i := 0; i < len(be); {
+		n := be.instrLen(i)
+		if n == 0 {
+			return nil, false
+		}
+		index[i] = len(ins)
+		in := bcInstr{code: be[i : i+n]}
+		switch op := be[i]; {
+		case isJump8(op):
+			in.code, in.jump, in.target = be[i:i+1], true, len(be)
+			if be[i+1] != 0 {
+				in.target = i + n + int(uint8(be[i+1]))
+			}
+		case isJump32(op) || isRedirect(op):
+			in.code, in.jump = be[i:i+1], true
+			in.target = i + n + int(*(*int32)(unsafe.Pointer(&be[i+1])))
+		case op == OC_run || op == OC_nordrun:
+			in.code, in.body = be[i:i+1], be[i+5:i+n]
+		}
+		ins = append(ins, in)
+		i += n
+	}
+	index[len(be)] = len(ins)
+	for k := range ins {
+		if ins[k].jump {
+			t, ok := index[ins[k].target]
+			if !ok {
+				return nil, false
+			}
+			ins[k].target = t
+		}
+	}
+	return ins, true
+}
+
+// Returns false if an 8 bit jump cannot reach its target anymore
+func encodeExp(ins []bcInstr) (BytecodeExp, bool) {
+	pos := make([]int, len(ins)+1)
+	for k := range ins {
+		pos[k+1] = pos[k] + ins[k].size()
+	}
+	be := make(BytecodeExp, 0, pos[len(ins)])
+	for k := range ins {
+		in := &ins[k]
+		be.append(in.code...)
+		switch {
+		case isJump8(in.op()):
+			off := pos[in.target] - pos[k+1]
+			if in.target == len(ins) {
+				off = 0
+			} else if off <= 0 || off > 255 {
+				return nil, false
+			}
+			be.append(OpCode(off))
+		case in.jump:
+			off := int32(pos[in.target] - pos[k+1])
+			be.append((*(*[4]OpCode)(unsafe.Pointer(&off)))[:]...)
+		case in.op() == OC_run || in.op() == OC_nordrun:
+			l := int32(len(in.body))
+			be.append((*(*[4]OpCode)(unsafe.Pointer(&l)))[:]...)
+			be.append(in.body...)
+		}
+	}
+	return be, true
+}
+
+func jumpTargets(ins []bcInstr) []bool {
+	t := make([]bool, len(ins)+1)
+	for _, in := range ins {
+		if in.jump {
+			t[in.target] = true
+		}
+	}
+	return t
+}
+
+// Whether the instruction runs on the char of the redirect just before it,
+// so that it must stay right after it
+func attached(ins []bcInstr, k int) bool {
+	return k > 0 && (isRedirect(ins[k-1].op()) || ins[k-1].op() == OC_nordrun)
+}
+
+func constAt(ins []bcInstr, k int) (BytecodeValue, bool) {
+	if k >= len(ins) || attached(ins, k) {
+		return BytecodeSF(), false
+	}
+	return ins[k].value()
+}
+
+// Removes n instructions from k, jumps into them going to what follows
+func removeInstrs(ins []bcInstr, k, n int) []bcInstr {
+	ins = append(ins[:k], ins[k+n:]...)
+	for i := range ins {
+		if ins[i].jump {
+			if ins[i].target >= k+n {
+				ins[i].target -= n
+			} else if ins[i].target > k {
+				ins[i].target = k
+			}
+		}
+	}
+	return ins
+}
+
+func replaceWithValue(ins []bcInstr, k, n int, v BytecodeValue) []bcInstr {
+	var be BytecodeExp
+	be.appendValue(v)
+	ins[k] = bcInstr{code: be}
+	return removeInstrs(ins, k+1, n-1)
+}
+
+func foldUnary(op OpCode, v BytecodeValue) (BytecodeValue, bool) {
+	var be BytecodeExp
+	switch op {
+	case OC_neg:
+		be.neg(&v)
+	case OC_not:
+		be.not(&v)
+	case OC_blnot:
+		be.blnot(&v)
+	case OC_abs:
+		be.abs(&v)
+	case OC_exp:
+		be.exp(&v)
+	case OC_ln:
+		be.ln(&v)
+	case OC_cos:
+		be.cos(&v)
+	case OC_sin:
+		be.sin(&v)
+	case OC_tan:
+		be.tan(&v)
+	case OC_acos:
+		be.acos(&v)
+	case OC_asin:
+		be.asin(&v)
+	case OC_atan:
+		be.atan(&v)
+	case OC_floor:
+		be.floor(&v)
+	case OC_ceil:
+		be.ceil(&v)
+	default:
+		return v, false
+	}
+	return v, !v.IsSF()
+}
+
+func foldBinary(op OpCode, v1, v2 BytecodeValue) (BytecodeValue, bool) {
+	var be BytecodeExp
+	switch op {
+	case OC_mul:
+		be.mul(&v1, v2)
+	case OC_div:
+		be.div(&v1, v2)
+	case OC_mod:
+		be.mod(&v1, v2)
+	case OC_add:
+		be.add(&v1, v2)
+	case OC_sub:
+		be.sub(&v1, v2)
+	case OC_gt:
+		be.gt(&v1, v2)
+	case OC_ge:
+		be.ge(&v1, v2)
+	case OC_lt:
+		be.lt(&v1, v2)
+	case OC_le:
+		be.le(&v1, v2)
+	case OC_eq:
+		be.eq(&v1, v2)
+	case OC_ne:
+		be.ne(&v1, v2)
+	case OC_and:
+		be.and(&v1, v2)
+	case OC_xor:
+		be.xor(&v1, v2)
+	case OC_or:
+		be.or(&v1, v2)
+	case OC_bland:
+		be.bland(&v1, v2)
+	case OC_blxor:
+		be.blxor(&v1, v2)
+	case OC_blor:
+		be.blor(&v1, v2)
+	case OC_log:
+		be.log(&v1, v2)
+	default:
+		return v1, false
+	}
+	return v1, !v1.IsSF()
+}
+
+// Evaluates operators whose operands are all constants
+func foldConsts(ins []bcInstr) ([]bcInstr, bool) {
+	t := jumpTargets(ins)
+	for k := range ins {
+		v1, ok := constAt(ins, k)
+		if !ok {
+			continue
+		}
+		if k+1 < len(ins) && !t[k+1] {
+			if v, ok := foldUnary(ins[k+1].op(), v1); ok {
+				return replaceWithValue(ins, k, 2, v), true
+			}
+		}
+		if k+2 >= len(ins) || t[k+1] || t[k+2] {
+			continue
+		}
+		v2, ok := constAt(ins, k+1)
+		if !ok {
+			continue
+		}
+		if v, ok := foldBinary(ins[k+2].op(), v1, v2); ok {
+			return replaceWithValue(ins, k, 3, v), true
+		}
+		if k+3 < len(ins) && !t[k+3] && ins[k+3].op() == OC_ifelse {
+			if v3, ok := constAt(ins, k+2); ok {
+				if v1.ToB() {
+					v3 = v2
+				}
+				return replaceWithValue(ins, k, 4, v3), true
+			}
+		}
+	}
+	return ins, false
+}
+
+// Resolves conditional jumps on constants and drops constants that are
+// popped right away
+func constJumps(ins []bcInstr) ([]bcInstr, bool) {
+	t := jumpTargets(ins)
+	for k := 0; k+1 < len(ins); k++ {
+		v, ok := constAt(ins, k)
+		if !ok || t[k+1] {
+			continue
+		}
+		next := &ins[k+1]
+		var taken bool
+		switch next.op() {
+		case OC_pop:
+			return removeInstrs(ins, k, 2), true
+		case OC_jsf8:
+			taken = v.IsSF()
+		case OC_jz8, OC_jz:
+			taken = !v.ToB()
+		case OC_jnz8, OC_jnz:
+			taken = v.ToB()
+		default:
+			continue
+		}
+		if !taken {
+			return removeInstrs(ins, k+1, 1), true
+		}
+		if isJump8(next.op()) {
+			next.code = BytecodeExp{OC_jmp8}
+		} else {
+			next.code = BytecodeExp{OC_jmp}
+		}
+		return ins, true
+	}
+	return ins, false
+}
+
+// Removes unreachable instructions and jumps to the next instruction
+func removeDeadCode(ins []bcInstr) ([]bcInstr, bool) {
+	reach := make([]bool, len(ins))
+	todo := []int{0}
+	for len(todo) > 0 {
+		k := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if k >= len(ins) || reach[k] {
+			continue
+		}
+		reach[k] = true
+		if ins[k].jump {
+			todo = append(todo, ins[k].target)
+		}
+		if op := ins[k].op(); op != OC_jmp8 && op != OC_jmp {
+			todo = append(todo, k+1)
+		}
+	}
+	for k := len(ins) - 1; k >= 0; k-- {
+		if !reach[k] {
+			n := 1
+			for k > 0 && !reach[k-1] {
+				k--
+				n++
+			}
+			return removeInstrs(ins, k, n), true
+		}
+	}
+	for k := range ins {
+		if ins[k].jump && !isRedirect(ins[k].op()) && ins[k].target == k+1 &&
+			!attached(ins, k) {
+			return removeInstrs(ins, k, 1), true
+		}
+	}
+	return ins, false
+}
+
+// Optimizes an expression, leaving it as it is if it cannot be decoded or
+// encoded again
+func optimizeExp(be BytecodeExp) BytecodeExp {
+	ins, ok := decodeExp(be)
+	if !ok {
+		return be
+	}
+	for k := range ins {
+		in := &ins[k]
+		switch in.op() {
+		case OC_run, OC_nordrun:
+			in.body = optimizeExp(in.body)
+		case OC_const_:
+			// const and stageconst lookups by name are cached per string
+			switch in.code[1] {
+			case OC_const_constants:
+				in.code = append(BytecodeExp{OC_const_, OC_const_constants_cached},
+					in.code[2:]...)
+			case OC_const_stage_constants:
+				in.code = append(BytecodeExp{OC_const_,
+					OC_const_stage_constants_cached}, in.code[2:]...)
+			}
+		}
+	}
+	for changed := true; changed; {
+		if ins, changed = foldConsts(ins); changed {
+			continue
+		}
+		if ins, changed = constJumps(ins); changed {
+			continue
+		}
+		ins, changed = removeDeadCode(ins)
+	}
+	if opt, ok := encodeExp(ins); ok && len(opt) <= len(be) {
+		return opt
+	}
+	return be
+}
+
+func sameExp(a, b BytecodeExp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+func constValue(be BytecodeExp) (BytecodeValue, bool) {
+	if ins, ok := decodeExp(be); ok && len(ins) == 1 {
+		return ins[0].value()
+	}
+	return BytecodeSF(), false
+}
+
+type bytecodeOptimizer struct {
+	dump *disassembler
+}
+
+func (o *bytecodeOptimizer) exp(be BytecodeExp, where string) BytecodeExp {
+	opt := optimizeExp(be)
+	if o.dump != nil && !sameExp(be, opt) {
+		o.dump.line(0, "%v", where)
+		o.dump.line(1, "before:")
+		o.dump.exp(be, 2)
+		o.dump.line(1, "after:")
+		o.dump.exp(opt, 2)
+	}
+	return opt
+}
+
+// Returns false if the block never runs anything
+func (o *bytecodeOptimizer) block(b *StateBlock, where string) bool {
+	if len(b.trigger) > 0 {
+		b.trigger = o.exp(b.trigger, where+" trigger")
+	}
+	if b.forLoop {
+		for i, e := range b.forExp {
+			if len(e) > 0 {
+				b.forExp[i] = o.exp(e, fmt.Sprintf("%v for %v", where, i+1))
+			}
+		}
+	}
+	b.ctrls = o.ctrls(b.ctrls, where)
+	if b.elseBlock != nil {
+		eb := *b.elseBlock
+		if o.block(&eb, where+" else") {
+			b.elseBlock = &eb
+		} else {
+			b.elseBlock = nil
+		}
+	}
+	if !b.loop && len(b.trigger) > 0 {
+		if v, ok := constValue(b.trigger); ok {
+			if v.ToB() {
+				b.trigger, b.elseBlock = nil, nil
+			} else if b.elseBlock == nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (o *bytecodeOptimizer) ctrls(ctrls []StateController,
+	where string) []StateController {
+	var out []StateController
+	for i, sc := range ctrls {
+		w := fmt.Sprintf("%v ctrl %v", where, i+1)
+		switch sc := sc.(type) {
+		case StateBlock:
+			if !o.block(&sc, w) {
+				continue
+			}
+			out = append(out, sc)
+		case varAssign:
+			sc.be = o.exp(sc.be, w)
+			out = append(out, sc)
+		case callFunction:
+			if len(sc.arg) > 0 {
+				sc.arg = o.exp(sc.arg, w)
+			}
+			out = append(out, sc)
+		case StateExpr:
+			out = append(out, StateExpr(o.exp(BytecodeExp(sc), w)))
+		default:
+			out = append(out, sc)
+		}
+	}
+	return out
+}
+
+// Optimizes the expressions of the compiled states and functions. Controller
+// parameters are left as they are, since some of them are not bytecode.
+func (c *Compiler) optimize(states map[int32]StateBytecode, def string) {
+	o := &bytecodeOptimizer{}
+	if sys.bytecodeDump != nil {
+		o.dump = &disassembler{w: sys.bytecodeDump, pn: c.playerNo}
+		o.dump.line(0, "== %v", def)
+	}
+	names := make([]string, 0, len(c.funcs))
+	for name := range c.funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// Calls share the controllers of the function, so they are replaced
+		// in place, with what is removed becoming null controllers
+		ctrls := c.funcs[name].ctrls
+		n := copy(ctrls, o.ctrls(ctrls, "function "+name))
+		for i := n; i < len(ctrls); i++ {
+			ctrls[i] = nullStateController
+		}
+	}
+	nos := make([]int, 0, len(states))
+	for no := range states {
+		nos = append(nos, int(no))
+	}
+	sort.Ints(nos)
+	for _, no := range nos {
+		sb := states[int32(no)]
+		o.block(&sb.block, fmt.Sprintf("state %v", no))
+		states[int32(no)] = sb
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import "testing"
+
+// Expressions whose optimized bytecode must give the same results as the
+// bytecode the compiler made, for every value of var(0) and var(1) tried.
+// The compiler already folds constants, so most of the work is left to the
+// optimizer by the jumps of && and ||, cond and ifelse.
+var optimizeExpTests = []struct {
+	exp     string
+	shorter bool
+}{
+	{"1 + 2 * 3", false},
+	{"var(0) + 2 * 3", false},
+	{"1 || var(0)", true},
+	{"0 && var(0)", true},
+	{"var(0) && 0", false},
+	{"var(0) || 1", false},
+	{"0 || 0 || var(1)", true},
+	{"1 && 1 && var(1)", true},
+	{"cond(0, var(0), var(1))", true},
+	{"cond(1, var(0), var(1))", true},
+	{"cond(var(0), var(0) + 1, var(1))", false},
+	{"ifelse(1, var(0), var(1))", false},
+	{"ifelse(var(0), 1 + 1, 2)", false},
+	{"var(0) = 1 || var(1) = 2", false},
+	{"!(1 && 0) + var(0)", false},
+	{"(0 || var(0)) * (1 && var(1))", true},
+	{"floor(var(0) / 2.0) + ceil(1.5)", false},
+	{"var(0) / 0", false},
+	{"var(1) % (1 || var(0))", true},
+}
+
+// Whether two results are the same, the value of a SFalse not counting.
+// Folded bools become ints, as they do when the compiler folds them.
+func sameValue(a, b BytecodeValue) bool {
+	vt := func(v BytecodeValue) ValueType {
+		if v.t == VT_Bool {
+			return VT_Int
+		}
+		return v.t
+	}
+	return vt(a) == vt(b) && (a.v == b.v || a.IsSF())
+}
+
+func TestOptimizeExp(t *testing.T) {
+	c := newChar(0, 0)
+	for _, tt := range optimizeExpTests {
+		in := tt.exp
+		be, err := newCompiler().fullExpression(&in, VT_SFalse)
+		if err != nil {
+			t.Errorf("%v: %v", tt.exp, err)
+			continue
+		}
+		opt := optimizeExp(be)
+		if shorter := len(opt) < len(be); shorter != tt.shorter {
+			t.Errorf("%v: optimized from %v to %v bytes", tt.exp, len(be), len(opt))
+		}
+		for _, v := range [][2]int32{{0, 0}, {1, 0}, {0, 1}, {-2, 5}, {3, -7}} {
+			c.ivar[0], c.ivar[1] = v[0], v[1]
+			want, got := be.run(c), opt.run(c)
+			if !sameValue(got, want) {
+				t.Errorf("%v with var(0) = %v, var(1) = %v: %v, optimized %v",
+					tt.exp, v[0], v[1], want, got)
+			}
+		}
+	}
+}
+
+// Bytecode the compiler does not make, as it folds constants itself
+func TestOptimizeExpFold(t *testing.T) {
+	exp := func(code ...interface{}) (be BytecodeExp) {
+		for _, x := range code {
+			switch x := x.(type) {
+			case BytecodeValue:
+				be.appendValue(x)
+			case OpCode:
+				be.append(x)
+			}
+		}
+		return
+	}
+	for _, tt := range []struct {
+		be   BytecodeExp
+		want BytecodeValue
+	}{
+		{exp(BytecodeInt(1), BytecodeInt(2), OC_add), BytecodeInt(3)},
+		{exp(BytecodeInt(7), BytecodeInt(2), OC_div), BytecodeInt(3)},
+		{exp(BytecodeFloat(1.5), BytecodeInt(2), OC_mul), BytecodeFloat(3)},
+		{exp(BytecodeInt(5), OC_neg, BytecodeInt(1), OC_sub), BytecodeInt(-6)},
+		{exp(BytecodeInt(0), BytecodeInt(4), BytecodeInt(9), OC_ifelse),
+			BytecodeInt(9)},
+		{exp(BytecodeInt(3), BytecodeInt(3), OC_eq, OC_blnot), BytecodeInt(0)},
+	} {
+		opt := optimizeExp(tt.be)
+		v, ok := constValue(opt)
+		if !ok {
+			t.Errorf("%v: not folded, optimized to %v", tt.be, opt)
+			continue
+		}
+		if got := tt.be.run(nil); !sameValue(got, v) {
+			t.Errorf("%v: %v, folded to %v", tt.be, got, v)
+		}
+		if !sameValue(v, tt.want) {
+			t.Errorf("%v: folded to %v, want %v", tt.be, v, tt.want)
+		}
+	}
+}
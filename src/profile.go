@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Profiler records how long the states and state controllers of every
+// character take to run. It is only enabled with -profile, and appends a
+// report of every match to that file as one line of JSON.
+type Profiler struct {
+	enabled bool
+	file    string
+	frames  int64
+	states  map[profileStateKey]*profileEntry
+	ctrls   map[profileCtrlKey]*profileCtrl
+	stack   []profileFrame
+	lines   []string
+	linesAt int64
+}
+
+// Frames between rebuilds of the overlay, which sorts everything recorded
+const profileOverlayFrames = 30
+
+type profileStateKey struct {
+	def string
+	no  int32
+}
+
+type profileCtrlKey struct {
+	slot  *StateController
+	state profileStateKey
+}
+
+type profileEntry struct {
+	calls int64
+	time  time.Duration
+}
+
+type profileCtrl struct {
+	profileEntry
+	index int
+	typ   string
+}
+
+// A state being run, along with the time spent in the states nested in it
+// by a ChangeState, which is not counted as its own
+type profileFrame struct {
+	key    profileStateKey
+	nested time.Duration
+}
+
+type ProfileReport struct {
+	Version string        `json:"version"`
+	Date    string        `json:"date"`
+	Frames  int64         `json:"frames"`
+	Chars   []ProfileChar `json:"chars"`
+}
+
+type ProfileChar struct {
+	Def    string         `json:"def"`
+	Calls  int64          `json:"calls"`
+	TimeUs float64        `json:"time_us"`
+	States []ProfileState `json:"states"`
+}
+
+type ProfileState struct {
+	State  int32         `json:"state"`
+	Calls  int64         `json:"calls"`
+	TimeUs float64       `json:"time_us"`
+	Ctrls  []ProfileCtrl `json:"ctrls"`
+}
+
+type ProfileCtrl struct {
+	Index  int     `json:"index"`
+	Type   string  `json:"type"`
+	Calls  int64   `json:"calls"`
+	TimeUs float64 `json:"time_us"`
+}
+
+func microseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+// Clears what has been recorded so far, at the start of a match
+func (p *Profiler) reset() {
+	p.frames = 0
+	p.states, p.ctrls = nil, nil
+	p.lines, p.linesAt = nil, 0
+}
+
+// Called before a state of the code of player pn is run by c
+func (p *Profiler) beginState(c *Char, pn int) time.Time {
+	key := profileStateKey{def: sys.cgi[pn].def, no: c.ss.no}
+	if c.minus != 0 {
+		key.no = int32(c.minus)
+	}
+	p.stack = append(p.stack, profileFrame{key: key})
+	return time.Now()
+}
+func (p *Profiler) endState(start time.Time) {
+	total := time.Since(start)
+	n := len(p.stack) - 1
+	f := p.stack[n]
+	p.stack = p.stack[:n]
+	if n > 0 {
+		p.stack[n-1].nested += total
+	}
+	if p.states == nil {
+		p.states = make(map[profileStateKey]*profileEntry)
+	}
+	e := p.states[f.key]
+	if e == nil {
+		e = &profileEntry{}
+		p.states[f.key] = e
+	}
+	e.calls++
+	e.time += total - f.nested
+}
+
+// Runs the controller in slot, the index-th of its block, timing it if the
+// profiler is on. The time of a controller includes any state it changes to.
+// Blocks are not timed, as their controllers already are.
+func (p *Profiler) runCtrl(c *Char, slot *StateController, index int,
+	ps []int32) bool {
+	sc := *slot
+	if !p.enabled || len(p.stack) == 0 {
+		return sc.Run(c, ps)
+	}
+	if _, ok := sc.(StateBlock); ok {
+		return sc.Run(c, ps)
+	}
+	start := time.Now()
+	changeState := sc.Run(c, ps)
+	d := time.Since(start)
+	key := profileCtrlKey{slot: slot, state: p.stack[len(p.stack)-1].key}
+	if p.ctrls == nil {
+		p.ctrls = make(map[profileCtrlKey]*profileCtrl)
+	}
+	e := p.ctrls[key]
+	if e == nil {
+		e = &profileCtrl{index: index,
+			typ: strings.TrimPrefix(fmt.Sprintf("%T", sc), "main.")}
+		p.ctrls[key] = e
+	}
+	e.calls++
+	e.time += d
+	return changeState
+}
+
+// Builds the report of what has been recorded, with characters, states and
+// controllers sorted from the slowest
+func (p *Profiler) report() *ProfileReport {
+	r := &ProfileReport{Version: Version, Frames: p.frames}
+	chars := make(map[string]*ProfileChar)
+	states := make(map[profileStateKey]*ProfileState)
+	for k, e := range p.states {
+		pc := chars[k.def]
+		if pc == nil {
+			pc = &ProfileChar{Def: k.def}
+			chars[k.def] = pc
+		}
+		pc.Calls += e.calls
+		pc.TimeUs += microseconds(e.time)
+		states[k] = &ProfileState{State: k.no, Calls: e.calls,
+			TimeUs: microseconds(e.time)}
+	}
+	for k, e := range p.ctrls {
+		if ps := states[k.state]; ps != nil {
+			ps.Ctrls = append(ps.Ctrls, ProfileCtrl{Index: e.index, Type: e.typ,
+				Calls: e.calls, TimeUs: microseconds(e.time)})
+		}
+	}
+	for k, ps := range states {
+		sort.Slice(ps.Ctrls, func(i, j int) bool {
+			return ps.Ctrls[i].TimeUs > ps.Ctrls[j].TimeUs
+		})
+		chars[k.def].States = append(chars[k.def].States, *ps)
+	}
+	for _, pc := range chars {
+		sort.Slice(pc.States, func(i, j int) bool {
+			return pc.States[i].TimeUs > pc.States[j].TimeUs
+		})
+		r.Chars = append(r.Chars, *pc)
+	}
+	sort.Slice(r.Chars, func(i, j int) bool {
+		return r.Chars[i].TimeUs > r.Chars[j].TimeUs
+	})
+	return r
+}
+
+// The lines shown in the debug overlay, the time per frame of every
+// character followed by the slowest states. They are kept for
+// profileOverlayFrames frames before being built again.
+func (p *Profiler) overlay(maxStates int) []string {
+	if !p.enabled || p.frames == 0 {
+		return nil
+	}
+	if p.lines != nil && p.frames-p.linesAt < profileOverlayFrames {
+		return p.lines
+	}
+	p.linesAt = p.frames
+	r := p.report()
+	perFrame := func(us float64) float64 { return us / 1000 / float64(r.Frames) }
+	lines := []string{fmt.Sprintf("Profile: %d frames", r.Frames)}
+	var slowest []ProfileState
+	var defs []string
+	for _, pc := range r.Chars {
+		lines = append(lines, fmt.Sprintf("%s: %.3fms/frame", pc.Def,
+			perFrame(pc.TimeUs)))
+		for _, ps := range pc.States {
+			slowest = append(slowest, ps)
+			defs = append(defs, pc.Def)
+		}
+	}
+	idx := make([]int, len(slowest))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool {
+		return slowest[idx[i]].TimeUs > slowest[idx[j]].TimeUs
+	})
+	for n, i := range idx {
+		if n >= maxStates {
+			break
+		}
+		ps := slowest[i]
+		line := fmt.Sprintf("  %s %d: %.3fms/frame %d runs", filepath.Base(defs[i]),
+			ps.State, perFrame(ps.TimeUs), ps.Calls)
+		if len(ps.Ctrls) > 0 {
+			line += fmt.Sprintf(", %s #%d %.3fms/frame", ps.Ctrls[0].Type,
+				ps.Ctrls[0].Index, perFrame(ps.Ctrls[0].TimeUs))
+		}
+		lines = append(lines, line)
+	}
+	p.lines = lines
+	return lines
+}
+
+// Appends the report of the match that has just ended to the profile file
+func (p *Profiler) write() {
+	if !p.enabled || p.states == nil {
+		return
+	}
+	r := p.report()
+	r.Date = time.Now().Format(time.RFC3339)
+	b, err := json.Marshal(r)
+	if err == nil {
+		if dir := filepath.Dir(p.file); dir != "." {
+			os.MkdirAll(dir, 0755)
+		}
+		var f *os.File
+		if f, err = os.OpenFile(p.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+			_, err = f.Write(append(b, '\n'))
+			f.Close()
+		}
+	}
+	if err != nil {
+		sys.errLog.Println(err.Error())
+	}
+	p.reset()
+}
@@ -623,6 +623,9 @@ func RenderMugenPal(tex Texture, mask int32, size [2]uint16,
 func RenderMugen(tex Texture, pal []uint32, mask int32, size [2]uint16,
 	x, y float32, tile *[4]int32, xts, xbs, ys, vs, rxadd, agl, yagl, xagl float32,
 	trans int32, window *[4]int32, rcx, rcy float32) {
+	if sys.headless {
+		return
+	}
 	gl.Enable(gl.TEXTURE_1D)
 	gl.ActiveTexture(gl.TEXTURE1)
 	var paltex uint32
@@ -689,6 +692,9 @@ func RenderMugenFcS(tex Texture, size [2]uint16, x, y float32,
 	gl.Disable(gl.BLEND)
 }
 func FillRect(rect [4]int32, color uint32, trans int32) {
+	if sys.headless {
+		return
+	}
 	r := float32(color>>16&0xff) / 255
 	g := float32(color>>8&0xff) / 255
 	b := float32(color&0xff) / 255
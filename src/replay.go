@@ -0,0 +1,459 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// Replay files start with replayMagic and the format number, followed by a
+// JSON ReplayHeader. Every synchronization then writes a JSON ReplayMatch,
+// the random seed and the InputBits of each frame. Files without the magic
+// are raw seed and InputBits streams from older versions.
+const (
+	replayMagic  = "IKEMENRP"
+	replayFormat = 1
+)
+
+// Engine version, set at build time with -ldflags "-X main.Version=..."
+var Version = "development"
+
+type ReplayHeader struct {
+	Format  uint32 `json:"format"`
+	Version string `json:"version"`
+}
+
+type ReplayDef struct {
+	Def  string `json:"def"`
+	Hash string `json:"hash"`
+}
+
+type ReplayChar struct {
+	ReplayDef
+	Player int     `json:"player"`
+	Pal    int32   `json:"pal"`
+	Com    float32 `json:"com"`
+	// Set when an AiController played, whose recorded keys are played back
+	AiKeys bool `json:"aikeys,omitempty"`
+}
+
+// Everything that has to match for the recorded inputs to play back the same
+type ReplayMatch struct {
+	Chars    []ReplayChar   `json:"chars"`
+	Stage    ReplayDef      `json:"stage"`
+	Settings ReplaySettings `json:"settings"`
+}
+
+// Team modes, round settings and the config values that affect simulation
+type ReplaySettings struct {
+	TeamMode    [2]TeamMode `json:"teammode"`
+	NumSimul    [2]int32    `json:"numsimul"`
+	NumTurns    [2]int32    `json:"numturns"`
+	MatchWins   [2]int32    `json:"matchwins"`
+	RoundTime   int32       `json:"roundtime"`
+	LifeMul     float32     `json:"lifemul"`
+	Team1VS2    float32     `json:"team1vs2life"`
+	TurnsRecov  float32     `json:"turnsrecoveryrate"`
+	LifeShare   [2]bool     `json:"lifeshare"`
+	PowerShare  [2]bool     `json:"powershare"`
+	LoseSimul   bool        `json:"losesimul"`
+	LoseTag     bool        `json:"losetag"`
+	ComboWindow int32       `json:"comboextraframewindow"`
+	HelperMax   int32       `json:"helpermax"`
+	ProjMax     int         `json:"playerprojectilemax"`
+	ExplodMax   int         `json:"explodmax"`
+}
+
+// Hashes of the files referenced by each def, since hashing sprites and
+// music again on every synchronization is slow
+var replayHashes = make(map[string]string)
+
+// Hashes the given def file along with the files it references: the [Files]
+// of a character and the common files every character loads, or the sprites
+// and music of a stage
+func replayHash(def string) string {
+	if def == "" {
+		return ""
+	}
+	if hash, ok := replayHashes[def]; ok {
+		return hash
+	}
+	h := sha1.New()
+	str, err := LoadText(def)
+	if err != nil {
+		return ""
+	}
+	io.WriteString(h, str)
+	var files, common []string
+	lines, i := SplitAndTrim(str, "\n"), 0
+	for i < len(lines) {
+		is, name, _ := ReadIniSection(lines, &i)
+		switch name {
+		case "files":
+			for _, f := range is {
+				files = append(files, f)
+			}
+			common = append([]string{sys.commonConst}, sys.commonStates...)
+			io.WriteString(h, sys.commonCmd)
+			io.WriteString(h, sys.commonAir)
+		case "bgdef":
+			files = append(files, is["spr"])
+		case "music":
+			for k, f := range is {
+				if strings.HasPrefix(k, "bgmusic") {
+					files = append(files, f)
+				}
+			}
+		}
+	}
+	sort.Strings(files)
+	for _, f := range append(files, common...) {
+		if f == "" {
+			continue
+		}
+		if b, err := ioutil.ReadFile(SearchFile(f, def, true)); err == nil {
+			io.WriteString(h, filepath.ToSlash(f))
+			h.Write(b)
+		}
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	replayHashes[def] = hash
+	return hash
+}
+
+func (s *System) replayMatch() (m ReplayMatch) {
+	for i, p := range s.chars {
+		if len(p) > 0 {
+			m.Chars = append(m.Chars, ReplayChar{
+				ReplayDef: ReplayDef{s.cgi[i].def, replayHash(s.cgi[i].def)},
+				Player:    i + 1, Pal: s.cgi[i].palno, Com: s.com[i],
+				AiKeys: s.aiController[i] != nil})
+		}
+	}
+	if s.stage != nil {
+		m.Stage = ReplayDef{s.stage.def, replayHash(s.stage.def)}
+	}
+	m.Settings = ReplaySettings{
+		TeamMode: s.tmode, NumSimul: s.numSimul, NumTurns: s.numTurns,
+		MatchWins: s.matchWins, RoundTime: s.roundTime,
+		LifeMul: s.lifeMul, Team1VS2: s.team1VS2Life, TurnsRecov: s.turnsRecoveryRate,
+		LifeShare: s.lifeShare, PowerShare: s.powerShare,
+		LoseSimul: s.loseSimul, LoseTag: s.loseTag,
+		ComboWindow: s.comboExtraFrameWindow, HelperMax: s.helperMax,
+		ProjMax: s.playerProjectileMax, ExplodMax: s.explodMax,
+	}
+	return
+}
+
+// Returns a description of the first difference that would make the
+// replay desync, or an empty string if the match can be played back
+func (m *ReplayMatch) mismatch(o *ReplayMatch) string {
+	if len(m.Chars) != len(o.Chars) {
+		return fmt.Sprintf("%v characters recorded, %v loaded", len(m.Chars), len(o.Chars))
+	}
+	for i, c := range m.Chars {
+		switch oc := o.Chars[i]; {
+		case c.Player != oc.Player || c.Def != oc.Def:
+			return fmt.Sprintf("P%v: %v recorded, P%v: %v loaded", c.Player, c.Def, oc.Player, oc.Def)
+		case c.Hash != oc.Hash:
+			return fmt.Sprintf("P%v: %v has been modified", c.Player, c.Def)
+		case c.Pal != oc.Pal:
+			return fmt.Sprintf("P%v: palette %v recorded, %v selected", c.Player, c.Pal, oc.Pal)
+		case c.Com != oc.Com:
+			return fmt.Sprintf("P%v: AI level %v recorded, %v set", c.Player, c.Com, oc.Com)
+		}
+	}
+	if m.Stage.Def != o.Stage.Def {
+		return fmt.Sprintf("stage %v recorded, %v loaded", m.Stage.Def, o.Stage.Def)
+	}
+	if m.Stage.Hash != o.Stage.Hash {
+		return fmt.Sprintf("stage %v has been modified", m.Stage.Def)
+	}
+	if m.Settings != o.Settings {
+		ja, _ := json.Marshal(m.Settings)
+		jb, _ := json.Marshal(o.Settings)
+		return fmt.Sprintf("match settings differ:\n%s recorded\n%s in use", ja, jb)
+	}
+	return ""
+}
+
+func writeReplayJSON(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(b))); err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+func readReplayJSON(r io.Reader, v interface{}) error {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return err
+	}
+	if size > 1<<24 {
+		return Error("Replay block too large")
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Creates a replay file and writes its header, returning nil on failure
+func createReplay(filename string) *os.File {
+	f, err := os.Create(filename)
+	if err != nil {
+		sys.errLog.Println(err.Error())
+		return nil
+	}
+	if err := writeReplayHeader(f); err != nil {
+		sys.errLog.Println(err.Error())
+		f.Close()
+		return nil
+	}
+	return f
+}
+func writeReplayHeader(w io.Writer) error {
+	if _, err := io.WriteString(w, replayMagic); err != nil {
+		return err
+	}
+	return writeReplayJSON(w, &ReplayHeader{Format: replayFormat, Version: Version})
+}
+
+// Returns a nil header for files that predate the replay header, in which
+// case the file is rewound to its start
+func readReplayHeader(f *os.File) (*ReplayHeader, error) {
+	magic := make([]byte, len(replayMagic))
+	if _, err := io.ReadFull(f, magic); err != nil || string(magic) != replayMagic {
+		_, err = f.Seek(0, io.SeekStart)
+		return nil, err
+	}
+	return readReplayHeaderJSON(f)
+}
+
+// Same as readReplayHeader for streams that can not be rewound, which have
+// to start with the header
+func readReplayStreamHeader(r io.Reader) (*ReplayHeader, error) {
+	magic := make([]byte, len(replayMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	} else if string(magic) != replayMagic {
+		return nil, Error("Not a replay stream")
+	}
+	return readReplayHeaderJSON(r)
+}
+func readReplayHeaderJSON(r io.Reader) (*ReplayHeader, error) {
+	h := &ReplayHeader{}
+	if err := readReplayJSON(r, h); err != nil {
+		return nil, err
+	}
+	if h.Format > replayFormat {
+		return h, Error(fmt.Sprintf("Replay format %v is not supported by this version", h.Format))
+	}
+	// Changes to the engine between versions may make the replay desync,
+	// which is worth knowing about but not reason enough to refuse it
+	if h.Version != Version {
+		sys.errLog.Printf("Replay recorded with engine version %v, playing it back with %v\n",
+			h.Version, Version)
+	}
+	return h, nil
+}
+func writeReplayMatch(w io.Writer) error {
+	m := sys.replayMatch()
+	return writeReplayJSON(w, &m)
+}
+
+// Frames between the states kept by the replay viewer to seek backwards
+const replayKeyframeInterval = 300
+
+type replayKeyframe struct {
+	frame int32
+	pos   int64
+	state *GameState
+}
+
+// Plays back the keys recorded for a player that had an AiController, as
+// the controller may not give the same keys again
+type replayAiController struct {
+	fi *FileInput
+	pn int
+}
+
+func (rc *replayAiController) Input(*AiView) InputBits {
+	return rc.fi.ib[rc.pn]
+}
+
+// Gives the players of match m that had an AiController the keys recorded
+// for them, and the others the random AI. The controllers set before are
+// given back by Close.
+func (fi *FileInput) setAiControllers(m *ReplayMatch) {
+	if fi.ai == nil {
+		ai := sys.aiController
+		fi.ai = &ai
+	}
+	for _, c := range m.Chars {
+		if pn := c.Player - 1; pn >= 0 && pn < len(sys.aiController) {
+			sys.aiController[pn] = nil
+			if c.AiKeys {
+				sys.aiController[pn] = &replayAiController{fi: fi, pn: pn}
+			}
+		}
+	}
+}
+
+// Replay viewer state of a FileInput. Frames are counted from the start of
+// the match being watched, frame being the number of frames whose input has
+// been read. A state is kept when the viewer starts and every
+// replayKeyframeInterval frames, so that seeking backwards only has to
+// simulate the frames since the closest one. Seeking simulates frames
+// without drawing them until the target is reached, and states are loaded
+// with load, which also resets what fight keeps of the frame.
+type replayViewer struct {
+	viewing   bool
+	load      func(gs *GameState)
+	frame     int32
+	keyframes []replayKeyframe
+	rounds    map[int32]int32
+	speed     int
+	seekT     int32
+	seekRound int32
+	resume    bool
+}
+
+func newReplayViewer() replayViewer {
+	return replayViewer{speed: 1, seekT: -1, seekRound: -1}
+}
+
+// Called by fight, since states can only be kept while a match is running.
+// The input of the first frame has already been read by Synchronize.
+func (fi *FileInput) StartViewer(load func(gs *GameState)) {
+	frame := fi.frame
+	fi.replayViewer = newReplayViewer()
+	fi.viewing, fi.load, fi.frame = true, load, frame
+	fi.rounds = make(map[int32]int32)
+}
+func (fi *FileInput) StopViewer() {
+	fi.replayViewer = newReplayViewer()
+}
+func (fi *FileInput) seeking() bool {
+	return fi.seekT >= 0 || fi.seekRound >= 0
+}
+
+// Seeks to frame t of the match, which is paused again after getting there
+// if it was paused before
+func (fi *FileInput) Seek(t int32) {
+	if !fi.viewing {
+		return
+	}
+	if !fi.seeking() {
+		fi.resume = sys.paused
+	}
+	fi.seekT, fi.seekRound = Max(0, t), -1
+	sys.paused = false
+}
+func (fi *FileInput) SeekRound(round int32) {
+	if !fi.viewing || round < 1 {
+		return
+	}
+	if t, ok := fi.rounds[round]; ok {
+		fi.Seek(t)
+	} else if round > sys.round {
+		if !fi.seeking() {
+			fi.resume = sys.paused
+		}
+		fi.seekT, fi.seekRound = -1, round
+		sys.paused = false
+	}
+}
+func (fi *FileInput) seekDone() {
+	fi.seekT, fi.seekRound = -1, -1
+	sys.paused = fi.resume
+}
+
+// Runs before the input of every frame of the match is read. Loading a state
+// moves the file back to where the input of its frame starts.
+func (fi *FileInput) viewerUpdate() {
+	if !fi.viewing {
+		return
+	}
+	sk, _ := fi.f.(io.Seeker)
+	if fi.seekT >= 0 && fi.seekT < fi.frame && sk != nil {
+		// Frames before the first state can not be reached
+		var kf *replayKeyframe
+		for i := range fi.keyframes {
+			if i == 0 || fi.keyframes[i].frame <= fi.seekT {
+				kf = &fi.keyframes[i]
+			}
+		}
+		if kf != nil && kf.state.compatible() {
+			if _, err := sk.Seek(kf.pos, io.SeekStart); err == nil {
+				fi.load(kf.state)
+				fi.frame = kf.frame
+			}
+		}
+	}
+	if _, ok := fi.rounds[sys.round]; !ok {
+		fi.rounds[sys.round] = fi.frame
+	}
+	if fi.seekT >= 0 && fi.frame >= fi.seekT ||
+		fi.seekRound >= 0 && sys.round >= fi.seekRound {
+		fi.seekDone()
+	}
+	if sk != nil && (len(fi.keyframes) == 0 || fi.frame%replayKeyframeInterval == 0 &&
+		fi.keyframes[len(fi.keyframes)-1].frame < fi.frame) {
+		if pos, err := sk.Seek(0, io.SeekCurrent); err == nil {
+			fi.keyframes = append(fi.keyframes,
+				replayKeyframe{frame: fi.frame, pos: pos, state: sys.saveState()})
+		}
+	}
+}
+
+// Keyboard controls of the replay viewer: space pauses, period advances a
+// paused match by one frame, F cycles the playback speed, left and right
+// seek five seconds, home goes back to the start of the match and page up
+// and page down to the previous and next round.
+func (fi *FileInput) viewerKey(key glfw.Key) {
+	if !fi.viewing {
+		return
+	}
+	switch key {
+	case glfw.KeySpace:
+		if fi.seeking() {
+			fi.resume = !fi.resume
+		} else {
+			sys.paused = !sys.paused
+		}
+	case glfw.KeyPeriod:
+		if !fi.seeking() {
+			sys.paused, sys.step = true, true
+		}
+	case glfw.KeyF:
+		if fi.speed *= 2; fi.speed > 8 {
+			fi.speed = 1
+		}
+	case glfw.KeyLeft:
+		fi.Seek(fi.frame - replayKeyframeInterval)
+	case glfw.KeyRight:
+		fi.Seek(fi.frame + replayKeyframeInterval)
+	case glfw.KeyHome:
+		fi.Seek(0)
+	case glfw.KeyPageUp:
+		fi.SeekRound(sys.round - 1)
+	case glfw.KeyPageDown:
+		fi.SeekRound(sys.round + 1)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// MatchResult is appended as one line of JSON to the results file, set with
+// -results or the ResultsFile option, for every match that is played to the
+// end. Teams are numbered 1 and 2, and 0 stands for a draw.
+type MatchResult struct {
+	Version  string        `json:"version"`
+	Date     string        `json:"date"`
+	Mode     string        `json:"mode"`
+	Stage    string        `json:"stage"`
+	TeamMode [2]string     `json:"teammode"`
+	Chars    []ResultChar  `json:"chars"`
+	Rounds   []ResultRound `json:"rounds"`
+	WinTeam  int32         `json:"winteam"`
+	Wins     [2]int32      `json:"wins"`
+	Draws    int32         `json:"draws"`
+	Frames   int32         `json:"frames"`
+	Score    [2]float32    `json:"score"`
+}
+
+type ResultChar struct {
+	Player   int     `json:"player"`
+	Team     int     `json:"team"`
+	Def      string  `json:"def"`
+	Name     string  `json:"name"`
+	Pal      int32   `json:"pal"`
+	AILevel  float32 `json:"ailevel"`
+	Input    string  `json:"input"`
+	Joystick int     `json:"joystick"`
+}
+
+type ResultRound struct {
+	Round     int32        `json:"round"`
+	WinTeam   int32        `json:"winteam"`
+	WinType   string       `json:"wintype"`
+	Perfect   bool         `json:"perfect"`
+	Finish    string       `json:"finish"`
+	Frames    int32        `json:"frames"`
+	TimeLeft  int32        `json:"timeleft"`
+	Life      []ResultLife `json:"life"`
+	Score     [2]float32   `json:"score"`
+	MaxCombo  [2]int32     `json:"maxcombo"`
+	MaxDamage [2]int32     `json:"maxcombodamage"`
+}
+
+type ResultLife struct {
+	Player  int   `json:"player"`
+	Life    int32 `json:"life"`
+	LifeMax int32 `json:"lifemax"`
+}
+
+func (tm TeamMode) resultString() string {
+	switch tm {
+	case TM_Simul:
+		return "simul"
+	case TM_Turns:
+		return "turns"
+	case TM_Tag:
+		return "tag"
+	}
+	return "single"
+}
+func (wt WinType) resultString() string {
+	if wt >= WT_PN {
+		wt -= WT_PN
+	}
+	switch wt {
+	case WT_S:
+		return "special"
+	case WT_H:
+		return "hyper"
+	case WT_C:
+		return "cheese"
+	case WT_T:
+		return "time"
+	case WT_Throw:
+		return "throw"
+	case WT_Suicide:
+		return "suicide"
+	case WT_Teammate:
+		return "teammate"
+	}
+	return "normal"
+}
+func (ft FinishType) resultString() string {
+	switch ft {
+	case FT_KO:
+		return "ko"
+	case FT_DKO:
+		return "doubleko"
+	case FT_TO:
+		return "timeover"
+	case FT_TODraw:
+		return "timeoverdraw"
+	}
+	return ""
+}
+
+// Where the input of player pn comes from, and the joystick it reads if any
+func (s *System) resultInput(pn int) (string, int) {
+	switch {
+	case s.com[pn] > 0:
+		return "ai", -1
+	case s.fileInput != nil:
+		return "replay", -1
+	case s.netInput != nil:
+		if s.inputRemap[pn] == s.netInput.locIn {
+			return "netplay local", -1
+		}
+		return "netplay remote", -1
+	}
+	in := s.inputRemap[pn]
+	if in < len(s.joystickConfig) && s.joystickConfig[in].Joy >= 0 {
+		return "joystick", s.joystickConfig[in].Joy
+	}
+	return "keyboard", -1
+}
+
+// Starts collecting the result of a new match
+func (s *System) beginMatchResult() {
+	s.matchResult = nil
+	if s.resultsFile == "" {
+		return
+	}
+	s.matchResult = &MatchResult{Version: Version, Mode: s.gameMode,
+		TeamMode: [...]string{s.tmode[0].resultString(), s.tmode[1].resultString()}}
+}
+
+// Adds the round that has just ended, along with any character that has not
+// played in an earlier round
+func (s *System) recordRoundResult() {
+	mr := s.matchResult
+	if mr == nil {
+		return
+	}
+	r := ResultRound{Round: s.round - 1, Finish: s.finish.resultString(),
+		TimeLeft: s.time, Score: [...]float32{s.lifebar.sc[0].scorePoints, s.lifebar.sc[1].scorePoints}}
+	if s.winTeam >= 0 {
+		r.WinTeam = int32(s.winTeam) + 1
+		r.WinType = s.winType[s.winTeam].resultString()
+		r.Perfect = s.winType[s.winTeam] >= WT_PN
+	}
+	if i := int(r.Round) - 1; i >= 0 && i < len(s.timerCount) {
+		r.Frames = s.timerCount[i]
+	}
+	for i := range r.MaxCombo {
+		r.MaxCombo[i], r.MaxDamage[i] = s.lifebar.co[i].maxCombo, s.lifebar.co[i].maxDamage
+	}
+	for i, p := range s.chars {
+		if len(p) == 0 {
+			continue
+		}
+		r.Life = append(r.Life, ResultLife{Player: i + 1, Life: p[0].life, LifeMax: p[0].lifeMax})
+		found := false
+		for _, c := range mr.Chars {
+			found = found || c.Player == i+1 && c.Def == s.cgi[i].def
+		}
+		if !found {
+			in, joy := s.resultInput(i)
+			mr.Chars = append(mr.Chars, ResultChar{Player: i + 1, Team: i&1 + 1,
+				Def: s.cgi[i].def, Name: p[0].name, Pal: p[0].palno(),
+				AILevel: s.com[i], Input: in, Joystick: joy})
+		}
+	}
+	if s.stage != nil {
+		mr.Stage = s.stage.def
+	}
+	mr.Rounds = append(mr.Rounds, r)
+}
+
+// Appends the result of a match that has been played to the end, where winp
+// is the winning team or 0 on a draw
+func (s *System) writeMatchResult(winp int32, score [2]float32) {
+	mr := s.matchResult
+	s.matchResult = nil
+	if mr == nil {
+		return
+	}
+	mr.Date = time.Now().Format(time.RFC3339)
+	mr.WinTeam, mr.Wins, mr.Draws, mr.Score = winp, s.wins, s.draws, score
+	for _, r := range mr.Rounds {
+		mr.Frames += r.Frames
+	}
+	b, err := json.Marshal(mr)
+	if err == nil {
+		if dir := filepath.Dir(s.resultsFile); dir != "." {
+			os.MkdirAll(dir, 0755)
+		}
+		var f *os.File
+		if f, err = os.OpenFile(s.resultsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+			_, err = f.Write(append(b, '\n'))
+			f.Close()
+		}
+	}
+	if err != nil {
+		s.errLog.Println(err.Error())
+	}
+}
@@ -644,10 +644,34 @@ func systemScriptInit(l *lua.LState) {
 		return 0
 	})
 	luaRegister(l, "enterReplay", func(*lua.LState) int {
-		glfw.SwapInterval(1) //broken frame skipping when set to 0
+		if !sys.headless {
+			glfw.SwapInterval(1) //broken frame skipping when set to 0
+		}
 		sys.chars = [len(sys.chars)][]*Char{}
 		sys.fileInput = OpenFileInput(strArg(l, 1))
-		return 0
+		if err := sys.fileInput.err; err != nil {
+			sys.errLog.Printf("Can not play back %v: %v\n", strArg(l, 1), err)
+		} else if h := sys.fileInput.header; h == nil {
+			sys.errLog.Printf("%v has no replay header, playback may desync\n", strArg(l, 1))
+		} else if h.Version != Version {
+			sys.errLog.Printf("%v was recorded with version %v, running %v\n", strArg(l, 1), h.Version, Version)
+		}
+		l.Push(lua.LBool(sys.fileInput.err == nil))
+		return 1
+	})
+	luaRegister(l, "enterSpectate", func(*lua.LState) int {
+		if !sys.headless {
+			glfw.SwapInterval(1)
+		}
+		sys.chars = [len(sys.chars)][]*Char{}
+		sys.fileInput = ConnectFileInput(strArg(l, 1), sys.listenPort)
+		if err := sys.fileInput.err; err != nil {
+			sys.errLog.Printf("Can not watch %v: %v\n", strArg(l, 1), err)
+		} else if h := sys.fileInput.header; h.Version != Version {
+			sys.errLog.Printf("%v is running version %v, running %v\n", strArg(l, 1), h.Version, Version)
+		}
+		l.Push(lua.LBool(sys.fileInput.err == nil))
+		return 1
 	})
 	luaRegister(l, "esc", func(l *lua.LState) int {
 		if l.GetTop() >= 1 {
@@ -664,7 +688,9 @@ func systemScriptInit(l *lua.LState) {
 		return 0
 	})
 	luaRegister(l, "exitReplay", func(*lua.LState) int {
-		glfw.SwapInterval(sys.vRetrace)
+		if !sys.headless {
+			glfw.SwapInterval(sys.vRetrace)
+		}
 		if sys.fileInput != nil {
 			sys.fileInput.Close()
 			sys.fileInput = nil
@@ -797,6 +823,8 @@ func systemScriptInit(l *lua.LState) {
 			sys.draws = 0
 			tbl := l.NewTable()
 			sys.matchData = l.NewTable()
+			sys.beginMatchResult()
+			sys.profiler.reset()
 
 			// Anonymous function to perform gameplay
 			fight := func() (int32, error) {
@@ -961,6 +989,11 @@ func systemScriptInit(l *lua.LState) {
 				tbl.RawSetString("p2tmode", lua.LNumber(sys.tmode[1]))
 				tbl.RawSetString("p1score", lua.LNumber(sc[0]))
 				tbl.RawSetString("p2score", lua.LNumber(sc[1]))
+				if winp >= 0 {
+					sys.writeMatchResult(winp, sc)
+				}
+				sys.profiler.write()
+				sys.agentMatchOver(winp)
 				sys.timerStart = 0
 				sys.timerRounds = []int32{}
 				sys.scoreStart = [2]float32{}
@@ -1201,7 +1234,7 @@ func systemScriptInit(l *lua.LState) {
 	})
 	luaRegister(l, "getJoystickPresent", func(*lua.LState) int {
 		joy := int(numArg(l, 1))
-		present := joystick[joy].Present()
+		present := !sys.headless && joystick[joy].Present()
 		l.Push(lua.LBool(present))
 		return 1
 	})
@@ -1213,7 +1246,7 @@ func systemScriptInit(l *lua.LState) {
 			max = min + 1
 		}
 		for joy = min; joy < max; joy++ {
-			if joystick[joy].Present() {
+			if !sys.headless && joystick[joy].Present() {
 				axes := joystick[joy].GetAxes()
 				btns := joystick[joy].GetButtons()
 				for i := range axes {
@@ -1269,7 +1302,9 @@ func systemScriptInit(l *lua.LState) {
 		s := ""
 		if sys.keyInput != glfw.KeyUnknown {
 			if sys.keyInput == glfw.KeyInsert {
-				s = sys.window.Window.GetClipboardString()
+				if !sys.headless {
+					s = sys.window.Window.GetClipboardString()
+				}
 			} else {
 				s = sys.keyString
 			}
@@ -1387,6 +1422,30 @@ func systemScriptInit(l *lua.LState) {
 		sys.lifebar = *lb
 		return 0
 	})
+	luaRegister(l, "loadState", func(l *lua.LState) int {
+		gs, ok := toUserData(l, 1).(*GameState)
+		if !ok {
+			userDataError(l, 1, gs)
+		}
+		// Loading a state on one side only would desync netplay
+		if sys.netInput != nil || sys.fileInput != nil || !gs.compatible() {
+			l.Push(lua.LBool(false))
+			return 1
+		}
+		sys.loadState(gs)
+		l.Push(lua.LBool(true))
+		return 1
+	})
+	// Reads a state written by saveStateFile, which can only be done in the
+	// match it was saved in
+	luaRegister(l, "loadStateFile", func(l *lua.LState) int {
+		gs, err := readStateFile(strArg(l, 1))
+		if err != nil {
+			l.RaiseError(err.Error())
+		}
+		l.Push(newUserData(l, gs))
+		return 1
+	})
 	luaRegister(l, "loadStart", func(l *lua.LState) int {
 		if sys.gameMode != "randomtest" {
 			for k, v := range sys.sel.selected {
@@ -1401,6 +1460,14 @@ func systemScriptInit(l *lua.LState) {
 		sys.loadStart()
 		return 0
 	})
+	luaRegister(l, "netRTT", func(*lua.LState) int {
+		var rtt time.Duration
+		if sys.netInput != nil {
+			rtt = sys.netInput.RTT()
+		}
+		l.Push(lua.LNumber(rtt.Milliseconds()))
+		return 1
+	})
 	luaRegister(l, "numberToRune", func(l *lua.LState) int {
 		l.Push(lua.LString(fmt.Sprint('A' - 1 + int(numArg(l, 1)))))
 		return 1
@@ -1544,17 +1611,94 @@ func systemScriptInit(l *lua.LState) {
 		sys.debugWC.unsetSCF(SCF_dizzy)
 		return 0
 	})
+	luaRegister(l, "replayFrame", func(*lua.LState) int {
+		if sys.fileInput != nil {
+			l.Push(lua.LNumber(sys.fileInput.frame))
+		} else {
+			l.Push(lua.LNumber(-1))
+		}
+		return 1
+	})
+	// Returns the characters, stage and team settings of the match the replay
+	// being played back synchronizes next, or nil if it has none left
+	luaRegister(l, "replayMatch", func(*lua.LState) int {
+		if sys.fileInput == nil {
+			return 0
+		}
+		m, err := sys.fileInput.nextMatch()
+		if err != nil {
+			return 0
+		}
+		chars := l.NewTable()
+		for _, c := range m.Chars {
+			ct := l.NewTable()
+			ct.RawSetString("def", lua.LString(c.Def))
+			ct.RawSetString("player", lua.LNumber(c.Player))
+			ct.RawSetString("pal", lua.LNumber(c.Pal))
+			ct.RawSetString("com", lua.LNumber(c.Com))
+			chars.Append(ct)
+		}
+		t := l.NewTable()
+		t.RawSetString("chars", chars)
+		t.RawSetString("stage", lua.LString(m.Stage.Def))
+		for _, v := range [...]struct {
+			name string
+			val  [2]int32
+		}{{"teammode", [...]int32{int32(m.Settings.TeamMode[0]), int32(m.Settings.TeamMode[1])}},
+			{"numsimul", m.Settings.NumSimul}, {"numturns", m.Settings.NumTurns},
+			{"matchwins", m.Settings.MatchWins}} {
+			st := l.NewTable()
+			st.Append(lua.LNumber(v.val[0]))
+			st.Append(lua.LNumber(v.val[1]))
+			t.RawSetString(v.name, st)
+		}
+		t.RawSetString("roundtime", lua.LNumber(m.Settings.RoundTime))
+		l.Push(t)
+		return 1
+	})
 	luaRegister(l, "replayRecord", func(*lua.LState) int {
 		if sys.netInput != nil {
-			sys.netInput.rep, _ = os.Create(strArg(l, 1))
+			sys.netInput.rep = createReplay(strArg(l, 1))
+		} else if sys.fileInput == nil {
+			if sys.localInput != nil {
+				sys.localInput.Close()
+			}
+			sys.localInput = CreateLocalInput(strArg(l, 1))
 		}
 		return 0
 	})
+	luaRegister(l, "replaySeek", func(*lua.LState) int {
+		if sys.fileInput != nil {
+			sys.fileInput.Seek(int32(numArg(l, 1)))
+		}
+		return 0
+	})
+	luaRegister(l, "replaySeekRound", func(*lua.LState) int {
+		if sys.fileInput != nil {
+			sys.fileInput.SeekRound(int32(numArg(l, 1)))
+		}
+		return 0
+	})
+	luaRegister(l, "replaySpeed", func(*lua.LState) int {
+		if sys.fileInput == nil {
+			l.Push(lua.LNumber(1))
+			return 1
+		}
+		if l.GetTop() >= 1 {
+			sys.fileInput.speed = int(Min(8, Max(1, int32(numArg(l, 1)))))
+		}
+		l.Push(lua.LNumber(sys.fileInput.speed))
+		return 1
+	})
 	luaRegister(l, "replayStop", func(*lua.LState) int {
 		if sys.netInput != nil && sys.netInput.rep != nil {
 			sys.netInput.rep.Close()
 			sys.netInput.rep = nil
 		}
+		if sys.localInput != nil {
+			sys.localInput.Close()
+			sys.localInput = nil
+		}
 		return 0
 	})
 	luaRegister(l, "resetKey", func(*lua.LState) int {
@@ -1596,6 +1740,22 @@ func systemScriptInit(l *lua.LState) {
 		sys.roundResetFlg = true
 		return 0
 	})
+	// Returns the state of the running match as userdata, which can be
+	// loaded back with loadState, or written with saveStateFile
+	luaRegister(l, "saveState", func(*lua.LState) int {
+		l.Push(newUserData(l, sys.saveState()))
+		return 1
+	})
+	luaRegister(l, "saveStateFile", func(l *lua.LState) int {
+		gs, ok := toUserData(l, 1).(*GameState)
+		if !ok {
+			userDataError(l, 1, gs)
+		}
+		if err := gs.writeFile(strArg(l, 2)); err != nil {
+			l.RaiseError(err.Error())
+		}
+		return 0
+	})
 	luaRegister(l, "selectChar", func(*lua.LState) int {
 		tn := int(numArg(l, 1))
 		if tn < 1 || tn > 2 {
@@ -1715,6 +1875,24 @@ func systemScriptInit(l *lua.LState) {
 		sys.autolevel = boolArg(l, 1)
 		return 0
 	})
+	luaRegister(l, "setAIAgent", func(*lua.LState) int {
+		pn := int(numArg(l, 1))
+		if pn < 1 || pn > MaxSimul*2+MaxAttachedChar {
+			l.RaiseError("\nInvalid player number: %v\n", pn)
+		}
+		if err := sys.setAiAgent(pn-1, strArg(l, 2)); err != nil {
+			l.RaiseError(err.Error())
+		}
+		return 0
+	})
+	luaRegister(l, "setAIController", func(*lua.LState) int {
+		pn := int(numArg(l, 1))
+		if pn < 1 || pn > MaxSimul*2+MaxAttachedChar {
+			l.RaiseError("\nInvalid player number: %v\n", pn)
+		}
+		setAiController(l, pn-1, l.Get(2))
+		return 0
+	})
 	luaRegister(l, "setCom", func(*lua.LState) int {
 		pn := int(numArg(l, 1))
 		ailv := float32(numArg(l, 2))
@@ -2351,6 +2529,9 @@ func systemScriptInit(l *lua.LState) {
 		return 0
 	})
 	luaRegister(l, "toggleFullscreen", func(*lua.LState) int {
+		if sys.window == nil {
+			return 0
+		}
 		fs := !sys.window.fullscreen
 		if l.GetTop() >= 1 {
 			fs = boolArg(l, 1)
@@ -2429,7 +2610,9 @@ func systemScriptInit(l *lua.LState) {
 		} else {
 			sys.vRetrace = 0
 		}
-		glfw.SwapInterval(sys.vRetrace)
+		if !sys.headless {
+			glfw.SwapInterval(sys.vRetrace)
+		}
 		return 0
 	})
 	luaRegister(l, "waveGetLength", func(*lua.LState) int {
@@ -3651,7 +3834,11 @@ func triggerFunctions(l *lua.LState) {
 		return 1
 	})
 	luaRegister(l, "map", func(*lua.LState) int {
-		l.Push(lua.LNumber(sys.debugWC.mapArray[strings.ToLower(strArg(l, 1))]))
+		if v, ok := sys.debugWC.mapValues[strings.ToLower(strArg(l, 1))]; ok {
+			l.Push(lua.LString(v.ToS()))
+		} else {
+			l.Push(lua.LNumber(sys.debugWC.mapArray[strings.ToLower(strArg(l, 1))]))
+		}
 		return 1
 	})
 	luaRegister(l, "memberno", func(*lua.LState) int {
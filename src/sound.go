@@ -259,6 +259,9 @@ func newBgm() *Bgm {
 }
 
 func (bgm *Bgm) Open(filename string, isDefaultBGM bool, loop, bgmVolume, bgmLoopStart, bgmLoopEnd int) {
+	if sys.headless {
+		return
+	}
 	if filepath.Base(bgm.filename) == filepath.Base(filename) {
 		return
 	}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+)
+
+// NetSpectators streams a netplay session to read-only TCP connections made
+// to the port the host listens on. Spectators receive the same data as the
+// replay file, held back by delay frames, so they play it back the same way
+// as a replay. Those joining late start from the latest match, and what has
+// been sent to every spectator before it is dropped, so that a long session
+// does not have to be kept whole.
+type NetSpectators struct {
+	ln     *net.TCPListener
+	mu     sync.Mutex
+	header []byte
+	hist   []byte
+	base   int
+	match  int
+	sent   map[*net.TCPConn]int
+	pend   []netSpectatorChunk
+	time   int32
+	delay  int32
+	closed bool
+}
+type netSpectatorChunk struct {
+	time  int32
+	b     []byte
+	match bool
+}
+
+func ListenNetSpectators(port string, delay int32) (*NetSpectators, error) {
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return nil, err
+	}
+	ns := &NetSpectators{ln: ln.(*net.TCPListener), delay: delay,
+		sent: make(map[*net.TCPConn]int)}
+	var header bytes.Buffer
+	if err := writeReplayHeader(&header); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	ns.header = header.Bytes()
+	go func() {
+		for {
+			conn, err := ns.ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go ns.serve(conn)
+		}
+	}()
+	return ns, nil
+}
+
+// Everything written is stamped with the current frame and sent once the
+// delay has passed
+func (ns *NetSpectators) Write(b []byte) (int, error) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.pend = append(ns.pend, netSpectatorChunk{time: ns.time,
+		b: append([]byte{}, b...)})
+	return len(b), nil
+}
+
+// Marks the start of a match, where what is written next begins
+func (ns *NetSpectators) StartMatch() {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.pend = append(ns.pend, netSpectatorChunk{time: ns.time, match: true})
+}
+func (ns *NetSpectators) Update(t int32) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.time = t
+	n := 0
+	for ; n < len(ns.pend) && ns.pend[n].time+ns.delay <= t; n++ {
+		ns.add(ns.pend[n])
+	}
+	ns.pend = ns.pend[n:]
+	ns.trim()
+}
+func (ns *NetSpectators) add(c netSpectatorChunk) {
+	if c.match {
+		ns.match = ns.base + len(ns.hist)
+	}
+	ns.hist = append(ns.hist, c.b...)
+}
+
+// Drops what every spectator has been sent before the latest match. It is
+// copied to a new slice once at least half of it can go, so that the memory
+// is freed.
+func (ns *NetSpectators) trim() {
+	n := ns.match - ns.base
+	for _, sent := range ns.sent {
+		if sent-ns.base < n {
+			n = sent - ns.base
+		}
+	}
+	if n > 0 && n >= len(ns.hist)/2 {
+		ns.hist = append([]byte(nil), ns.hist[n:]...)
+		ns.base += n
+	}
+}
+
+// Sends what is left without waiting for the delay and disconnects the
+// spectators once they have it
+func (ns *NetSpectators) Close() {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	for _, c := range ns.pend {
+		ns.add(c)
+	}
+	ns.pend = nil
+	ns.closed = true
+	ns.ln.Close()
+}
+
+// The bytes of hist are never changed once written, so what has been read
+// from it stays valid without holding the lock
+func (ns *NetSpectators) serve(conn *net.TCPConn) {
+	defer conn.Close()
+	if _, err := conn.Write(ns.header); err != nil {
+		return
+	}
+	ns.mu.Lock()
+	sent := ns.match
+	ns.sent[conn] = sent
+	ns.mu.Unlock()
+	defer func() {
+		ns.mu.Lock()
+		delete(ns.sent, conn)
+		ns.mu.Unlock()
+	}()
+	for {
+		ns.mu.Lock()
+		b, closed := ns.hist[sent-ns.base:], ns.closed
+		ns.mu.Unlock()
+		if len(b) > 0 {
+			if _, err := conn.Write(b); err != nil {
+				return
+			}
+			sent += len(b)
+			ns.mu.Lock()
+			ns.sent[conn] = sent
+			ns.mu.Unlock()
+		} else if closed {
+			return
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
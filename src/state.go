@@ -0,0 +1,590 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+)
+
+// GameState holds a copy of everything the simulation of a match depends
+// on, so that it can be restored later on. Objects are restored in place,
+// keeping pointers shared between characters, helpers, projectiles and
+// explods valid. Assets, bytecode and sound playback are never copied.
+//
+// A GameState refers to the objects it restores and to the assets they
+// point to. encode writes it with those references turned into indices, so
+// that decodeState can read it back in another process, or after the engine
+// is started again, once the same characters and stage are loaded.
+type GameState struct {
+	randseed  int32
+	sys       systemState
+	chars     [MaxSimul*2 + MaxAttachedChar][]*Char
+	char      []charState
+	cgi       [MaxSimul*2 + MaxAttachedChar]cgiState
+	runOrder  []*Char
+	drawOrder []*Char
+	idMap     map[int32]*Char
+	projs     [MaxSimul*2 + MaxAttachedChar][]Projectile
+	explods   [MaxSimul*2 + MaxAttachedChar][]Explod
+	explDraw  [3][MaxSimul*2 + MaxAttachedChar][]int
+	anims     map[*Animation]Animation
+	palfx     map[*PalFX]PalFX
+	cmds      [][2][]CommandList
+	hitScale  map[*HitScale]HitScale
+	cam       Camera
+	stage     stageState
+	lifebar   lifebarState
+}
+
+// System fields that change while a match is running
+type systemState struct {
+	aiInput                               [MaxSimul*2 + MaxAttachedChar]AiInput
+	gameTime, round, intro, time          int32
+	lastHitter                            [2]int
+	winTeam                               int
+	winType, winTrigger                   [2]WinType
+	wins, roundsExisted                   [2]int32
+	draws                                 int32
+	nextCharId                            int32
+	specialFlag                           GlobalSpecialFlag
+	envShake                              EnvShake
+	pause, pausetime                      int32
+	pausebg                               bool
+	pauseendcmdbuftime                    int32
+	pauseplayer                           int
+	super, supertime                      int32
+	superpausebg                          bool
+	superendcmdbuftime                    int32
+	superplayer                           int
+	superdarken                           bool
+	superanim                             *Animation
+	superpmap                             PalFX
+	superpos                              [2]float32
+	superfacing, superp2defmul            float32
+	envcol                                [3]int32
+	envcol_time                           int32
+	envcol_under                          bool
+	tickCount, oldTickCount               int
+	tickCountF, lastTick                  float32
+	nextAddTime, oldNextAddTime           float32
+	xmin, xmax                            float32
+	winskipped                            bool
+	finish                                FinishType
+	waitdown, slowtime, shuttertime       int32
+	fadeintime, fadeouttime               int32
+	accel                                 float32
+	allPalFX, bgPalFX                     PalFX
+	autoguard                             [MaxSimul*2 + MaxAttachedChar]bool
+	teamLeader                            [2]int
+	introSkipped, fightOver, postMatchFlg bool
+	dialogueFlg                           bool
+	enableZoomstate                       bool
+	zoomlag, zoomScale, zoomPosXLag       float32
+	zoomPosYLag, drawScale                float32
+	zoomPos                               [2]float32
+	roundType                             [2]RoundType
+	timerCount                            []int32
+	fightCam                              struct{ x, y, newx, newy, l, r, scl, sclmul float32 }
+	// Rounds recorded by the end of round, which may be simulated again
+	scoreRounds, resultRounds int
+}
+
+type charState struct {
+	c         *Char
+	v         Char
+	mapArray  map[string]float32
+	mapValues map[string]BytecodeValue
+	remapSpr  RemapPreset
+	next      map[int32][3]*HitScale
+	active    map[int32][3]*HitScale
+}
+
+type cgiState struct {
+	pctype      ProjContact
+	pctime      int32
+	pcid        int32
+	unhittable  int32
+	remappedpal [2]int32
+}
+
+type stageState struct {
+	stage     *Stage
+	stageTime int32
+	bga       bgAction
+	bg        []backGround
+	bgc       []bgCtrl
+	line      []bgctNode
+	al        []*bgCtrl
+}
+
+type lifebarState struct {
+	hb   [8][]HealthBar
+	pb   [8][]PowerBar
+	gb   [8][]GuardBar
+	sb   [8][]StunBar
+	fa   [8][]LifeBarFace
+	nm   [8][]LifeBarName
+	wi   [2]LifeBarWinIcon
+	ti   LifeBarTime
+	co   [2]LifeBarCombo
+	ac   [2]LifeBarAction
+	ro   LifeBarRound
+	ra   [2]LifeBarRatio
+	tr   LifeBarTimer
+	sc   [2]LifeBarScore
+	ma   LifeBarMatch
+	ai   [2]LifeBarAiLevel
+	wc   [2]LifeBarWinCount
+	done bool
+}
+
+// Replaces the slices a character may modify in place with copies
+func (c *Char) copySlices() {
+	c.ss.ps = append([]int32(nil), c.ss.ps...)
+	for i, w := range c.ss.wakegawakaranai {
+		c.ss.wakegawakaranai[i] = append([]bool(nil), w...)
+	}
+	c.ss.sb.ctrlsps = append([]int32(nil), c.ss.sb.ctrlsps...)
+	c.ghv.hitBy = append([][2]int32(nil), c.ghv.hitBy...)
+	c.children = append([]*Char(nil), c.children...)
+	c.targets = append([]int32(nil), c.targets...)
+	c.targetsOfHitdef = append([]int32(nil), c.targetsOfHitdef...)
+	for i, e := range c.enemynear {
+		c.enemynear[i] = append([]*Char(nil), e...)
+	}
+	c.aimg.palfx = append([]PalFX(nil), c.aimg.palfx...)
+	c.clipboardText = append([]string(nil), c.clipboardText...)
+	c.dialogue = append([]string(nil), c.dialogue...)
+}
+
+// Returns a copy of the command lists with their own buffers and command
+// progress, or copies the progress of src into dst if dst is not nil
+func copyCommandLists(dst, src []CommandList) []CommandList {
+	if dst == nil {
+		dst = make([]CommandList, len(src))
+		for i, cl := range src {
+			dst[i] = cl
+			if cl.Buffer != nil {
+				dst[i].Buffer = &CommandBuffer{}
+			}
+			dst[i].Commands = make([][]Command, len(cl.Commands))
+			for j := range cl.Commands {
+				dst[i].Commands[j] = make([]Command, len(cl.Commands[j]))
+				for k := range cl.Commands[j] {
+					dst[i].Commands[j][k].held = make([]bool, len(cl.Commands[j][k].held))
+				}
+			}
+		}
+	}
+	for i := range src {
+		if src[i].Buffer != nil && dst[i].Buffer != nil {
+			*dst[i].Buffer = *src[i].Buffer
+		}
+		for j := range src[i].Commands {
+			for k, cmd := range src[i].Commands[j] {
+				held := dst[i].Commands[j][k].held
+				copy(held, cmd.held)
+				dst[i].Commands[j][k] = cmd
+				dst[i].Commands[j][k].held = held
+			}
+		}
+	}
+	return dst
+}
+
+func (gs *GameState) saveAnim(a *Animation) {
+	if a != nil {
+		gs.anims[a] = *a
+	}
+}
+func (gs *GameState) savePalFX(p *PalFX) {
+	if p != nil {
+		gs.palfx[p] = *p
+	}
+}
+func (gs *GameState) saveHitScale(hs [3]*HitScale) {
+	for _, h := range hs {
+		if h != nil {
+			gs.hitScale[h] = *h
+		}
+	}
+}
+
+// Copies the current simulation state
+func (s *System) saveState() *GameState {
+	gs := &GameState{randseed: s.randseed,
+		anims: make(map[*Animation]Animation), palfx: make(map[*PalFX]PalFX),
+		hitScale: make(map[*HitScale]HitScale)}
+	// Helpers share the command lists of their root
+	cmds := make(map[*CommandList]bool)
+	gs.sys = systemState{
+		aiInput: s.aiInput, gameTime: s.gameTime, round: s.round,
+		intro: s.intro, time: s.time, lastHitter: s.lastHitter,
+		winTeam: s.winTeam, winType: s.winType, winTrigger: s.winTrigger,
+		wins: s.wins, roundsExisted: s.roundsExisted, draws: s.draws,
+		nextCharId: s.nextCharId, specialFlag: s.specialFlag,
+		envShake: s.envShake, pause: s.pause, pausetime: s.pausetime,
+		pausebg: s.pausebg, pauseendcmdbuftime: s.pauseendcmdbuftime,
+		pauseplayer: s.pauseplayer, super: s.super, supertime: s.supertime,
+		superpausebg: s.superpausebg, superendcmdbuftime: s.superendcmdbuftime,
+		superplayer: s.superplayer, superdarken: s.superdarken,
+		superanim: s.superanim, superpmap: s.superpmap, superpos: s.superpos,
+		superfacing: s.superfacing, superp2defmul: s.superp2defmul,
+		envcol: s.envcol, envcol_time: s.envcol_time,
+		envcol_under: s.envcol_under, tickCount: s.tickCount,
+		oldTickCount: s.oldTickCount, tickCountF: s.tickCountF,
+		lastTick: s.lastTick, nextAddTime: s.nextAddTime,
+		oldNextAddTime: s.oldNextAddTime, xmin: s.xmin, xmax: s.xmax,
+		winskipped: s.winskipped, finish: s.finish, waitdown: s.waitdown,
+		slowtime: s.slowtime, shuttertime: s.shuttertime,
+		fadeintime: s.fadeintime, fadeouttime: s.fadeouttime, accel: s.accel,
+		allPalFX: s.allPalFX, bgPalFX: s.bgPalFX, autoguard: s.autoguard,
+		teamLeader: s.teamLeader, introSkipped: s.introSkipped,
+		fightOver: s.fightOver, postMatchFlg: s.postMatchFlg,
+		dialogueFlg: s.dialogueFlg, enableZoomstate: s.enableZoomstate,
+		zoomlag: s.zoomlag, zoomScale: s.zoomScale,
+		zoomPosXLag: s.zoomPosXLag, zoomPosYLag: s.zoomPosYLag,
+		drawScale: s.drawScale, zoomPos: s.zoomPos, roundType: s.roundType,
+		timerCount:  append([]int32(nil), s.timerCount...),
+		fightCam:    s.fightCam,
+		scoreRounds: len(s.scoreRounds),
+	}
+	if s.matchResult != nil {
+		gs.sys.resultRounds = len(s.matchResult.Rounds)
+	}
+	gs.saveAnim(s.superanim)
+	for i, p := range s.chars {
+		gs.chars[i] = append([]*Char(nil), p...)
+		for _, c := range p {
+			cs := charState{c: c, v: *c}
+			cs.v.copySlices()
+			cs.mapArray = make(map[string]float32, len(c.mapArray))
+			for k, v := range c.mapArray {
+				cs.mapArray[k] = v
+			}
+			cs.mapValues = make(map[string]BytecodeValue, len(c.mapValues))
+			for k, v := range c.mapValues {
+				cs.mapValues[k] = v
+			}
+			cs.remapSpr = make(RemapPreset, len(c.remapSpr))
+			for k, v := range c.remapSpr {
+				cs.remapSpr[k] = v
+			}
+			cs.next = make(map[int32][3]*HitScale, len(c.nextHitScale))
+			for k, v := range c.nextHitScale {
+				cs.next[k] = v
+				gs.saveHitScale(v)
+			}
+			cs.active = make(map[int32][3]*HitScale, len(c.activeHitScale))
+			for k, v := range c.activeHitScale {
+				cs.active[k] = v
+				gs.saveHitScale(v)
+			}
+			gs.saveHitScale(c.defaultHitScale)
+			gs.saveAnim(c.anim)
+			gs.savePalFX(c.palfx)
+			if len(c.cmd) > 0 {
+				if !cmds[&c.cmd[0]] {
+					cmds[&c.cmd[0]] = true
+					gs.cmds = append(gs.cmds, [...][]CommandList{c.cmd,
+						copyCommandLists(nil, c.cmd)})
+				}
+			}
+			gs.char = append(gs.char, cs)
+		}
+		gs.cgi[i] = cgiState{s.cgi[i].pctype, s.cgi[i].pctime, s.cgi[i].pcid,
+			s.cgi[i].unhittable, s.cgi[i].remappedpal}
+	}
+	gs.runOrder = append([]*Char(nil), s.charList.runOrder...)
+	gs.drawOrder = append([]*Char(nil), s.charList.drawOrder...)
+	gs.idMap = make(map[int32]*Char, len(s.charList.idMap))
+	for k, v := range s.charList.idMap {
+		gs.idMap[k] = v
+	}
+	for i := range s.projs {
+		gs.projs[i] = append([]Projectile(nil), s.projs[i]...)
+		for _, p := range s.projs[i] {
+			gs.saveAnim(p.ani)
+			gs.savePalFX(p.palfx)
+		}
+		gs.explods[i] = append([]Explod(nil), s.explods[i]...)
+		for _, e := range s.explods[i] {
+			gs.saveAnim(e.anim)
+			gs.savePalFX(e.palfx)
+		}
+		gs.explDraw[0][i] = append([]int(nil), s.explDrawlist[i]...)
+		gs.explDraw[1][i] = append([]int(nil), s.topexplDrawlist[i]...)
+		gs.explDraw[2][i] = append([]int(nil), s.underexplDrawlist[i]...)
+	}
+	gs.cam = s.cam
+	gs.stage.save(s.stage)
+	gs.lifebar.save(&s.lifebar)
+	return gs
+}
+
+// Returns false if the state was saved with other characters or another
+// stage loaded, in which case it can not be restored
+func (gs *GameState) compatible() bool {
+	if gs.stage.stage != sys.stage {
+		return false
+	}
+	for i, p := range sys.chars {
+		if (len(p) > 0) != (len(gs.chars[i]) > 0) ||
+			len(p) > 0 && p[0] != gs.chars[i][0] {
+			return false
+		}
+	}
+	return true
+}
+
+// Restores a state returned by saveState. The same state can be loaded
+// any number of times.
+func (s *System) loadState(gs *GameState) {
+	s.randseed = gs.randseed
+	st := &gs.sys
+	s.aiInput, s.gameTime, s.round = st.aiInput, st.gameTime, st.round
+	s.intro, s.time, s.lastHitter = st.intro, st.time, st.lastHitter
+	s.winTeam, s.winType, s.winTrigger = st.winTeam, st.winType, st.winTrigger
+	s.wins, s.roundsExisted, s.draws = st.wins, st.roundsExisted, st.draws
+	s.nextCharId, s.specialFlag = st.nextCharId, st.specialFlag
+	s.envShake, s.pause, s.pausetime = st.envShake, st.pause, st.pausetime
+	s.pausebg, s.pauseendcmdbuftime = st.pausebg, st.pauseendcmdbuftime
+	s.pauseplayer, s.super, s.supertime = st.pauseplayer, st.super, st.supertime
+	s.superpausebg, s.superendcmdbuftime = st.superpausebg, st.superendcmdbuftime
+	s.superplayer, s.superdarken = st.superplayer, st.superdarken
+	s.superanim, s.superpmap, s.superpos = st.superanim, st.superpmap, st.superpos
+	s.superfacing, s.superp2defmul = st.superfacing, st.superp2defmul
+	s.envcol, s.envcol_time, s.envcol_under = st.envcol, st.envcol_time, st.envcol_under
+	s.tickCount, s.oldTickCount = st.tickCount, st.oldTickCount
+	s.tickCountF, s.lastTick = st.tickCountF, st.lastTick
+	s.nextAddTime, s.oldNextAddTime = st.nextAddTime, st.oldNextAddTime
+	s.xmin, s.xmax, s.winskipped = st.xmin, st.xmax, st.winskipped
+	s.finish, s.waitdown, s.slowtime = st.finish, st.waitdown, st.slowtime
+	s.shuttertime, s.fadeintime = st.shuttertime, st.fadeintime
+	s.fadeouttime, s.accel = st.fadeouttime, st.accel
+	s.allPalFX, s.bgPalFX, s.autoguard = st.allPalFX, st.bgPalFX, st.autoguard
+	s.teamLeader, s.introSkipped = st.teamLeader, st.introSkipped
+	s.fightOver, s.postMatchFlg = st.fightOver, st.postMatchFlg
+	s.dialogueFlg, s.enableZoomstate = st.dialogueFlg, st.enableZoomstate
+	s.zoomlag, s.zoomScale = st.zoomlag, st.zoomScale
+	s.zoomPosXLag, s.zoomPosYLag = st.zoomPosXLag, st.zoomPosYLag
+	s.drawScale, s.zoomPos, s.roundType = st.drawScale, st.zoomPos, st.roundType
+	s.timerCount = append(s.timerCount[:0], st.timerCount...)
+	s.fightCam = st.fightCam
+	if len(s.scoreRounds) > st.scoreRounds {
+		s.scoreRounds = s.scoreRounds[:st.scoreRounds]
+	}
+	if mr := s.matchResult; mr != nil && len(mr.Rounds) > st.resultRounds {
+		mr.Rounds = mr.Rounds[:st.resultRounds]
+	}
+	for a, v := range gs.anims {
+		*a = v
+	}
+	for p, v := range gs.palfx {
+		*p = v
+	}
+	for h, v := range gs.hitScale {
+		*h = v
+	}
+	for _, v := range gs.cmds {
+		copyCommandLists(v[0], v[1])
+	}
+	for i := range s.chars {
+		s.chars[i] = append([]*Char(nil), gs.chars[i]...)
+	}
+	for _, cs := range gs.char {
+		sounds := cs.c.sounds
+		*cs.c = cs.v
+		cs.c.copySlices()
+		cs.c.sounds = sounds
+		if cs.c.mapArray != nil {
+			for k := range cs.c.mapArray {
+				delete(cs.c.mapArray, k)
+			}
+			for k, v := range cs.mapArray {
+				cs.c.mapArray[k] = v
+			}
+		}
+		cs.c.mapValues = make(map[string]BytecodeValue, len(cs.mapValues))
+		for k, v := range cs.mapValues {
+			cs.c.mapValues[k] = v
+		}
+		if cs.c.remapSpr != nil {
+			for k := range cs.c.remapSpr {
+				delete(cs.c.remapSpr, k)
+			}
+			for k, v := range cs.remapSpr {
+				cs.c.remapSpr[k] = v
+			}
+		}
+		if cs.c.nextHitScale != nil {
+			for k := range cs.c.nextHitScale {
+				delete(cs.c.nextHitScale, k)
+			}
+			for k, v := range cs.next {
+				cs.c.nextHitScale[k] = v
+			}
+		}
+		if cs.c.activeHitScale != nil {
+			for k := range cs.c.activeHitScale {
+				delete(cs.c.activeHitScale, k)
+			}
+			for k, v := range cs.active {
+				cs.c.activeHitScale[k] = v
+			}
+		}
+	}
+	for i, g := range gs.cgi {
+		s.cgi[i].pctype, s.cgi[i].pctime, s.cgi[i].pcid = g.pctype, g.pctime, g.pcid
+		s.cgi[i].unhittable, s.cgi[i].remappedpal = g.unhittable, g.remappedpal
+	}
+	s.charList.runOrder = append(s.charList.runOrder[:0], gs.runOrder...)
+	s.charList.drawOrder = append(s.charList.drawOrder[:0], gs.drawOrder...)
+	for k := range s.charList.idMap {
+		delete(s.charList.idMap, k)
+	}
+	for k, v := range gs.idMap {
+		s.charList.idMap[k] = v
+	}
+	for i := range s.projs {
+		s.projs[i] = append(s.projs[i][:0], gs.projs[i]...)
+		s.explods[i] = append(s.explods[i][:0], gs.explods[i]...)
+		s.explDrawlist[i] = append(s.explDrawlist[i][:0], gs.explDraw[0][i]...)
+		s.topexplDrawlist[i] = append(s.topexplDrawlist[i][:0], gs.explDraw[1][i]...)
+		s.underexplDrawlist[i] = append(s.underexplDrawlist[i][:0], gs.explDraw[2][i]...)
+	}
+	s.cam = gs.cam
+	gs.stage.load()
+	gs.lifebar.load(&s.lifebar)
+}
+
+func (ss *stageState) save(s *Stage) {
+	ss.stage = s
+	if s == nil {
+		return
+	}
+	ss.stageTime, ss.bga = s.stageTime, s.bga
+	ss.bg = make([]backGround, len(s.bg))
+	for i, b := range s.bg {
+		ss.bg[i] = *b
+	}
+	ss.bgc = append([]bgCtrl(nil), s.bgc...)
+	ss.line = append([]bgctNode(nil), s.bgct.line...)
+	ss.al = append([]*bgCtrl(nil), s.bgct.al...)
+}
+func (ss *stageState) load() {
+	s := ss.stage
+	if s == nil {
+		return
+	}
+	s.stageTime, s.bga = ss.stageTime, ss.bga
+	for i, b := range ss.bg {
+		*s.bg[i] = b
+	}
+	// Timeline entries point into bgc, so it is copied back in place
+	copy(s.bgc, ss.bgc)
+	s.bgct.line = append([]bgctNode(nil), ss.line...)
+	s.bgct.al = append(s.bgct.al[:0], ss.al...)
+}
+
+func (ls *lifebarState) save(l *Lifebar) {
+	for i := range l.hb {
+		for _, b := range l.hb[i] {
+			ls.hb[i] = append(ls.hb[i], *b)
+		}
+		for _, b := range l.pb[i] {
+			ls.pb[i] = append(ls.pb[i], *b)
+		}
+		for _, b := range l.gb[i] {
+			ls.gb[i] = append(ls.gb[i], *b)
+		}
+		for _, b := range l.sb[i] {
+			ls.sb[i] = append(ls.sb[i], *b)
+		}
+		for _, f := range l.fa[i] {
+			ls.fa[i] = append(ls.fa[i], *f)
+		}
+		for _, n := range l.nm[i] {
+			ls.nm[i] = append(ls.nm[i], *n)
+		}
+	}
+	if l.ro == nil {
+		return
+	}
+	for i := range l.wi {
+		ls.wi[i] = *l.wi[i]
+		ls.wi[i].wins = append([]WinType(nil), l.wi[i].wins...)
+		ls.co[i], ls.ac[i], ls.ra[i] = *l.co[i], *l.ac[i], *l.ra[i]
+		ls.ac[i].messages = append([]*LbMsg(nil), l.ac[i].messages...)
+		ls.sc[i], ls.ai[i], ls.wc[i] = *l.sc[i], *l.ai[i], *l.wc[i]
+	}
+	ls.ti, ls.ro, ls.tr, ls.ma = *l.ti, *l.ro, *l.tr, *l.ma
+	ls.done = true
+}
+func (ls *lifebarState) load(l *Lifebar) {
+	for i := range l.hb {
+		for j, b := range ls.hb[i] {
+			*l.hb[i][j] = b
+		}
+		for j, b := range ls.pb[i] {
+			*l.pb[i][j] = b
+		}
+		for j, b := range ls.gb[i] {
+			*l.gb[i][j] = b
+		}
+		for j, b := range ls.sb[i] {
+			*l.sb[i][j] = b
+		}
+		for j, f := range ls.fa[i] {
+			*l.fa[i][j] = f
+		}
+		for j, n := range ls.nm[i] {
+			*l.nm[i][j] = n
+		}
+	}
+	if !ls.done {
+		return
+	}
+	for i := range l.wi {
+		*l.wi[i] = ls.wi[i]
+		l.wi[i].wins = append([]WinType(nil), ls.wi[i].wins...)
+		*l.co[i], *l.ac[i], *l.ra[i] = ls.co[i], ls.ac[i], ls.ra[i]
+		l.ac[i].messages = append([]*LbMsg(nil), ls.ac[i].messages...)
+		*l.sc[i], *l.ai[i], *l.wc[i] = ls.sc[i], ls.ai[i], ls.wc[i]
+	}
+	*l.ti, *l.ro, *l.tr, *l.ma = ls.ti, ls.ro, ls.tr, ls.ma
+}
+
+// Values that have to be the same on every netplay peer at the same frame,
+// compared to detect desyncs: the random seed followed by seven values for
+// each character
+func (s *System) syncValues() []int32 {
+	v := []int32{s.randseed}
+	for _, p := range s.chars {
+		for _, c := range p {
+			v = append(v, int32(c.playerNo), c.id, c.ss.no, c.life, c.power,
+				int32(math.Float32bits(c.pos[0])), int32(math.Float32bits(c.pos[1])))
+		}
+	}
+	return v
+}
+func syncChecksum(v []int32) int32 {
+	h := fnv.New32a()
+	binary.Write(h, binary.LittleEndian, v)
+	return int32(h.Sum32())
+}
+func syncDump(v []int32) string {
+	if len(v) == 0 {
+		return "no state\n"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "randseed %v\n", v[0])
+	for i := 1; i+7 <= len(v); i += 7 {
+		fmt.Fprintf(&b, "P%v id %v stateno %v life %v power %v pos %v,%v\n",
+			v[i]+1, v[i+1], v[i+2], v[i+3], v[i+4],
+			math.Float32frombits(uint32(v[i+5])), math.Float32frombits(uint32(v[i+6])))
+	}
+	return b.String()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// A state written with encode must load back to what was saved, sharing
+// the same assets and characters as the match it was saved in
+func TestStateRoundTrip(t *testing.T) {
+	defer func(h int32) { sys.helperMax = h }(sys.helperMax)
+	sys.helperMax = 4
+	sff := &Sff{sprites: map[[2]int16]*Sprite{{0, 0}: {}, {200, 1}: {Group: 200,
+		Number: 1}}}
+	for i := range sys.chars {
+		sys.chars[i], sys.projs[i], sys.explods[i] = nil, nil, nil
+		sys.cgi[i].sff, sys.cgi[i].def = nil, ""
+	}
+	sys.charList.clear()
+	for pn := 0; pn < 2; pn++ {
+		c := newChar(pn, 0)
+		c.palfx = newPalFX()
+		c.cmd = []CommandList{*NewCommandList(&CommandBuffer{})}
+		c.anim = &Animation{sff: sff, spr: sff.sprites[[2]int16{200, 1}],
+			frames: []AnimFrame{{Time: 3, Group: 200, Number: 1}, {Time: -1}}}
+		c.curFrame = c.anim.CurrentFrame()
+		c.mapArray = map[string]float32{"hits": 2}
+		c.mapValues = map[string]BytecodeValue{"name": BytecodeString("P")}
+		sys.chars[pn] = []*Char{c}
+		sys.cgi[pn].sff, sys.cgi[pn].def = sff, "chars/test/test.def"
+		sys.charList.add(c)
+	}
+	root := sys.chars[0][0]
+	h := newChar(0, 1)
+	h.id, h.helperIndex, h.cmd, h.anim = sys.newCharId(), 1, root.cmd, root.anim
+	sys.chars[0] = append(sys.chars[0], h)
+	sys.charList.add(h)
+	sys.explods[0] = []Explod{{id: 5, anim: root.anim, palfx: root.palfx}}
+	sys.randseed = 42
+	root.life, root.pos[0] = 800, 120
+
+	b, err := sys.saveState().encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sys.randseed = 7
+	root.life, root.pos[0] = 1, -30
+	root.anim.time = 9
+	root.mapArray["hits"] = 5
+	sys.explods[0] = nil
+	sys.chars[0] = sys.chars[0][:1]
+	gs, err := decodeState(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gs.compatible() {
+		t.Fatal("state read back is not compatible with the match it was saved in")
+	}
+	sys.loadState(gs)
+
+	if sys.randseed != 42 || root.life != 800 || root.pos[0] != 120 {
+		t.Errorf("randseed %v, life %v, pos %v", sys.randseed, root.life, root.pos[0])
+	}
+	if sys.chars[0][0] != root || len(sys.chars[0]) != 2 {
+		t.Fatalf("%v characters of P1, root replaced: %v", len(sys.chars[0]),
+			sys.chars[0][0] != root)
+	}
+	h = sys.chars[0][1]
+	if h.anim != root.anim || root.anim.time != 0 {
+		t.Errorf("helper animation shared: %v, time %v", h.anim == root.anim,
+			root.anim.time)
+	}
+	if &h.cmd[0] != &root.cmd[0] {
+		t.Error("helper does not share the command lists of its root")
+	}
+	if root.anim.sff != sff || root.anim.spr != sff.sprites[[2]int16{200, 1}] {
+		t.Error("animation does not refer to the sprites that are loaded")
+	}
+	if root.curFrame == nil || root.curFrame.Time != 3 {
+		t.Errorf("current frame %+v", root.curFrame)
+	}
+	if root.mapArray["hits"] != 2 ||
+		!reflect.DeepEqual(root.mapValues["name"], BytecodeString("P")) {
+		t.Errorf("maps %v, %v", root.mapArray, root.mapValues)
+	}
+	if len(sys.explods[0]) != 1 || sys.explods[0][0].id != 5 ||
+		sys.explods[0][0].anim != root.anim || sys.explods[0][0].palfx != root.palfx {
+		t.Errorf("explods %+v", sys.explods[0])
+	}
+	if sys.charList.idMap[h.id] != h {
+		t.Error("helper missing from the character list")
+	}
+
+	sys.cgi[1].def = "chars/other/other.def"
+	if _, err := decodeState(b); err == nil {
+		t.Error("state read back with another character loaded")
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+)
+
+// Bumped whenever what is written of a GameState changes
+const stateFileVersion = 1
+
+// What a GameState was saved with, which has to be loaded again before it
+// can be read back
+type stateHeader struct {
+	Version int
+	Engine  string
+	Defs    [MaxSimul*2 + MaxAttachedChar]string
+	Chars   [MaxSimul*2 + MaxAttachedChar]int
+	Stage   string
+}
+
+// Types that are written as the index of an asset or character of the
+// loaded match, instead of a copy of what they point to
+var stateAssetTypes = []reflect.Type{
+	reflect.TypeOf((*Char)(nil)), reflect.TypeOf((*Sff)(nil)),
+	reflect.TypeOf((*Snd)(nil)), reflect.TypeOf((*Stage)(nil)),
+	reflect.TypeOf((*backGround)(nil)), reflect.TypeOf((*bgCtrl)(nil)),
+}
+
+type stateRefKey struct {
+	t reflect.Type
+	p uintptr
+}
+
+// A sprite, by the index of its sff and its group and number
+type stateSprite struct {
+	sff int
+	key [2]int16
+}
+
+// The cacheRefs of a GameState. Assets are found in the same order every
+// time the same match is loaded, so they are written by index. Every other
+// pointer, and the command lists helpers share with their root, is written
+// with what it points to the first time and by index after that, so that
+// what was shared is still shared once read back.
+type stateRefs struct {
+	assets   map[reflect.Type][]reflect.Value
+	index    map[stateRefKey]int
+	sprites  map[*Sprite]stateSprite
+	shared   map[stateRefKey]int
+	readback []reflect.Value
+}
+
+var (
+	soundsType   = reflect.TypeOf(Sounds(nil))
+	sffType      = reflect.TypeOf((*Sff)(nil))
+	spriteType   = reflect.TypeOf((*Sprite)(nil))
+	cmdListsType = reflect.TypeOf([]CommandList(nil))
+)
+
+// Finds the assets of the loaded match, and chars, the characters of the
+// state in the order of its chars field
+func newStateRefs(chars []*Char) *stateRefs {
+	r := &stateRefs{assets: make(map[reflect.Type][]reflect.Value),
+		index: make(map[stateRefKey]int), sprites: make(map[*Sprite]stateSprite),
+		shared: make(map[stateRefKey]int)}
+	for _, t := range stateAssetTypes {
+		r.assets[t] = nil
+	}
+	for _, c := range chars {
+		r.add(c)
+	}
+	for i := range sys.cgi {
+		r.addSff(sys.cgi[i].sff)
+		r.add(sys.cgi[i].snd)
+	}
+	r.addSff(sys.lifebar.sff)
+	r.addSff(sys.lifebar.fsff)
+	r.add(sys.lifebar.snd)
+	r.add(sys.lifebar.fsnd)
+	if s := sys.stage; s != nil {
+		r.add(s)
+		r.addSff(s.sff)
+		for _, b := range s.bg {
+			r.add(b)
+		}
+		for i := range s.bgc {
+			r.add(&s.bgc[i])
+		}
+	}
+	return r
+}
+func (r *stateRefs) add(v interface{}) {
+	p := reflect.ValueOf(v)
+	if p.IsNil() {
+		return
+	}
+	k := stateRefKey{p.Type(), p.Pointer()}
+	if _, ok := r.index[k]; !ok {
+		r.index[k] = len(r.assets[k.t])
+		r.assets[k.t] = append(r.assets[k.t], p)
+	}
+}
+func (r *stateRefs) addSff(s *Sff) {
+	i := len(r.assets[sffType])
+	if r.add(s); len(r.assets[sffType]) == i {
+		return
+	}
+	for k, spr := range s.sprites {
+		if _, ok := r.sprites[spr]; !ok {
+			r.sprites[spr] = stateSprite{i, k}
+		}
+	}
+}
+
+func (r *stateRefs) write(e *cacheEncoder, v reflect.Value) (bool, error) {
+	t := v.Type()
+	switch {
+	case t == soundsType:
+		// Sound playback is left as it is
+		return true, nil
+	case t == spriteType:
+		if v.IsNil() {
+			e.uvarint(0)
+			return true, nil
+		}
+		s, ok := r.sprites[v.Interface().(*Sprite)]
+		if !ok {
+			return true, Error("State refers to a sprite of an sff that is not loaded")
+		}
+		e.uvarint(uint64(s.sff) + 1)
+		e.varint(int64(s.key[0]))
+		e.varint(int64(s.key[1]))
+		return true, nil
+	case t == cmdListsType:
+		if v.Len() == 0 {
+			e.uvarint(0)
+			return true, nil
+		}
+		if r.writeShared(e, v) {
+			return true, nil
+		}
+		e.uvarint(uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := e.value(v.Index(i)); err != nil {
+				return true, err
+			}
+		}
+		return true, nil
+	case t.Kind() != reflect.Ptr:
+		return false, nil
+	}
+	if v.IsNil() {
+		e.uvarint(0)
+		return true, nil
+	}
+	if _, ok := r.assets[t]; ok {
+		i, ok := r.index[stateRefKey{t, v.Pointer()}]
+		if !ok {
+			return true, Error("State refers to a " + t.Elem().Name() +
+				" that is not loaded")
+		}
+		e.uvarint(uint64(i) + 1)
+		return true, nil
+	}
+	if r.writeShared(e, v) {
+		return true, nil
+	}
+	return true, e.value(v.Elem())
+}
+
+// Writes the index of a pointer or slice already written and returns true,
+// or gives it the next index and returns false
+func (r *stateRefs) writeShared(e *cacheEncoder, v reflect.Value) bool {
+	k := stateRefKey{v.Type(), v.Pointer()}
+	if i, ok := r.shared[k]; ok {
+		e.uvarint(uint64(i) + 1)
+		return true
+	}
+	r.shared[k] = len(r.shared)
+	e.uvarint(uint64(len(r.shared)))
+	return false
+}
+
+func (r *stateRefs) read(d *cacheDecoder, v reflect.Value) bool {
+	t := v.Type()
+	switch {
+	case t == soundsType:
+		return true
+	case t == spriteType:
+		if i := d.uvarint(); i > 0 {
+			sffs := r.assets[sffType]
+			if i > uint64(len(sffs)) {
+				panic(Error("State refers to an sff that is not loaded"))
+			}
+			key := [...]int16{int16(d.varint()), int16(d.varint())}
+			v.Set(reflect.ValueOf(sffs[i-1].Interface().(*Sff).sprites[key]))
+		}
+		return true
+	case t == cmdListsType:
+		if !r.readShared(d, v) {
+			n := d.uvarint()
+			if n > uint64(d.r.Len()) {
+				panic(Error("State data cut short"))
+			}
+			s := reflect.MakeSlice(t, int(n), int(n))
+			r.readback[len(r.readback)-1] = s
+			v.Set(s)
+			for i := 0; i < s.Len(); i++ {
+				d.value(s.Index(i))
+			}
+		}
+		return true
+	case t.Kind() != reflect.Ptr:
+		return false
+	}
+	if list, ok := r.assets[t]; ok {
+		if i := d.uvarint(); i > 0 {
+			if i > uint64(len(list)) {
+				panic(Error("State refers to a " + t.Elem().Name() +
+					" that is not loaded"))
+			}
+			v.Set(list[i-1])
+		}
+		return true
+	}
+	if !r.readShared(d, v) {
+		p := reflect.New(t.Elem())
+		r.readback[len(r.readback)-1] = p
+		v.Set(p)
+		d.value(p.Elem())
+	}
+	return true
+}
+
+// Sets v to a pointer or slice already read and returns true, or returns
+// false if it is read for the first time, leaving a place for it in read
+func (r *stateRefs) readShared(d *cacheDecoder, v reflect.Value) bool {
+	i := d.uvarint()
+	switch {
+	case i == 0:
+		return true
+	case i <= uint64(len(r.readback)):
+		if r.readback[i-1].Type() != v.Type() {
+			panic(Error("State data corrupt"))
+		}
+		v.Set(r.readback[i-1])
+		return true
+	case i == uint64(len(r.readback))+1:
+		r.readback = append(r.readback, reflect.Value{})
+		return false
+	}
+	panic(Error("State data corrupt"))
+}
+
+// The header of the loaded match, for a state with the given number of
+// characters of each player
+func newStateHeader(chars [MaxSimul*2 + MaxAttachedChar]int) stateHeader {
+	h := stateHeader{Version: stateFileVersion, Engine: cacheEngineHash(),
+		Chars: chars}
+	for i, n := range chars {
+		if n > 0 {
+			h.Defs[i] = sys.cgi[i].def
+		}
+	}
+	if sys.stage != nil {
+		h.Stage = sys.stage.def
+	}
+	return h
+}
+
+// Writes the state, which must have been saved in the match that is loaded
+func (gs *GameState) encode() ([]byte, error) {
+	if !gs.compatible() {
+		return nil, Error("State was saved with other characters or another stage")
+	}
+	var n [MaxSimul*2 + MaxAttachedChar]int
+	var chars []*Char
+	for i, p := range gs.chars {
+		n[i] = len(p)
+		chars = append(chars, p...)
+	}
+	h := newStateHeader(n)
+	e := cacheEncoder{}
+	if err := e.value(reflect.ValueOf(&h).Elem()); err != nil {
+		return nil, err
+	}
+	e.refs = newStateRefs(chars)
+	if err := e.value(reflect.ValueOf(gs).Elem()); err != nil {
+		return nil, err
+	}
+	return e.buf.Bytes(), nil
+}
+
+// Reads back a state written by encode, in the match it was saved in. The
+// characters of the match are restored in place, and helpers that are gone
+// are made again.
+func decodeState(b []byte) (gs *GameState, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			gs, err = nil, Error(fmt.Sprint("Invalid state data: ", r))
+		}
+	}()
+	d := cacheDecoder{r: bytes.NewReader(b)}
+	var h stateHeader
+	d.value(reflect.ValueOf(&h).Elem())
+	if h.Version != stateFileVersion || h.Engine != cacheEngineHash() {
+		return nil, Error("State was saved by another version of the engine")
+	}
+	if newStateHeader(h.Chars) != h {
+		return nil, Error("State was saved with other characters or another stage")
+	}
+	var chars []*Char
+	for i, n := range h.Chars {
+		if (n > 0) != (len(sys.chars[i]) > 0) || n > int(sys.helperMax)+1 {
+			return nil, Error("State was saved with other characters or another stage")
+		}
+		for j := 0; j < n; j++ {
+			if j < len(sys.chars[i]) {
+				chars = append(chars, sys.chars[i][j])
+			} else {
+				chars = append(chars, newChar(i, int32(j)))
+			}
+		}
+	}
+	d.refs = newStateRefs(chars)
+	gs = &GameState{}
+	d.value(reflect.ValueOf(gs).Elem())
+	return gs, nil
+}
+
+// Writes the state to a file, that can be read back with readStateFile
+func (gs *GameState) writeFile(filename string) error {
+	b, err := gs.encode()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0644)
+}
+func readStateFile(filename string) (*GameState, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return decodeState(b)
+}
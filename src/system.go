@@ -111,6 +111,10 @@ type System struct {
 	widthScale, heightScale float32
 	window                  *Window
 	gameEnd, frameSkip      bool
+	headless                bool
+	noOptimize              bool
+	noCache                 bool
+	bytecodeDump            io.Writer
 	redrawWait              struct{ nextTime, lastDraw time.Time }
 	brightness              int32
 	roundTime               int32
@@ -132,7 +136,9 @@ type System struct {
 	keyState                map[glfw.Key]bool
 	netInput                *NetInput
 	fileInput               *FileInput
+	localInput              *LocalInput
 	aiInput                 [MaxSimul*2 + MaxAttachedChar]AiInput
+	aiController            [MaxSimul*2 + MaxAttachedChar]AiController
 	keyConfig               []KeyConfig
 	joystickConfig          []KeyConfig
 	com                     [MaxSimul*2 + MaxAttachedChar]float32
@@ -142,6 +148,8 @@ type System struct {
 	match                   int32
 	inputRemap              [MaxSimul*2 + MaxAttachedChar]int
 	listenPort              string
+	rollbackFrames          int32
+	spectatorDelay          int32
 	round                   int32
 	intro                   int32
 	time                    int32
@@ -162,8 +170,12 @@ type System struct {
 	loadMutex               sync.Mutex
 	ignoreMostErrors        bool
 	stringPool              [MaxSimul*2 + MaxAttachedChar]StringPool
+	constCache              [MaxSimul*2 + MaxAttachedChar][]constCacheEntry
+	constGen                uint32
 	bcStack, bcVarStack     BytecodeStack
 	bcVar                   []BytecodeValue
+	loopJump                LoopJump
+	loopIterations          int32
 	workingChar             *Char
 	workingState            *StateBytecode
 	specialFlag             GlobalSpecialFlag
@@ -268,6 +280,7 @@ type System struct {
 	allowDebugMode          bool
 	commonAir               string
 	commonCmd               string
+	commonCmdFile           string
 	keyInput                glfw.Key
 	keyString               string
 	timerCount              []int32
@@ -314,44 +327,52 @@ type System struct {
 	vRetrace   int
 	pngFilter  bool // Controls the GL_TEXTURE_MAG_FILTER on 32bit sprites
 
-	gameMode        string
-	frameCounter    int32
-	motifDir        string
-	captureNum      int
-	roundType       [2]RoundType
-	timerStart      int32
-	timerRounds     []int32
-	scoreStart      [2]float32
-	scoreRounds     [][2]float32
-	matchData       *lua.LTable
-	consecutiveWins [2]int32
-	teamLeader      [2]int
-	commonConst     string
-	commonLua       []string
-	commonStates    []string
-	gameSpeed       float32
-	maxPowerMode    bool
-	clsnText        []ClsnText
-	consoleText     []string
-	consoleRows     int
-	clipboardRows   int
-	luaLState       *lua.LState
-	statusLFunc     *lua.LFunction
-	listLFunc       []*lua.LFunction
-	introSkipped    bool
-	fightOver       bool
-	endMatch        bool
-	continueFlg     bool
-	dialogueFlg     bool
-	dialogueForce   int
-	dialogueBarsFlg bool
-	noSoundFlg      bool
-	postMatchFlg    bool
-	brightnessOld   int32
-	clsnDarken      bool
-	maxBgmVolume    int
-	stereoEffects   bool
-	panningRange    float32
+	gameMode         string
+	frameCounter     int32
+	motifDir         string
+	captureNum       int
+	roundType        [2]RoundType
+	timerStart       int32
+	timerRounds      []int32
+	scoreStart       [2]float32
+	scoreRounds      [][2]float32
+	matchData        *lua.LTable
+	matchResult      *MatchResult
+	resultsFile      string
+	profiler         Profiler
+	inputDisplay     bool
+	inputHistory     [MaxSimul*2 + MaxAttachedChar]InputHistory
+	frameDataDisplay bool
+	frameData        [MaxSimul*2 + MaxAttachedChar]FrameDataTracker
+	fightCam         struct{ x, y, newx, newy, l, r, scl, sclmul float32 }
+	consecutiveWins  [2]int32
+	teamLeader       [2]int
+	commonConst      string
+	commonLua        []string
+	commonStates     []string
+	gameSpeed        float32
+	maxPowerMode     bool
+	clsnText         []ClsnText
+	consoleText      []string
+	consoleRows      int
+	clipboardRows    int
+	luaLState        *lua.LState
+	statusLFunc      *lua.LFunction
+	listLFunc        []*lua.LFunction
+	introSkipped     bool
+	fightOver        bool
+	endMatch         bool
+	continueFlg      bool
+	dialogueFlg      bool
+	dialogueForce    int
+	dialogueBarsFlg  bool
+	noSoundFlg       bool
+	postMatchFlg     bool
+	brightnessOld    int32
+	clsnDarken       bool
+	maxBgmVolume     int
+	stereoEffects    bool
+	panningRange     float32
 }
 
 type Window struct {
@@ -380,7 +401,7 @@ func (s *System) newWindow(w, h int) (*Window, error) {
 		}
 		window.SetInputMode(glfw.CursorMode, glfw.CursorHidden)
 		vm := monitor.GetVideoMode()
-		x, y = (vm.Width - w) / 2, (vm.Height - h) / 2
+		x, y = (vm.Width-w)/2, (vm.Height-h)/2
 	} else {
 		if window, err = glfw.CreateWindow(w, h, s.windowTitle, nil, nil); err != nil {
 			return nil, fmt.Errorf("failed to create window: %w", err)
@@ -409,6 +430,60 @@ func (w *Window) toggleFullscreen() {
 // Initialize stuff, this is called after the config int at main.go
 func (s *System) init(w, h int32) *lua.LState {
 	s.setWindowSize(w, h)
+	var err error
+	if !s.headless {
+		s.initWindow()
+	}
+	l := lua.NewState()
+	l.Options.IncludeGoStackTrace = true
+	l.OpenLibs()
+	for i := range s.inputRemap {
+		s.inputRemap[i] = i
+	}
+	for i := range s.stringPool {
+		s.stringPool[i] = *NewStringPool()
+	}
+	s.clsnSpr = *newSprite()
+	s.clsnSpr.Size, s.clsnSpr.Pal = [...]uint16{1, 1}, make([]uint32, 256)
+	s.clsnSpr.SetPxl([]byte{0})
+	systemScriptInit(l)
+	s.shortcutScripts = make(map[ShortcutKey]*ShortcutScript)
+	// So now that we have a window we add a icon.
+	if len(s.windowMainIconLocation) > 0 && !s.headless {
+		// First we initialize arrays.
+		var f = make([]io.ReadCloser, len(s.windowMainIconLocation))
+		s.windowMainIcon = make([]image.Image, len(s.windowMainIconLocation))
+		// And then we load them.
+		for i, iconLocation := range s.windowMainIconLocation {
+			f[i], err = os.Open(iconLocation)
+			if err != nil {
+				var dErr = "Icon file can not be found.\nPanic: " + err.Error()
+				dialog.Message(dErr).Title("I.K.E.M.E.N Error").Error()
+				panic(Error(dErr))
+			}
+			s.windowMainIcon[i], _, err = image.Decode(f[i])
+		}
+		s.window.Window.SetIcon(s.windowMainIcon)
+		chk(err)
+	}
+	// [Icon add end]
+
+	// Error print?
+	go func() {
+		stdin := bufio.NewScanner(os.Stdin)
+		for stdin.Scan() {
+			if err := stdin.Err(); err != nil {
+				s.errLog.Println(err.Error())
+				return
+			}
+			s.commandLine <- stdin.Text()
+		}
+	}()
+	return l
+}
+
+// Creates the window and initializes OpenGL and audio, skipped in headless mode
+func (s *System) initWindow() {
 	var err error
 	// Create a GLWF window.
 	glfw.WindowHint(glfw.Resizable, glfw.False)
@@ -468,52 +543,6 @@ func (s *System) init(w, h int32) *lua.LState {
 	s.audioOpen()
 	sr := beep.SampleRate(Mp3SampleRate)
 	speaker.Init(sr, sr.N(time.Second/10))
-	l := lua.NewState()
-	l.Options.IncludeGoStackTrace = true
-	l.OpenLibs()
-	for i := range s.inputRemap {
-		s.inputRemap[i] = i
-	}
-	for i := range s.stringPool {
-		s.stringPool[i] = *NewStringPool()
-	}
-	s.clsnSpr = *newSprite()
-	s.clsnSpr.Size, s.clsnSpr.Pal = [...]uint16{1, 1}, make([]uint32, 256)
-	s.clsnSpr.SetPxl([]byte{0})
-	systemScriptInit(l)
-	s.shortcutScripts = make(map[ShortcutKey]*ShortcutScript)
-	// So now that we have a window we add a icon.
-	if len(s.windowMainIconLocation) > 0 {
-		// First we initialize arrays.
-		var f = make([]io.ReadCloser, len(s.windowMainIconLocation))
-		s.windowMainIcon = make([]image.Image, len(s.windowMainIconLocation))
-		// And then we load them.
-		for i, iconLocation := range s.windowMainIconLocation {
-			f[i], err = os.Open(iconLocation)
-			if err != nil {
-				var dErr = "Icon file can not be found.\nPanic: " + err.Error()
-				dialog.Message(dErr).Title("I.K.E.M.E.N Error").Error()
-				panic(Error(dErr))
-			}
-			s.windowMainIcon[i], _, err = image.Decode(f[i])
-		}
-		s.window.Window.SetIcon(s.windowMainIcon)
-		chk(err)
-	}
-	// [Icon add end]
-
-	// Error print?
-	go func() {
-		stdin := bufio.NewScanner(os.Stdin)
-		for stdin.Scan() {
-			if err := stdin.Err(); err != nil {
-				s.errLog.Println(err.Error())
-				return
-			}
-			s.commandLine <- stdin.Text()
-		}
-	}()
-	return l
 }
 func (s *System) setWindowSize(w, h int32) {
 	s.scrrect[2], s.scrrect[3] = w, h
@@ -530,6 +559,9 @@ func (s *System) eventUpdate() bool {
 	for _, v := range s.shortcutScripts {
 		v.Activate = false
 	}
+	if s.headless {
+		return !s.gameEnd
+	}
 	glfw.PollEvents()
 	s.gameEnd = s.window.Window.ShouldClose()
 	return !s.gameEnd
@@ -545,6 +577,13 @@ func (s *System) runMainThreadTask() {
 	}
 }
 func (s *System) await(fps int) bool {
+	if s.headless {
+		// No window to present to, so every frame is skipped and the
+		// simulation runs as fast as possible
+		s.runMainThreadTask()
+		s.frameSkip = true
+		return s.eventUpdate()
+	}
 	if !s.frameSkip {
 		// Render the finished frame
 		unbindFB()
@@ -584,10 +623,17 @@ func (s *System) await(fps int) bool {
 func (s *System) update() bool {
 	s.frameCounter++
 	if s.fileInput != nil {
-		if s.anyHardButton() {
+		switch {
+		case s.fileInput.seeking():
+			// Frames are neither drawn nor waited for until the replay
+			// viewer gets to where it is seeking
+			s.runMainThreadTask()
+			s.frameSkip = true
+			s.eventUpdate()
+		case s.anyHardButton():
 			s.await(FPS * 4)
-		} else {
-			s.await(FPS)
+		default:
+			s.await(FPS * s.fileInput.speed)
 		}
 		return s.fileInput.Update()
 	}
@@ -595,6 +641,10 @@ func (s *System) update() bool {
 		s.await(FPS)
 		return s.netInput.Update()
 	}
+	if s.localInput != nil {
+		s.await(FPS)
+		return s.localInput.Update()
+	}
 	return s.await(FPS)
 }
 func (s *System) audioOpen() {
@@ -697,6 +747,8 @@ func (s *System) synchronize() error {
 		s.fileInput.Synchronize()
 	} else if s.netInput != nil {
 		return s.netInput.Synchronize()
+	} else if s.localInput != nil {
+		s.localInput.Synchronize()
 	}
 	return nil
 }
@@ -720,6 +772,9 @@ func (s *System) anyButton() bool {
 	if s.netInput != nil {
 		return s.netInput.AnyButton()
 	}
+	if s.localInput != nil {
+		return s.localInput.AnyButton()
+	}
 	return s.anyHardButton()
 }
 func (s *System) playerID(id int32) *Char {
@@ -1016,6 +1071,7 @@ func (s *System) commandUpdate() {
 				for j := range r.cmd {
 					r.cmd[j].BufReset()
 				}
+				s.inputHistory[i].clear()
 				continue
 			}
 			act := true
@@ -1048,11 +1104,16 @@ func (s *System) commandUpdate() {
 					}
 				}
 			}
+			if s.inputDisplay && s.gameMode == "training" && i < len(r.cmd) {
+				s.inputHistory[i].record(&r.cmd[i])
+			}
 			if r.key < 0 {
 				cc := int32(-1)
 				// AI Scaling
 				// TODO: Balance AI Scaling
-				if r.roundState() == 2 && RandF32(0, sys.com[i]/2+32) > 32 {
+				// Players with an AiController only use the commands they input
+				if r.roundState() == 2 && s.aiController[i] == nil &&
+					RandF32(0, sys.com[i]/2+32) > 32 {
 					cc = Rand(0, int32(len(r.cmd[r.ss.sb.playerNo].Commands))-1)
 				} else {
 					cc = -1
@@ -1158,8 +1219,18 @@ func (s *System) action(x, y *float32, scl float32) (leftest, rightest,
 		if s.superanim != nil {
 			s.superanim.Action()
 		}
+		if s.profiler.enabled {
+			s.profiler.frames++
+		}
 		s.charList.action(*x, &cvmin, &cvmax,
 			&highest, &lowest, &leftest, &rightest)
+		if s.frameDataDisplay && s.gameMode == "training" {
+			for i, p := range s.chars {
+				if len(p) > 0 {
+					s.frameData[i].update(p[0])
+				}
+			}
+		}
 		s.nomusic = s.sf(GSF_nomusic) && !sys.postMatchFlg
 	} else {
 		s.charUpdate(&cvmin, &cvmax, &highest, &lowest, &leftest, &rightest)
@@ -1676,6 +1747,10 @@ func (s *System) drawDebug() {
 		for _, s := range s.consoleText {
 			put(&x, &y, s)
 		}
+		//Profiler
+		for _, s := range s.profiler.overlay(5) {
+			put(&x, &y, s)
+		}
 		//Data
 		pn := s.debugRef[0]
 		hn := s.debugRef[1]
@@ -1753,6 +1828,7 @@ func (s *System) fight() (reload bool) {
 	var fvar [len(s.chars)][]float32
 	var dialogue [len(s.chars)][]string
 	var mapArray [len(s.chars)]map[string]float32
+	var mapValues [len(s.chars)]map[string]BytecodeValue
 	var remapSpr [len(s.chars)]RemapPreset
 	// Anonymous function to assign initial character values
 	copyVar := func(pn int) {
@@ -1774,6 +1850,10 @@ func (s *System) fight() (reload bool) {
 		for k, v := range s.chars[pn][0].mapArray {
 			mapArray[pn][k] = v
 		}
+		mapValues[pn] = make(map[string]BytecodeValue)
+		for k, v := range s.chars[pn][0].mapValues {
+			mapValues[pn][k] = v
+		}
 		remapSpr[pn] = make(RemapPreset)
 		for k, v := range s.chars[pn][0].remapSpr {
 			remapSpr[pn][k] = v
@@ -1804,6 +1884,9 @@ func (s *System) fight() (reload bool) {
 	if s.netInput != nil {
 		defer s.netInput.Stop()
 	}
+	if s.localInput != nil {
+		defer s.localInput.Stop()
+	}
 	s.wincnt.init()
 
 	// Initialize super meter values, and max power for teams sharing meter
@@ -1924,6 +2007,7 @@ func (s *System) fight() (reload bool) {
 				for k, v := range p[0].mapDefault {
 					p[0].mapArray[k] = v
 				}
+				p[0].mapValues = nil
 				p[0].remapSpr = make(RemapPreset)
 
 				// Reset hitScale
@@ -1954,8 +2038,7 @@ func (s *System) fight() (reload bool) {
 
 	oldWins, oldDraws := s.wins, s.draws
 	oldTeamLeader := s.teamLeader
-	var x, y, newx, newy, l, r float32
-	var scl, sclmul float32
+	fc := &s.fightCam
 	// Anonymous function to reset values, called at the start of each round
 	reset := func() {
 		s.wins, s.draws = oldWins, oldDraws
@@ -1974,6 +2057,10 @@ func (s *System) fight() (reload bool) {
 				for k, v := range mapArray[i] {
 					p[0].mapArray[k] = v
 				}
+				p[0].mapValues = make(map[string]BytecodeValue)
+				for k, v := range mapValues[i] {
+					p[0].mapValues[k] = v
+				}
 				p[0].remapSpr = make(RemapPreset)
 				for k, v := range remapSpr[i] {
 					p[0].remapSpr[k] = v
@@ -1989,24 +2076,45 @@ func (s *System) fight() (reload bool) {
 		s.nextRound()
 		s.roundResetFlg, s.introSkipped = false, false
 		s.reloadFlg, s.reloadStageFlg, s.reloadLifebarFlg = false, false, false
-		x, y, newx, newy, l, r, sclmul = 0, 0, 0, 0, 0, 0, 1
-		scl = s.cam.startzoom
-		s.cam.Update(scl, x, y)
+		fc.x, fc.y, fc.newx, fc.newy, fc.l, fc.r, fc.sclmul = 0, 0, 0, 0, 0, 0, 1
+		fc.scl = s.cam.startzoom
+		s.cam.Update(fc.scl, fc.x, fc.y)
 	}
-	reset()
+	// Updates camera, stage and game state for one frame
+	simulate := func() {
+		// Update camera
+		fc.scl = s.cam.ScaleBound(fc.scl, fc.sclmul)
+		tmp := (float32(s.gameWidth) / 2) / fc.scl
+		if AbsF((fc.l+fc.r)-(fc.newx-fc.x)*2) >= tmp/2 {
+			tmp = MaxF(0, MinF(tmp, MaxF((fc.newx-fc.x)-fc.l, fc.r-(fc.newx-fc.x))))
+		}
+		fc.x = s.cam.XBound(fc.scl, MinF(fc.x+fc.l+tmp, MaxF(fc.x+fc.r-tmp, fc.newx)))
+		if !s.cam.ZoomEnable {
+			// Pos X の誤差が出ないように精度を落とす
+			fc.x = float32(math.Ceil(float64(fc.x)*4-0.5) / 4)
+		}
+		fc.y = s.cam.YBound(fc.scl, fc.newy)
 
-	// Loop until end of match
-	fin := false
-	for !s.endMatch {
-		s.step = false
-		for _, v := range s.shortcutScripts {
-			if v.Activate {
-				if err := s.luaLState.DoString(v.Script); err != nil {
-					s.errLog.Println(err.Error())
-				}
-			}
+		// If frame is ready to tick and not paused
+		if s.tickFrame() && (s.super <= 0 || !s.superpausebg) &&
+			(s.pause <= 0 || !s.pausebg) {
+			// Update stage
+			s.stage.action()
 		}
 
+		// Update game state
+		fc.newx, fc.newy = fc.x, fc.y
+		fc.l, fc.r, fc.sclmul = s.action(&fc.newx, &fc.newy, fc.scl)
+	}
+	reset()
+	// Runs one frame of the match: the end of the round, the camera, stage
+	// and game state, and the restart of the round. Returns false once the
+	// fight has to be restarted for the next character in turns mode.
+	fin, nextChar := false, false
+	runFrame := func() bool {
+		if nextChar {
+			return false
+		}
 		// If next round
 		if s.roundOver() && !fin {
 			s.round++
@@ -2044,6 +2152,7 @@ func (s *System) fight() (reload bool) {
 			}
 			s.matchData.RawSetInt(int(s.round-1), tbl_roundNo)
 			s.scoreRounds = append(s.scoreRounds, [2]float32{s.lifebar.sc[0].scorePoints, s.lifebar.sc[1].scorePoints})
+			s.recordRoundResult()
 			oldTeamLeader = s.teamLeader
 
 			if !s.matchOver() && (s.tmode[0] != TM_Turns || s.chars[0][0].win()) &&
@@ -2081,9 +2190,10 @@ func (s *System) fight() (reload bool) {
 					}
 				}
 				// If match isn't over, presumably this is turns mode,
-				// so break to restart fight for the next character
+				// so end the fight to restart it for the next character
 				if !s.matchOver() {
-					break
+					nextChar = true
+					return false
 				}
 
 				// Otherwise match is over
@@ -2092,34 +2202,58 @@ func (s *System) fight() (reload bool) {
 			}
 		}
 
-		// Update camera
-		scl = s.cam.ScaleBound(scl, sclmul)
-		tmp := (float32(s.gameWidth) / 2) / scl
-		if AbsF((l+r)-(newx-x)*2) >= tmp/2 {
-			tmp = MaxF(0, MinF(tmp, MaxF((newx-x)-l, r-(newx-x))))
-		}
-		x = s.cam.XBound(scl, MinF(x+l+tmp, MaxF(x+r-tmp, newx)))
-		if !s.cam.ZoomEnable {
-			// Pos X の誤差が出ないように精度を落とす
-			x = float32(math.Ceil(float64(x)*4-0.5) / 4)
-		}
-		y = s.cam.YBound(scl, newy)
-
-		// If frame is ready to tick and not paused
-		if s.tickFrame() && (s.super <= 0 || !s.superpausebg) &&
-			(s.pause <= 0 || !s.pausebg) {
-			// Update stage
-			s.stage.action()
-		}
-
-		// Update game state
-		newx, newy = x, y
-		l, r, sclmul = s.action(&newx, &newy, scl)
+		simulate()
 
 		// F4 pressed to restart round
 		if s.roundResetFlg && !s.postMatchFlg {
 			reset()
 		}
+		return true
+	}
+
+	// Loads a state saved during this match, along with what is kept here
+	loadState := func(gs *GameState) {
+		s.loadState(gs)
+		fin, nextChar = s.postMatchFlg, false
+	}
+
+	// Rollback netplay simulates frames again without drawing them, so it
+	// keeps a state for each frame that may still be mispredicted
+	if s.netInput != nil && s.rollbackFrames > 0 {
+		var states [32]*GameState
+		s.netInput.StartRollback(s.rollbackFrames, func(t int32) {
+			states[t&31] = s.saveState()
+		}, func(t int32) {
+			loadState(states[t&31])
+		}, func() {
+			for runFrame() && !s.addFrameTime(s.turbo) {
+			}
+		})
+		defer s.netInput.StopRollback()
+	}
+	if s.netInput != nil {
+		s.netInput.StartCheck()
+		defer s.netInput.StopCheck()
+	}
+	if s.fileInput != nil {
+		s.fileInput.StartViewer(loadState)
+		defer s.fileInput.StopViewer()
+	}
+
+	// Loop until end of match
+	for !s.endMatch {
+		s.step = false
+		for _, v := range s.shortcutScripts {
+			if v.Activate {
+				if err := s.luaLState.DoString(v.Script); err != nil {
+					s.errLog.Println(err.Error())
+				}
+			}
+		}
+
+		if !runFrame() {
+			break
+		}
 		// Shift+F4 pressed to restart match
 		if s.reloadFlg {
 			return true
@@ -2134,16 +2268,16 @@ func (s *System) fight() (reload bool) {
 		}
 		// Render frame
 		if !s.frameSkip {
-			dx, dy, dscl := x, y, scl
+			dx, dy, dscl := fc.x, fc.y, fc.scl
 			if s.enableZoomstate {
 				if !s.debugPaused() {
 					s.zoomPosXLag += ((s.zoomPos[0] - s.zoomPosXLag) * (1 - s.zoomlag))
 					s.zoomPosYLag += ((s.zoomPos[1] - s.zoomPosYLag) * (1 - s.zoomlag))
-					s.drawScale = s.drawScale / (s.drawScale + (s.zoomScale*scl-s.drawScale)*s.zoomlag) * s.zoomScale * scl
+					s.drawScale = s.drawScale / (s.drawScale + (s.zoomScale*fc.scl-s.drawScale)*s.zoomlag) * s.zoomScale * fc.scl
 				}
 				dscl = MaxF(s.cam.MinScale, s.drawScale/s.cam.BaseScale())
-				dx = s.cam.XBound(dscl, x+s.zoomPosXLag/scl)
-				dy = y + s.zoomPosYLag
+				dx = s.cam.XBound(dscl, fc.x+s.zoomPosXLag/fc.scl)
+				dy = fc.y + s.zoomPosYLag
 			} else {
 				s.zoomlag = 0
 				s.zoomPosXLag = 0
@@ -2163,6 +2297,7 @@ func (s *System) fight() (reload bool) {
 		// Render debug elements
 		if !s.frameSkip {
 			s.drawTop()
+			s.drawInputDisplay()
 			s.drawDebug()
 		}
 
@@ -2754,7 +2889,7 @@ func (l *Loader) loadChar(pn int) int {
 	sys.chars[pn][0] = p
 	if sys.cgi[pn].sff == nil {
 		if sys.cgi[pn].states, l.err =
-			newCompiler().Compile(p.playerNo, cdef); l.err != nil {
+			compileChar(p.playerNo, cdef); l.err != nil {
 			sys.chars[pn] = nil
 			tstr = fmt.Sprintf("WARNING: Failed to compile new char states: %v", cdef)
 			return -1
@@ -2820,7 +2955,7 @@ func (l *Loader) loadAttachedChar(pn int) int {
 	sys.chars[pn][0] = p
 	if sys.cgi[pn].sff == nil {
 		if sys.cgi[pn].states, l.err =
-			newCompiler().Compile(p.playerNo, cdef); l.err != nil {
+			compileChar(p.playerNo, cdef); l.err != nil {
 			sys.chars[pn] = nil
 			tstr = fmt.Sprintf("WARNING: Failed to compile new attachedchar states: %v", cdef)
 			return -1